@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// An Input is a channel a Streamer reads records from. InputOf adapts channels of any type,
+// so a Streamer can read from them without relaying their records through another channel
+type Input interface {
+	// Receive reads the next record, returning false once the channel has been closed or stop is closed
+	Receive(stop <-chan struct{}) (interface{}, bool)
+}
+
+// An Output is a channel a stage writes records to. OutputOf adapts channels of any type, so a
+// stage can write to them without relaying its records through another channel
+type Output interface {
+	// Send writes rec to the channel, returning false if quit is closed first. An error is returned
+	// if rec can not be written to the channel because of its type
+	Send(quit <-chan struct{}, rec interface{}) (bool, error)
+	// Close closes the channel
+	Close()
+}
+
+// InputOf adapts a channel of T into an Input
+func InputOf[T any](in <-chan T) Input {
+	return chanInput[T](in)
+}
+
+// OutputOf adapts a channel of T into an Output. Records which are not a T, including nil unless T
+// is an interface, are returned as errors by Send instead of being written
+func OutputOf[T any](out chan T) Output {
+	return chanOutput[T](out)
+}
+
+// chanInput is an Input which reads from a channel of T
+type chanInput[T any] <-chan T
+
+func (in chanInput[T]) Receive(stop <-chan struct{}) (interface{}, bool) {
+	select {
+	case <-stop:
+		return nil, false
+	case rec, ok := <-in:
+		return rec, ok
+	}
+}
+
+// chanOutput is an Output which writes to a channel of T
+type chanOutput[T any] chan T
+
+func (out chanOutput[T]) Send(quit <-chan struct{}, rec interface{}) (bool, error) {
+	typed, ok := rec.(T)
+	if !ok && (rec != nil || typeOf[T]().Kind() != reflect.Interface) {
+		return false, fmt.Errorf("Expected a %v, received %T", typeOf[T](), rec)
+	}
+	select {
+	case <-quit:
+		return false, nil
+	case out <- typed:
+		return true, nil
+	}
+}
+
+func (out chanOutput[T]) Close() {
+	close(out)
+}
+
+// typeOf returns the type T. Unlike the type of its zero value, it is not nil when T is an interface
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// closedChannel returns a channel which is already closed, for stages whose records are only
+// written to other outputs
+func closedChannel() chan interface{} {
+	closed := make(chan interface{})
+	close(closed)
+	return closed
+}
@@ -0,0 +1,508 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// A Checkpoint records how far a run has durably progressed through a single source
+type Checkpoint struct {
+	// Stage is the name of the stage which read the source
+	Stage string `json:"stage"`
+	// Source identifies what was read, such as the URL of a download or the path of a parsed file
+	Source string `json:"source"`
+	// Offset is the number of records at the start of the source which have been durably written,
+	// and can be skipped when resuming
+	Offset int64 `json:"offset"`
+	// Bytes is the size of the source, for sources which are stored whole such as downloads
+	Bytes int64 `json:"bytes,omitempty"`
+	// Done is whether the whole source has been durably written
+	Done bool `json:"done"`
+}
+
+// A CheckpointStore persists the Checkpoints of a run so that a later run can resume from them
+type CheckpointStore interface {
+	// Load returns the Checkpoints which were last saved
+	Load() ([]Checkpoint, error)
+	// Save replaces the saved Checkpoints
+	Save(checkpoints []Checkpoint) error
+	// Clear removes the saved Checkpoints, such as once a run has completed
+	Clear() error
+}
+
+// FileCheckpointStore is a CheckpointStore which keeps the Checkpoints in a JSON file
+type FileCheckpointStore struct {
+	Path string
+}
+
+// NewFileCheckpointStore builds a FileCheckpointStore which keeps the Checkpoints in the file at path
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{Path: path}
+}
+
+// Load reads the Checkpoints from the file. No Checkpoints are returned if the file does not exist
+func (s *FileCheckpointStore) Load() ([]Checkpoint, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	checkpoints := []Checkpoint{}
+	return checkpoints, json.Unmarshal(data, &checkpoints)
+}
+
+// Save writes the Checkpoints to the file. The file is replaced atomically, so a crash while
+// saving leaves the previous Checkpoints intact
+func (s *FileCheckpointStore) Save(checkpoints []Checkpoint) error {
+	data, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir, name := filepath.Split(s.Path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, name+".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), s.Path)
+}
+
+// Clear removes the file
+func (s *FileCheckpointStore) Clear() error {
+	if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DefaultCheckpointMaxTracked is the maximum number of records a Checkpointer tracks at once by default
+var DefaultCheckpointMaxTracked = 1000000
+
+// A Checkpointer tracks the progress of a run and saves it to a CheckpointStore.
+//
+// Sources which are stored whole, such as downloads, are checkpointed as soon as they complete.
+// Records read by parsers are tracked until they are acknowledged by a writer, and the offset of
+// their source only advances past records which have been acknowledged, so resuming never skips
+// a record which was not written. Records are tracked by identity, so only pointer and map records
+// can be tracked. A stage which replaces records must call Transfer, a stage which sends a record
+// to several outputs must call Share, and a stage which consumes records that can no longer be
+// followed (such as by grouping them) must call Release. Records which can not be followed hold
+// the offset of their source back, and are read again when resuming, so writers should be
+// idempotent (for example by giving each Elasticsearch document an id).
+//
+// All of its methods are no-ops on a nil Checkpointer
+type Checkpointer struct {
+	// MaxTracked is the maximum number of records tracked at once. Records read once it is
+	// reached are released, so a run whose sink never acknowledges its records does not grow
+	// without bound
+	MaxTracked int
+	Log        Logger
+
+	mu      sync.Mutex
+	store   CheckpointStore
+	sources map[string]*checkpointSource
+	tracked map[interface{}]*trackedRecord
+}
+
+// trackedRecord is a record which has been read but not acknowledged
+type trackedRecord struct {
+	// rec is the record, which keeps maps tracked by their address alive
+	rec    interface{}
+	source *checkpointSource
+	offset int64
+	// acks is the number of acknowledgements the record is waiting for, one for each output it was sent to
+	acks int
+}
+
+// checkpointSource is the progress through a single source
+type checkpointSource struct {
+	checkpoint Checkpoint
+	// outstanding counts the records at each offset which have been read but not acknowledged
+	outstanding map[int64]int
+	// next is the offset after the last record read
+	next int64
+	// finished is whether every record of the source has been read
+	finished bool
+	// held is whether a record of the source was released, which holds its offset at heldAt
+	held   bool
+	heldAt int64
+}
+
+// NewCheckpointer builds a Checkpointer which saves to store, resuming from the Checkpoints
+// which were last saved to it
+func NewCheckpointer(store CheckpointStore) (*Checkpointer, error) {
+	checkpoints, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Checkpointer{
+		MaxTracked: DefaultCheckpointMaxTracked,
+		Log:        DefaultLogger.WithField("task", "checkpoint"),
+		store:      store,
+		sources:    map[string]*checkpointSource{},
+		tracked:    map[interface{}]*trackedRecord{},
+	}
+	for _, checkpoint := range checkpoints {
+		c.sources[checkpointKey(checkpoint.Stage, checkpoint.Source)] = &checkpointSource{
+			checkpoint:  checkpoint,
+			outstanding: map[int64]int{},
+			next:        checkpoint.Offset,
+			finished:    checkpoint.Done,
+		}
+	}
+	return c, nil
+}
+
+// Resume returns the Checkpoint the named stage should resume reading source from. The zero
+// Checkpoint is returned if the source has not been checkpointed
+func (c *Checkpointer) Resume(stage string, source string) Checkpoint {
+	if c == nil {
+		return Checkpoint{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.source(stage, source).checkpoint
+}
+
+// Complete records that the named stage has stored the whole of source, which is size bytes,
+// and saves the Checkpoints
+func (c *Checkpointer) Complete(stage string, source string, size int64) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	progress := c.source(stage, source)
+	progress.checkpoint.Bytes = size
+	progress.finished = true
+	return c.save(true)
+}
+
+// Track records that the named stage read rec from offset of source. The offset of the source
+// will not advance past rec until it is acknowledged.
+//
+// If rec can not be tracked, because it is not a pointer or map or MaxTracked records are
+// already tracked, it is released and a warning is logged
+func (c *Checkpointer) Track(rec interface{}, stage string, source string, offset int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	progress := c.source(stage, source)
+	if offset >= progress.next {
+		progress.next = offset + 1
+	}
+
+	key, trackable := trackingKey(rec)
+	if !trackable {
+		c.hold(progress, offset, fmt.Sprintf("records of type %T can not be tracked", rec))
+		return
+	}
+	if c.MaxTracked > 0 && len(c.tracked) >= c.MaxTracked {
+		c.hold(progress, offset, "too many records are waiting to be acknowledged")
+		return
+	}
+	c.follow(key, &trackedRecord{rec: rec, source: progress, offset: offset})
+}
+
+// Finished records that the named stage has read every record of source, and saves the
+// Checkpoints if they changed
+func (c *Checkpointer) Finished(stage string, source string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.source(stage, source).finished = true
+	return c.save(false)
+}
+
+// Transfer records that a stage replaced from with the records in to, such as when mapping
+// records to a new type. The offset of the source of from will not advance until all of them
+// are acknowledged. If to is empty, from is acknowledged, as it was dropped
+func (c *Checkpointer) Transfer(from interface{}, to []interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	position := c.unfollow(from)
+	if position == nil {
+		return
+	}
+	for _, rec := range to {
+		key, trackable := trackingKey(rec)
+		if !trackable {
+			c.hold(position.source, position.offset, fmt.Sprintf("records of type %T can not be tracked", rec))
+			continue
+		}
+		c.follow(key, &trackedRecord{rec: rec, source: position.source, offset: position.offset})
+	}
+}
+
+// Share records that a stage sent rec to copies outputs, each of which will acknowledge it
+// separately, such as when a Streamer is teed. The offset of its source will not advance until
+// every copy is acknowledged
+func (c *Checkpointer) Share(rec interface{}, copies int) {
+	if c == nil || copies < 2 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, trackable := trackingKey(rec)
+	if !trackable {
+		return
+	}
+	if tracked, isTracked := c.tracked[key]; isTracked {
+		tracked.acks += copies - 1
+		tracked.source.outstanding[tracked.offset] += copies - 1
+	}
+}
+
+// Release records that rec will never be acknowledged, because a stage consumed it in a way that
+// can not be followed, such as by grouping it with other records. Its source stops advancing at
+// its offset, so it is read again when resuming, but it is no longer held in memory
+func (c *Checkpointer) Release(rec interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if position := c.unfollow(rec); position != nil {
+		c.hold(position.source, position.offset, "a stage consumed records without passing them on")
+	}
+}
+
+// Ack records that the records have been durably written, and saves the Checkpoints of any
+// sources whose offsets advanced
+func (c *Checkpointer) Ack(recs ...interface{}) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rec := range recs {
+		c.unfollow(rec)
+	}
+	return c.save(false)
+}
+
+// Checkpoints returns the current Checkpoints, ordered by stage and source
+func (c *Checkpointer) Checkpoints() []Checkpoint {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoints()
+}
+
+// Clear removes the saved Checkpoints, so the next run starts from the beginning
+func (c *Checkpointer) Clear() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sources = map[string]*checkpointSource{}
+	c.tracked = map[interface{}]*trackedRecord{}
+	return c.store.Clear()
+}
+
+// source returns the progress through source, creating it if it is not known
+func (c *Checkpointer) source(stage string, source string) *checkpointSource {
+	key := checkpointKey(stage, source)
+	progress, known := c.sources[key]
+	if !known {
+		progress = &checkpointSource{
+			checkpoint:  Checkpoint{Stage: stage, Source: source},
+			outstanding: map[int64]int{},
+		}
+		c.sources[key] = progress
+	}
+	return progress
+}
+
+// follow tracks the record until it is acknowledged. A record which is already tracked from the
+// same position waits for one more acknowledgement
+func (c *Checkpointer) follow(key interface{}, rec *trackedRecord) {
+	if tracked, isTracked := c.tracked[key]; isTracked {
+		if tracked.source != rec.source || tracked.offset != rec.offset {
+			// The record can only be followed back to one position
+			c.hold(rec.source, rec.offset, "a record was read from more than one position")
+			return
+		}
+		rec = tracked
+	} else {
+		c.tracked[key] = rec
+	}
+	rec.acks++
+	rec.source.outstanding[rec.offset]++
+}
+
+// unfollow removes one of the acknowledgements rec is waiting for, returning where it was read
+// from, or nil if it is not tracked
+func (c *Checkpointer) unfollow(rec interface{}) *trackedRecord {
+	key, trackable := trackingKey(rec)
+	if !trackable {
+		return nil
+	}
+	tracked, isTracked := c.tracked[key]
+	if !isTracked {
+		return nil
+	}
+	tracked.acks--
+	tracked.source.outstanding[tracked.offset]--
+	if tracked.acks <= 0 {
+		delete(c.tracked, key)
+	}
+	return tracked
+}
+
+// hold stops the source from advancing past offset, as a record read from it can not be
+// followed. A warning with the reason is logged the first time a source is held
+func (c *Checkpointer) hold(progress *checkpointSource, offset int64, reason string) {
+	if !progress.held {
+		c.Log.WithField("stage", progress.checkpoint.Stage).WithField("file", progress.checkpoint.Source).
+			WithField("offset", offset).Warn("Checkpoint can not advance, as " + reason)
+	}
+	if !progress.held || offset < progress.heldAt {
+		progress.held, progress.heldAt = true, offset
+	}
+}
+
+// save advances the offset of each source past its acknowledged records, and saves the
+// Checkpoints if any of them changed
+func (c *Checkpointer) save(changed bool) error {
+	for _, progress := range c.sources {
+		if progress.advance() {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return c.store.Save(c.checkpoints())
+}
+
+// checkpoints returns the current Checkpoints, ordered by stage and source
+func (c *Checkpointer) checkpoints() []Checkpoint {
+	checkpoints := make([]Checkpoint, 0, len(c.sources))
+	for _, progress := range c.sources {
+		checkpoints = append(checkpoints, progress.checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		if checkpoints[i].Stage != checkpoints[j].Stage {
+			return checkpoints[i].Stage < checkpoints[j].Stage
+		}
+		return checkpoints[i].Source < checkpoints[j].Source
+	})
+	return checkpoints
+}
+
+// advance moves the offset up to the first record which has not been acknowledged, returning
+// whether the Checkpoint changed
+func (s *checkpointSource) advance() bool {
+	offset := s.next
+	for pending, count := range s.outstanding {
+		if count <= 0 {
+			delete(s.outstanding, pending)
+		} else if pending < offset {
+			offset = pending
+		}
+	}
+	if s.held && s.heldAt < offset {
+		offset = s.heldAt
+	}
+	done := s.finished && len(s.outstanding) == 0 && !s.held
+
+	if offset <= s.checkpoint.Offset && done == s.checkpoint.Done {
+		return false
+	}
+	if offset > s.checkpoint.Offset {
+		s.checkpoint.Offset = offset
+	}
+	s.checkpoint.Done = done
+	return true
+}
+
+// checkpointKey identifies a source read by a stage
+func checkpointKey(stage string, source string) string {
+	return stage + "\x00" + source
+}
+
+// mapAddress identifies a map record by the address of its contents, as maps can not be map keys
+type mapAddress uintptr
+
+// trackingKey returns the key rec is tracked by, and whether it can be tracked by identity
+func trackingKey(rec interface{}) (interface{}, bool) {
+	if rec == nil {
+		return nil, false
+	}
+	switch value := reflect.ValueOf(rec); value.Kind() {
+	case reflect.Ptr:
+		return rec, !value.IsNil()
+	case reflect.Map:
+		return mapAddress(value.Pointer()), !value.IsNil()
+	}
+	return nil, false
+}
+
+// WithCheckpointer is a chainable configuration method that sets the Checkpointer the stages run
+// under the Controller (and its children) resume from and record their progress with. It must be
+// called before the stages are started
+func (c *Controller) WithCheckpointer(checkpointer *Checkpointer) *Controller {
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	root.checkpoints = checkpointer
+	return c
+}
+
+// Checkpointer returns the Checkpointer the stages run under the Controller record their progress
+// with, or nil if checkpointing is not enabled
+func (c *Controller) Checkpointer() *Checkpointer {
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	return root.checkpoints
+}
@@ -0,0 +1,264 @@
+package ingest
+
+import (
+	"archive/zip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type checkpointRec struct {
+	N int
+}
+
+func TestCheckpoints(t *testing.T) {
+	Convey("Checkpoints", t, func() {
+		dir, err := ioutil.TempDir("", "ingest-checkpoints")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+
+		Convey("FileCheckpointStore", func() {
+			Convey("loads nothing when there is no file", func() {
+				checkpoints, err := store.Load()
+				So(err, ShouldBeNil)
+				So(checkpoints, ShouldBeEmpty)
+			})
+
+			Convey("saves and clears checkpoints", func() {
+				saved := []Checkpoint{{Stage: "parse-csv", Source: "a.csv", Offset: 10}}
+				So(store.Save(saved), ShouldBeNil)
+				loaded, err := store.Load()
+				So(err, ShouldBeNil)
+				So(loaded, ShouldResemble, saved)
+
+				So(store.Clear(), ShouldBeNil)
+				loaded, err = store.Load()
+				So(err, ShouldBeNil)
+				So(loaded, ShouldBeEmpty)
+			})
+		})
+
+		Convey("Checkpointer", func() {
+			checkpointer, err := NewCheckpointer(store)
+			So(err, ShouldBeNil)
+			recs := []*checkpointRec{{0}, {1}, {2}, {3}}
+			for i, rec := range recs {
+				checkpointer.Track(rec, "parse-csv", "a.csv", int64(i))
+			}
+
+			Convey("only advances past acknowledged records", func() {
+				So(checkpointer.Ack(recs[0], recs[2]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 1)
+
+				So(checkpointer.Ack(recs[1]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 3)
+
+				resumed, err := NewCheckpointer(store)
+				So(err, ShouldBeNil)
+				So(resumed.Resume("parse-csv", "a.csv"), ShouldResemble, Checkpoint{Stage: "parse-csv", Source: "a.csv", Offset: 3})
+			})
+
+			Convey("is done once every record is acknowledged and the source is finished", func() {
+				So(checkpointer.Finished("parse-csv", "a.csv"), ShouldBeNil)
+				So(checkpointer.Ack(recs[0], recs[1], recs[2]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Done, ShouldBeFalse)
+
+				So(checkpointer.Ack(recs[3]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Done, ShouldBeTrue)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 4)
+			})
+
+			Convey("follows records which are transferred", func() {
+				mapped := []interface{}{&checkpointRec{10}, &checkpointRec{11}}
+				checkpointer.Transfer(recs[0], mapped)
+				checkpointer.Transfer(recs[1], nil)
+
+				So(checkpointer.Ack(mapped[0]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 0)
+
+				So(checkpointer.Ack(mapped[1]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 2)
+			})
+
+			Convey("holds back records which can not be followed", func() {
+				checkpointer.Transfer(recs[0], []interface{}{checkpointRec{10}})
+				So(checkpointer.Ack(recs[1]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 0)
+			})
+
+			Convey("waits for every copy of a shared record to be acknowledged", func() {
+				checkpointer.Share(recs[0], 2)
+				So(checkpointer.Ack(recs[0]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 0)
+
+				So(checkpointer.Ack(recs[0]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 1)
+			})
+
+			Convey("holds back released records without keeping them", func() {
+				checkpointer.Release(recs[1])
+				So(checkpointer.Finished("parse-csv", "a.csv"), ShouldBeNil)
+				So(checkpointer.Ack(recs[0], recs[2], recs[3]), ShouldBeNil)
+				So(checkpointer.tracked, ShouldBeEmpty)
+				So(checkpointer.Resume("parse-csv", "a.csv"), ShouldResemble, Checkpoint{Stage: "parse-csv", Source: "a.csv", Offset: 1})
+			})
+
+			Convey("tracks map records", func() {
+				row := map[string]interface{}{"name": "ada"}
+				checkpointer.Track(row, "parse-csv", "b.csv", 0)
+				So(checkpointer.Ack(row), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "b.csv").Offset, ShouldEqual, 1)
+			})
+
+			Convey("holds back records which can not be tracked", func() {
+				checkpointer.Track(checkpointRec{0}, "parse-csv", "b.csv", 0)
+				rec := &checkpointRec{1}
+				checkpointer.Track(rec, "parse-csv", "b.csv", 1)
+				So(checkpointer.Ack(rec), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "b.csv").Offset, ShouldEqual, 0)
+			})
+
+			Convey("stops tracking records once MaxTracked are tracked", func() {
+				checkpointer.MaxTracked = len(recs)
+				rec := &checkpointRec{4}
+				checkpointer.Track(rec, "parse-csv", "a.csv", 4)
+				So(checkpointer.tracked, ShouldHaveLength, len(recs))
+
+				So(checkpointer.Ack(recs[0], recs[1], recs[2], recs[3], rec), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 4)
+			})
+
+			Convey("waits for each branch of a Tee to acknowledge a record", func() {
+				ctrl := NewController().WithCheckpointer(checkpointer)
+				stream := StreamArray([]interface{}{recs[0]})
+				branches := stream.Tee(2)
+				stream.Start(ctrl)
+				first, second := branches[0].Start(ctrl), branches[1].Start(ctrl)
+				So(<-first, ShouldEqual, recs[0])
+				So(<-second, ShouldEqual, recs[0])
+				ctrl.Wait()
+
+				So(checkpointer.Ack(recs[0]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 0)
+				So(checkpointer.Ack(recs[0]), ShouldBeNil)
+				So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 1)
+			})
+
+			Convey("Pipeline", func() {
+				ctrl := NewController().WithCheckpointer(checkpointer)
+				pipeline := NewPipeline().From(StreamArray([]interface{}{recs[0], recs[1], recs[2], recs[3]}))
+
+				Convey("releases records before a sink which does not acknowledge them", func() {
+					result := pipeline.To(SinkFunc(func(ctrl *Controller, in <-chan interface{}) {
+						for range in {
+						}
+					})).Run(ctrl)
+
+					So(result.Err, ShouldBeNil)
+					So(checkpointer.tracked, ShouldBeEmpty)
+					So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 0)
+				})
+
+				Convey("follows records to a sink which acknowledges them", func() {
+					result := pipeline.To(AckSinkFunc(func(ctrl *Controller, in <-chan interface{}) {
+						for rec := range in {
+							ctrl.Checkpointer().Ack(rec)
+						}
+					})).Run(ctrl)
+
+					So(result.Err, ShouldBeNil)
+					So(checkpointer.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 4)
+				})
+			})
+
+			Convey("records completed sources", func() {
+				So(checkpointer.Complete("download", "http://example.com/a.csv", 42), ShouldBeNil)
+				resumed, err := NewCheckpointer(store)
+				So(err, ShouldBeNil)
+				So(resumed.Resume("download", "http://example.com/a.csv"), ShouldResemble,
+					Checkpoint{Stage: "download", Source: "http://example.com/a.csv", Bytes: 42, Done: true})
+			})
+		})
+
+		Convey("Downloader reuses a file downloaded by a previous run", func() {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.Write([]byte("name\nada\n"))
+			}))
+			defer server.Close()
+
+			download := func() string {
+				checkpointer, err := NewCheckpointer(store)
+				So(err, ShouldBeNil)
+				ctrl := NewController().WithCheckpointer(checkpointer)
+
+				contents := ""
+				for file := range Download(server.URL + "/people.csv").DownloadTo(filepath.Join(dir, "download")).Start(ctrl) {
+					data, err := ioutil.ReadAll(file)
+					So(err, ShouldBeNil)
+					file.Close()
+					contents += string(data)
+				}
+				return contents
+			}
+
+			So(download(), ShouldEqual, "name\nada\n")
+			So(download(), ShouldEqual, "name\nada\n")
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		})
+
+		Convey("Unzipper names entries by the archive and their path, so they can be checkpointed", func() {
+			path := filepath.Join(dir, "people.zip")
+			file, err := os.Create(path)
+			So(err, ShouldBeNil)
+			archive := zip.NewWriter(file)
+			entry, err := archive.Create("nested/people.csv")
+			So(err, ShouldBeNil)
+			entry.Write([]byte("name\nada\n"))
+			So(archive.Close(), ShouldBeNil)
+
+			entries, err := NewUnzipper().UnzipFile(file)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			defer entries[0].Close()
+			So(entries[0].(interface{ Name() string }).Name(), ShouldEqual, path+"/nested/people.csv")
+		})
+
+		Convey("Importer", func() {
+			Convey("resumes from the checkpoints of a failed run", func() {
+				runs := 0
+				importer := NewImporter(func(ctrl *Controller) error {
+					runs++
+					checkpoints := ctrl.Checkpointer()
+					if runs == 1 {
+						rec := &checkpointRec{}
+						checkpoints.Track(rec, "parse-csv", "a.csv", 0)
+						checkpoints.Ack(rec)
+						return errors.New("failed")
+					}
+					So(checkpoints.Resume("parse-csv", "a.csv").Offset, ShouldEqual, 1)
+					return nil
+				}).ResumeFrom(store)
+
+				So(importer.Run(), ShouldNotBeNil)
+				So(importer.Run(), ShouldBeNil)
+				So(runs, ShouldEqual, 2)
+
+				Convey("and clears them once a run succeeds", func() {
+					checkpoints, err := store.Load()
+					So(err, ShouldBeNil)
+					So(checkpoints, ShouldBeEmpty)
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/urbint/ingest/utils"
+)
+
+// Config describes a pipeline run by the ingest command
+type Config struct {
+	// Sources are the URLs (or paths) of the files to import
+	Sources []string `json:"sources"`
+	// Download configures how the sources are downloaded
+	Download DownloadConfig `json:"download"`
+	// Archive configures how the sources are unzipped, if they are archives
+	Archive ArchiveConfig `json:"archive"`
+	// Parser configures how the files are parsed into records
+	Parser ParserConfig `json:"parser"`
+	// Mappings renames (or with "-", removes) the fields of each record. Nested fields are
+	// separated by periods
+	Mappings utils.MapTransform `json:"mappings"`
+	// Sink configures where the records are written
+	Sink SinkConfig `json:"sink"`
+	// DeadLetters is the path of a file records which fail to parse or write are appended to
+	DeadLetters string `json:"deadLetters"`
+	// Progress is how often progress is printed, such as "10s". Progress is not printed if it is empty
+	Progress string `json:"progress"`
+}
+
+// DownloadConfig configures how the sources are downloaded
+type DownloadConfig struct {
+	// To is the directory the sources are downloaded to
+	To string `json:"to"`
+	// Parallel is the number of sources downloaded at the same time
+	Parallel int `json:"parallel"`
+	// Cleanup is whether the directory is removed once the pipeline finishes
+	Cleanup bool `json:"cleanup"`
+}
+
+// ArchiveConfig configures how the sources are unzipped
+type ArchiveConfig struct {
+	// Unzip is whether the sources are zip archives
+	Unzip bool `json:"unzip"`
+	// Filter is a pattern matching the names of the files within the archives which are parsed
+	Filter string `json:"filter"`
+	// Parallel is the number of archives unzipped at the same time
+	Parallel int `json:"parallel"`
+}
+
+// ParserConfig configures how the files are parsed
+type ParserConfig struct {
+	// Type is the format of the files, either csv or json
+	Type string `json:"type"`
+	// Workers is the number of files parsed at the same time
+	Workers int `json:"workers"`
+	// AbortOnError is whether the pipeline stops at the first record which fails to parse
+	AbortOnError bool `json:"abortOnError"`
+	// Delimiter separates the columns of a csv file
+	Delimiter string `json:"delimiter"`
+	// LazyQuotes allows quotes to appear within unquoted columns of a csv file
+	LazyQuotes bool `json:"lazyQuotes"`
+	// HeaderRow is the index of the row of a csv file which holds the names of the columns
+	HeaderRow int `json:"headerRow"`
+	// Selection is the path to the records within a json file, such as "*" for an array of records
+	Selection string `json:"selection"`
+}
+
+// SinkConfig configures where the records are written
+type SinkConfig struct {
+	// Type is where the records are written, either elasticsearch or json
+	Type string `json:"type"`
+	// URL is the address of the Elasticsearch cluster
+	URL string `json:"url"`
+	// Index is the Elasticsearch index records are written to
+	Index string `json:"index"`
+	// DocType is the Elasticsearch type records are written as
+	DocType string `json:"docType"`
+	// IDField is the field of each record used as its Elasticsearch id. If it is empty,
+	// Elasticsearch generates the ids
+	IDField string `json:"idField"`
+	// Workers is the number of bulk requests sent to Elasticsearch at the same time
+	Workers int `json:"workers"`
+	// Path is the file the json sink writes records to, one per line. Records are written to
+	// stdout if it is empty or "-"
+	Path string `json:"path"`
+}
+
+// loadConfig reads the Config at the path, which may be JSON or YAML
+func loadConfig(path string) (*Config, error) {
+	settings, err := utils.ReadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round trip the settings through JSON so they are decoded with the field names of Config
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+
+	config := &Config{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %s", path, err.Error())
+	}
+	config.setDefaults()
+	return config, config.validate()
+}
+
+// setDefaults fills in the options which were not configured
+func (c *Config) setDefaults() {
+	if c.Download.To == "" {
+		c.Download.To = "tmp/"
+	}
+	if c.Download.Parallel < 1 {
+		c.Download.Parallel = 1
+	}
+	if c.Archive.Parallel < 1 {
+		c.Archive.Parallel = 1
+	}
+	if c.Parser.Workers < 1 {
+		c.Parser.Workers = 1
+	}
+	if c.Parser.Type == "json" && c.Parser.Selection == "" {
+		c.Parser.Selection = "*"
+	}
+	if c.Sink.Type == "" {
+		c.Sink.Type = "json"
+	}
+}
+
+// validate returns an error describing the first problem with the Config
+func (c *Config) validate() error {
+	if len(c.Sources) == 0 {
+		return fmt.Errorf("Invalid config: no sources")
+	}
+
+	switch c.Parser.Type {
+	case "csv":
+		if len([]rune(c.Parser.Delimiter)) > 1 {
+			return fmt.Errorf("Invalid config: csv delimiter %q must be a single character", c.Parser.Delimiter)
+		}
+	case "json":
+	default:
+		return fmt.Errorf("Invalid config: unknown parser type %q, expected csv or json", c.Parser.Type)
+	}
+
+	switch c.Sink.Type {
+	case "elasticsearch":
+		if c.Sink.URL == "" || c.Sink.Index == "" || c.Sink.DocType == "" {
+			return fmt.Errorf("Invalid config: the elasticsearch sink requires a url, index and docType")
+		}
+	case "json":
+	default:
+		return fmt.Errorf("Invalid config: unknown sink type %q, expected elasticsearch or json", c.Sink.Type)
+	}
+
+	if c.Progress != "" {
+		if _, err := time.ParseDuration(c.Progress); err != nil {
+			return fmt.Errorf("Invalid config: progress %q is not a duration", c.Progress)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Command ingest runs a pipeline described by a JSON or YAML config file, so that a new feed
+// can be imported without writing a Go program for it.
+//
+// A config which downloads a zipped CSV file and writes its rows to Elasticsearch looks like:
+//
+//	sources:
+//	  - https://example.com/permits.zip
+//	archive:
+//	  unzip: true
+//	  filter: "*.csv"
+//	parser:
+//	  type: csv
+//	mappings:
+//	  PERMIT_NO: id
+//	  UNUSED: "-"
+//	sink:
+//	  type: elasticsearch
+//	  url: http://localhost:9200
+//	  index: permits
+//	  docType: permit
+//	  idField: id
+//	progress: 10s
+//
+// With -dry-run N, only the first N records of each file are read, and instead of being written
+// to the sink they are summarized in a report of the type, null rate and parse errors of each field.
+//
+// The exit code is 0 if the pipeline succeeded, 1 if it failed, 2 if the config is invalid,
+// and 130 if it was interrupted
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urbint/ingest"
+)
+
+// The exit codes of the command
+const (
+	exitSucceeded   = 0
+	exitFailed      = 1
+	exitInvalid     = 2
+	exitInterrupted = 130
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// run runs the command with the specified arguments, writing progress to out, and returns its exit code
+func run(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintln(out, "Usage: ingest [flags] <config.yml|config.json>")
+		flags.PrintDefaults()
+	}
+	quiet := flags.Bool("quiet", false, "don't print progress")
+	dryRun := flags.Int("dry-run", 0, "read only the first `N` records of each file and print a report of their fields instead of writing them")
+	if err := flags.Parse(args); err != nil {
+		return exitInvalid
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitInvalid
+	}
+	if *dryRun < 0 {
+		fmt.Fprintln(out, "-dry-run must be a positive number of records")
+		return exitInvalid
+	}
+
+	config, err := loadConfig(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return exitInvalid
+	}
+
+	pipeline, cleanup, err := buildPipeline(config, *dryRun > 0)
+	defer cleanup()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return exitInvalid
+	}
+	if *dryRun == 0 {
+		if err := pipeline.Validate(); err != nil {
+			fmt.Fprintln(out, err)
+			return exitInvalid
+		}
+	}
+
+	ctrl := ingest.NewController()
+
+	interrupted := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			close(interrupted)
+			fmt.Fprintln(out, "Interrupted, stopping")
+			go ctrl.Abort()
+		}
+	}()
+
+	finished := make(chan struct{})
+	printing := sync.WaitGroup{}
+	if interval, _ := time.ParseDuration(config.Progress); interval > 0 && !*quiet {
+		printing.Add(1)
+		go func() {
+			defer printing.Done()
+			printProgressEvery(ctrl, interval, finished, out)
+		}()
+	}
+
+	var result *ingest.PipelineResult
+	var report *ingest.SampleReport
+	if *dryRun > 0 {
+		dryRunResult := pipeline.DryRun(ctrl, *dryRun)
+		result, report = dryRunResult.PipelineResult, dryRunResult.Report
+	} else {
+		result = pipeline.Run(ctrl)
+	}
+	close(finished)
+	printing.Wait()
+
+	if !*quiet {
+		printProgress(out, ctrl.Progress())
+	}
+
+	select {
+	case <-interrupted:
+		return exitInterrupted
+	default:
+	}
+	if report != nil {
+		fmt.Fprintln(out)
+		report.Print(out)
+	}
+	if result.Err != nil {
+		fmt.Fprintf(out, "Pipeline failed after %s: %s\n", result.Duration, result.Err)
+		return exitFailed
+	}
+	if report != nil {
+		return exitSucceeded
+	}
+	fmt.Fprintf(out, "Wrote %d records in %s\n", result.Records, result.Duration)
+	return exitSucceeded
+}
+
+// printProgressEvery prints the progress of the pipeline at the specified interval until finished is closed.
+//
+// Controller.ReportProgressEvery can't be used, as the Controller is finished until the
+// pipeline starts its stages
+func printProgressEvery(ctrl *ingest.Controller, interval time.Duration, finished <-chan struct{}, out io.Writer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-finished:
+			return
+		case <-ticker.C:
+			printProgress(out, ctrl.Progress())
+		}
+	}
+}
+
+// printProgress prints a line for each stage
+func printProgress(out io.Writer, progress []ingest.Progress) {
+	for _, stage := range progress {
+		line := fmt.Sprintf("%-20s in=%d out=%d failed=%d", stage.Stage, stage.RecordsIn, stage.RecordsOut, stage.RecordsFailed)
+		if stage.Bytes > 0 {
+			line += fmt.Sprintf(" bytes=%d", stage.Bytes)
+		}
+		if stage.ETA > 0 {
+			line += fmt.Sprintf(" eta=%s", stage.ETA.Round(time.Second))
+		}
+		fmt.Fprintf(out, "%s %.1f/s\n", line, stage.Throughput)
+	}
+}
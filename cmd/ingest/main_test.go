@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/urbint/ingest"
+)
+
+// recordingStore is a CheckpointStore which records how much had been written when each save was made
+type recordingStore struct {
+	written *bytes.Buffer
+	saved   []int
+}
+
+func (s *recordingStore) Load() ([]ingest.Checkpoint, error) { return nil, nil }
+
+func (s *recordingStore) Save(checkpoints []ingest.Checkpoint) error {
+	s.saved = append(s.saved, s.written.Len())
+	return nil
+}
+
+func (s *recordingStore) Clear() error { return nil }
+
+func TestIngestCommand(t *testing.T) {
+	Convey("ingest", t, func() {
+		dir, err := ioutil.TempDir("", "ingest-cmd")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		writeFile := func(name, contents string) string {
+			path := filepath.Join(dir, name)
+			So(ioutil.WriteFile(path, []byte(contents), 0644), ShouldBeNil)
+			return path
+		}
+		source := writeFile("people.csv", "Name,Age,Notes\nBob,42,\nAlice,37,tall\n")
+		output := filepath.Join(dir, "people.json")
+
+		Convey("loadConfig", func() {
+			Convey("reads YAML and fills in defaults", func() {
+				path := writeFile("config.yml", "sources: [a.csv]\nparser:\n  type: json\n")
+				config, err := loadConfig(path)
+				So(err, ShouldBeNil)
+				So(config.Sources, ShouldResemble, []string{"a.csv"})
+				So(config.Parser.Selection, ShouldEqual, "*")
+				So(config.Sink.Type, ShouldEqual, "json")
+				So(config.Download.Parallel, ShouldEqual, 1)
+			})
+
+			Convey("rejects unknown options", func() {
+				path := writeFile("config.json", `{"sources": ["a.csv"], "parser": {"type": "csv", "delimeter": ";"}}`)
+				_, err := loadConfig(path)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "delimeter")
+			})
+
+			Convey("rejects invalid configs", func() {
+				for _, contents := range []string{
+					"parser: {type: csv}",
+					"sources: [a.csv]\nparser: {type: xls}",
+					"sources: [a.csv]\nparser: {type: csv}\nsink: {type: elasticsearch, url: http://localhost:9200}",
+					"sources: [a.csv]\nparser: {type: csv}\nprogress: often",
+				} {
+					_, err := loadConfig(writeFile("invalid.yml", contents))
+					So(err, ShouldNotBeNil)
+				}
+			})
+		})
+
+		Convey("jsonLines acknowledges records once they have been flushed", func() {
+			written := &bytes.Buffer{}
+			store := &recordingStore{written: written}
+			checkpoints, err := ingest.NewCheckpointer(store)
+			So(err, ShouldBeNil)
+			ctrl := ingest.NewController().WithCheckpointer(checkpoints)
+
+			in := make(chan interface{}, 3)
+			for offset := 0; offset < 3; offset++ {
+				rec := map[string]interface{}{"id": offset}
+				checkpoints.Track(rec, "parse-csv", "people.csv", int64(offset))
+				in <- rec
+			}
+			close(in)
+			jsonLines(written).Consume(ctrl, in)
+
+			So(store.saved, ShouldResemble, []int{written.Len()})
+			So(strings.Count(written.String(), "\n"), ShouldEqual, 3)
+			So(checkpoints.Checkpoints()[0].Offset, ShouldEqual, 3)
+		})
+
+		Convey("run", func() {
+			out := &bytes.Buffer{}
+
+			Convey("writes the mapped records and exits with 0", func() {
+				config := writeFile("config.yml", strings.Join([]string{
+					"sources: [" + source + "]",
+					"download: {to: " + filepath.Join(dir, "download") + ", cleanup: true}",
+					"parser: {type: csv, workers: 1}",
+					"mappings: {Name: name, Age: '-'}",
+					"sink: {type: json, path: " + output + "}",
+				}, "\n"))
+
+				So(run([]string{config}, out), ShouldEqual, exitSucceeded)
+				So(out.String(), ShouldContainSubstring, "Wrote 2 records")
+
+				written, err := ioutil.ReadFile(output)
+				So(err, ShouldBeNil)
+				So(string(written), ShouldEqual, "{\"name\":\"Bob\"}\n{\"Notes\":\"tall\",\"name\":\"Alice\"}\n")
+			})
+
+			Convey("dry runs summarize the first records of each file instead of writing them", func() {
+				config := writeFile("config.yml", strings.Join([]string{
+					"sources: [" + source + "]",
+					"download: {to: " + filepath.Join(dir, "download") + ", cleanup: true}",
+					"parser: {type: csv, workers: 1}",
+					"sink: {type: elasticsearch, url: http://localhost:9200, index: people, docType: person}",
+				}, "\n"))
+
+				So(run([]string{"-dry-run", "1", config}, out), ShouldEqual, exitSucceeded)
+				So(out.String(), ShouldContainSubstring, "Sampled 1 records, 0 failed to parse")
+				So(out.String(), ShouldContainSubstring, "Age    integer  0.0%    0")
+				So(out.String(), ShouldContainSubstring, "Notes  -        100.0%  0")
+			})
+
+			Convey("dry runs attribute rows missing columns to the column, and write no dead letters", func() {
+				deadLetters := filepath.Join(dir, "dead.jsonl")
+				config := writeFile("config.yml", strings.Join([]string{
+					"sources: [" + writeFile("short.csv", "Name,Age,Notes\nBob,42,\nCarol\n") + "]",
+					"download: {to: " + filepath.Join(dir, "download") + ", cleanup: true}",
+					"parser: {type: csv, workers: 1}",
+					"deadLetters: " + deadLetters,
+					"sink: {type: json, path: " + output + "}",
+				}, "\n"))
+
+				So(run([]string{"-dry-run", "10", config}, out), ShouldEqual, exitSucceeded)
+				So(out.String(), ShouldContainSubstring, "Sampled 1 records, 1 failed to parse")
+				So(out.String(), ShouldContainSubstring, "Age    integer  0.0%    1")
+
+				_, err := os.Stat(deadLetters)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Convey("exits with 1 when the pipeline fails", func() {
+				config := writeFile("config.yml", strings.Join([]string{
+					"sources: [" + filepath.Join(dir, "missing.csv") + "]",
+					"download: {to: " + filepath.Join(dir, "download") + "}",
+					"parser: {type: csv}",
+					"sink: {type: json, path: " + output + "}",
+				}, "\n"))
+
+				So(run([]string{config}, out), ShouldEqual, exitFailed)
+				So(out.String(), ShouldContainSubstring, "Pipeline failed")
+			})
+
+			Convey("exits with 2 when the config is invalid", func() {
+				So(run([]string{}, out), ShouldEqual, exitInvalid)
+				So(run([]string{filepath.Join(dir, "missing.yml")}, out), ShouldEqual, exitInvalid)
+			})
+		})
+	})
+}
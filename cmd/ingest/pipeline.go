@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/olivere/elastic"
+	"github.com/urbint/ingest"
+	"github.com/urbint/ingest/parse"
+	"github.com/urbint/ingest/utils"
+	"github.com/urbint/ingest/write"
+)
+
+// buildPipeline builds the Pipeline described by the Config. The returned function releases
+// any files opened for the pipeline, and should be called once it has finished.
+//
+// Pipelines built for a dry run have no sink, and don't keep dead letters
+func buildPipeline(config *Config, dryRun bool) (*ingest.Pipeline, func(), error) {
+	var closers []io.Closer
+	cleanup := func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}
+
+	pipeline := ingest.NewPipeline().From(buildSource(config))
+	if dryRun {
+		return pipeline.Through(buildParser(config.Parser, nil), buildMapper(config)), cleanup, nil
+	}
+
+	var deadLetters ingest.DeadLetterSink
+	if config.DeadLetters != "" {
+		sink, err := ingest.NewFileDeadLetterSink(config.DeadLetters)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		closers = append(closers, sink)
+		deadLetters = sink
+	}
+
+	sink, closer, err := buildSink(config.Sink, deadLetters)
+	if err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	if closer != nil {
+		closers = append(closers, closer)
+	}
+
+	pipeline.Through(buildParser(config.Parser, deadLetters), buildMapper(config)).To(sink)
+	return pipeline, cleanup, nil
+}
+
+// buildSource builds the stage which downloads (and unzips) the sources
+func buildSource(config *Config) ingest.Source {
+	download := ingest.DownloadOpts{
+		MaxParallelDownloads: config.Download.Parallel,
+		DownloadTo:           config.Download.To,
+		Cleanup:              config.Download.Cleanup,
+	}
+
+	if config.Archive.Unzip {
+		unzipper := ingest.Unzip(config.Sources...).Filter(config.Archive.Filter)
+		unzipper.Opts.DownloadOpts = download
+		unzipper.Opts.MaxParallelUnzips = config.Archive.Parallel
+		return unzipper
+	}
+
+	return ingest.Download(config.Sources...).WithOpts(download)
+}
+
+// buildParser builds the stage which parses the files into records of type map[string]interface{}
+func buildParser(config ParserConfig, deadLetters ingest.DeadLetterSink) ingest.Transform {
+	if config.Type == "json" {
+		parser := parse.NewJSONParser().
+			Select(config.Selection).
+			Struct(map[string]interface{}{}).
+			AbortOnError(config.AbortOnError)
+		parser.Opts.NumWorkers = config.Workers
+		if deadLetters != nil {
+			parser.DeadLetterTo(deadLetters)
+		}
+		return parser
+	}
+
+	parser := parse.NewCSVParser().
+		Maps().
+		HeaderRowIndex(config.HeaderRow).
+		LazyQuotes(config.LazyQuotes).
+		AbortOnError(config.AbortOnError)
+	parser.Opts.NumWorkers = config.Workers
+	if config.Delimiter != "" {
+		parser.Delimiter([]rune(config.Delimiter)[0])
+	}
+	if deadLetters != nil {
+		parser.DeadLetterTo(deadLetters)
+	}
+	return parser
+}
+
+// buildMapper builds the stage which applies the field mappings to each record, and wraps
+// it for Elasticsearch if that is where it will be written
+func buildMapper(config *Config) ingest.Transform {
+	sink := config.Sink
+
+	return ingest.NewStream().Named("map-fields").Map(func(rec interface{}) (interface{}, error) {
+		fields, err := recordFields(rec)
+		if err != nil {
+			return nil, err
+		}
+		if len(config.Mappings) > 0 {
+			if err := utils.TransformMap(fields, config.Mappings); err != nil {
+				return nil, err
+			}
+		}
+		if sink.Type == "elasticsearch" {
+			return &document{index: sink.Index, docType: sink.DocType, idField: sink.IDField, fields: fields}, nil
+		}
+		return fields, nil
+	})
+}
+
+// recordFields returns the fields of a record produced by one of the parsers
+func recordFields(rec interface{}) (map[string]interface{}, error) {
+	switch fields := rec.(type) {
+	case map[string]interface{}:
+		return fields, nil
+	case *map[string]interface{}:
+		if *fields == nil {
+			return map[string]interface{}{}, nil
+		}
+		return *fields, nil
+	}
+	return nil, fmt.Errorf("Expected a map[string]interface{}, received %T", rec)
+}
+
+// buildSink builds the stage which writes the records. The returned io.Closer, if any,
+// should be closed once the pipeline has finished
+func buildSink(config SinkConfig, deadLetters ingest.DeadLetterSink) (ingest.Sink, io.Closer, error) {
+	if config.Type == "elasticsearch" {
+		client, err := elastic.NewClient(elastic.SetURL(config.URL), elastic.SetSniff(false))
+		if err != nil {
+			return nil, nil, err
+		}
+		writer := write.Elasticsearch(client, nil)
+		if config.Workers > 0 {
+			writer.NumWorkers(config.Workers)
+		}
+		if deadLetters != nil {
+			writer.DeadLetterTo(deadLetters)
+		}
+		return writer, nil, nil
+	}
+
+	if config.Path == "" || config.Path == "-" {
+		return jsonLines(os.Stdout), nil, nil
+	}
+	file, err := os.Create(config.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jsonLines(file), file, nil
+}
+
+// jsonLinesFlushEvery is the number of records the json sink writes between flushes. Records are
+// only acknowledged once they have been flushed
+const jsonLinesFlushEvery = 1000
+
+// jsonLines returns a Sink which writes each record to w as a line of JSON
+func jsonLines(w io.Writer) ingest.Sink {
+	return ingest.AckSinkFunc(func(ctrl *ingest.Controller, in <-chan interface{}) {
+		progress := ctrl.Stage("write-json")
+		checkpoints := ctrl.Checkpointer()
+		log := ingest.DefaultLogger.WithField("task", "write-json")
+
+		buffered := bufio.NewWriter(w)
+		encoder := json.NewEncoder(buffered)
+		written := make([]interface{}, 0, jsonLinesFlushEvery)
+		flush := func() {
+			if err := buffered.Flush(); err != nil {
+				ctrl.ReportError("write-json", 0, err)
+				return
+			}
+			if err := checkpoints.Ack(written...); err != nil {
+				log.WithError(err).Error("Error saving checkpoint")
+			}
+			written = written[:0]
+		}
+
+		for rec := range in {
+			progress.In(1)
+			if err := encoder.Encode(rec); err != nil {
+				progress.Failed(1)
+				ctrl.ReportError("write-json", 0, err)
+				continue
+			}
+			progress.Out(1)
+			if written = append(written, rec); len(written) >= jsonLinesFlushEvery {
+				flush()
+			}
+		}
+		flush()
+	})
+}
+
+// document is a record which will be written to Elasticsearch
+type document struct {
+	index   string
+	docType string
+	idField string
+	fields  map[string]interface{}
+}
+
+// ForElastic returns the index, type and id the document is written with. The id is taken from
+// the configured field, or left for Elasticsearch to generate
+func (d *document) ForElastic() (string, string, string, interface{}) {
+	id := ""
+	if value, found := d.fields[d.idField]; found && d.idField != "" {
+		id = fmt.Sprint(value)
+	}
+	return d.index, d.docType, id, d.fields
+}
+
+// MarshalJSON encodes the fields of the document, so that dry runs can report them
+func (d *document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.fields)
+}
@@ -1,12 +1,20 @@
 package ingest
 
 import (
+	"context"
 	"sync"
+	"time"
+
+	"github.com/urbint/ingest/metrics"
+	"github.com/urbint/ingest/trace"
 )
 
 // A Controller ...
 type Controller struct {
-	// Err is used by workers to report errors encountered while working
+	// Err can be used by workers to report errors encountered while working.
+	//
+	// Sending on Err blocks until the error is read, so workers should prefer ReportError
+	// which never blocks
 	Err chan error
 	// Quit is closed by the controller when Abort is called
 	Quit chan struct{}
@@ -15,19 +23,138 @@ type Controller struct {
 	parent     *Controller
 	childBuilt bool
 	mu         sync.Mutex
+
+	base      context.Context
+	ctx       context.Context
+	cancel    context.CancelFunc
+	unwatch   func() bool
+	quitOnce  sync.Once
+	drain     chan struct{}
+	drainOnce sync.Once
+	paused    bool
+	resumed   chan struct{}
+
+	collecting bool
+	policy     ErrorPolicy
+	errs       MultiError
+	pending    []error
+	errReady   chan struct{}
+
+	state  State
+	reason error
+
+	stages  []*StageProgress
+	metrics metrics.Registry
+	tracer  trace.Tracer
+	span    trace.Span
+
+	checkpoints *Checkpointer
+	sampler     *Sampler
+}
+
+// A State describes where a Controller is in its lifecycle
+type State int
+
+const (
+	// StateRunning is the state of a Controller whose workers are running
+	StateRunning State = iota
+	// StateAborting is the state of a Controller that has been aborted, but whose workers have not all exited
+	StateAborting
+	// StateAborted is the state of a Controller that has been aborted and whose workers have all exited
+	StateAborted
+	// StateFinished is the state of a Controller whose workers have all exited without it being aborted
+	StateFinished
+	// StateFailed is the state of a Controller that was aborted because of errors reported by its workers
+	StateFailed
+	// StateDraining is the state of a Controller whose sources have stopped taking new work, but whose
+	// workers are still processing the work already in the pipeline
+	StateDraining
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRunning:
+		return "running"
+	case StateAborting:
+		return "aborting"
+	case StateAborted:
+		return "aborted"
+	case StateFinished:
+		return "finished"
+	case StateFailed:
+		return "failed"
+	case StateDraining:
+		return "draining"
+	default:
+		return "unknown"
+	}
+}
+
+// An ErrorPolicy defines when a Controller that is collecting errors will abort its workers
+type ErrorPolicy struct {
+	// MaxErrors is the number of errors after which the Controller will abort. If it is
+	// zero or less, errors will be collected without ever aborting
+	MaxErrors int
+}
+
+// FailFast is an ErrorPolicy that aborts on the first reported error
+var FailFast = ErrorPolicy{MaxErrors: 1}
+
+// NeverFail is an ErrorPolicy that collects every reported error without aborting
+var NeverFail = ErrorPolicy{MaxErrors: 0}
+
+// FailAfter builds an ErrorPolicy that aborts once count errors have been reported
+func FailAfter(count int) ErrorPolicy {
+	return ErrorPolicy{MaxErrors: count}
 }
 
 // NewController builds a new Controller for use
 func NewController() *Controller {
+	return newController(context.Background())
+}
+
+// NewControllerWithContext builds a new Controller that will abort all of its
+// workers (and the workers of its children) when the specified context is cancelled
+// before the Controller finishes
+func NewControllerWithContext(ctx context.Context) *Controller {
+	ctrl := newController(ctx)
+	if ctx.Done() != nil {
+		ctrl.unwatch = context.AfterFunc(ctx, func() {
+			ctrl.abort(ctx.Err(), false)
+		})
+	}
+	return ctrl
+}
+
+// newController allocates a Controller whose context is derived from the specified parent context
+func newController(parent context.Context) *Controller {
 	ctrl := &Controller{
-		Err:  make(chan error),
-		Quit: make(chan struct{}),
-		wg:   sync.WaitGroup{},
-		mu:   sync.Mutex{},
+		Err:      make(chan error),
+		Quit:     make(chan struct{}),
+		wg:       sync.WaitGroup{},
+		mu:       sync.Mutex{},
+		errReady: make(chan struct{}, 1),
+		drain:    make(chan struct{}),
+		resumed:  make(chan struct{}),
 	}
+	close(ctrl.resumed)
+	ctrl.base = parent
+	ctrl.ctx, ctrl.cancel = context.WithCancel(parent)
 	return ctrl
 }
 
+// Context returns a context.Context that is cancelled when the Controller quits or finishes.
+//
+// It can be handed to code that only understands context.Context. The context of
+// a child Controller is derived from the context of its parent. If workers are started
+// on a Controller after it has finished, it is given a new context
+func (c *Controller) Context() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ctx
+}
+
 // ChildBuilt is called on a child Controller to denote that it has been built and its wait group is valid
 func (c *Controller) ChildBuilt() *Controller {
 	c.mu.Lock()
@@ -49,6 +176,19 @@ func (c *Controller) ChildBuilt() *Controller {
 // WorkerStart is called by Worker to indicate to the controller
 // that it is running and that the job is not complete until it exits
 func (c *Controller) WorkerStart() *Controller {
+	c.mu.Lock()
+	if c.state == StateFinished {
+		c.state = StateRunning
+		c.ctx, c.cancel = context.WithCancel(c.base)
+		if c.unwatch != nil {
+			base := c.base
+			c.unwatch = context.AfterFunc(base, func() {
+				c.abort(base.Err(), false)
+			})
+		}
+	}
+	c.mu.Unlock()
+
 	c.wg.Add(1)
 	return c
 }
@@ -63,35 +203,411 @@ func (c *Controller) WorkerEnd() *Controller {
 // Wait waits for all workers to have exited
 func (c *Controller) Wait() {
 	c.wg.Wait()
+	c.finish()
 }
 
 // Done returns a channel that will be closed when the worker controller has finished
 func (c *Controller) Done() chan struct{} {
 	done := make(chan struct{})
 	go func() {
-		c.wg.Wait()
+		c.Wait()
 		close(done)
 	}()
 	return done
 }
 
+// State returns the current State of the Controller.
+//
+// A Controller is only considered finished (or aborted) once Wait, Error or Done have
+// observed all of its workers exit
+func (c *Controller) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+// AbortReason returns the reason the Controller was aborted, or nil if it has not been aborted.
+//
+// Controllers aborted with Abort will report ErrAborted, while those which failed because
+// of a worker error will report that error
+func (c *Controller) AbortReason() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reason
+}
+
+// finish records that all of the workers of the Controller have exited, releasing its context
+func (c *Controller) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case StateRunning, StateDraining:
+		c.state = StateFinished
+	case StateAborting:
+		c.state = StateAborted
+	}
+
+	if c.unwatch != nil {
+		c.unwatch()
+	}
+	c.cancel()
+}
+
+// CollectErrors is a chainable configuration method that puts the Controller into error
+// aggregation mode.
+//
+// Instead of returning the first error encountered, Error will gather every error reported
+// by the workers until they have all exited, aborting according to the specified policy
+func (c *Controller) CollectErrors(policy ErrorPolicy) *Controller {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.collecting = true
+	c.policy = policy
+	return c
+}
+
+// Errors returns the errors that have been collected by the Controller.
+//
+// Errors are only collected when the Controller has been configured with CollectErrors
+func (c *Controller) Errors() MultiError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make(MultiError, len(c.errs))
+	copy(result, c.errs)
+	return result
+}
+
+// ReportError is called by a Worker to report an error encountered while working.
+//
+// The error will be wrapped in a TaskError identifying the task and worker which reported it.
+//
+// ReportError never blocks. Errors are buffered by the Controller and each of its ancestors until
+// they are read by Error, so reporting an error can not prevent a worker from exiting, and
+// calling Error on a child returns the errors of its own workers as well as calling it on the root.
+func (c *Controller) ReportError(task string, worker int, err error) {
+	c.reportErrorMetric(task)
+	if c.span != nil {
+		c.span.RecordError(err)
+	}
+	c.deliver(&TaskError{Task: task, Worker: worker, Err: err})
+}
+
+// deliver queues an error on the Controller and each of its ancestors without blocking
+func (c *Controller) deliver(err error) {
+	for ctrl := c; ctrl != nil; ctrl = ctrl.parent {
+		ctrl.mu.Lock()
+		ctrl.pending = append(ctrl.pending, err)
+		ctrl.mu.Unlock()
+
+		select {
+		case ctrl.errReady <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// forward delivers an error read from the Err channel of a child to its ancestors, which
+// would otherwise have received it from the child
+func (c *Controller) forward(err error) {
+	if c.parent != nil {
+		c.parent.deliver(err)
+	}
+}
+
+// errorsReady returns a channel that receives a value when errors are waiting to be read
+// with takeError or takeErrors.
+//
+// Errors are removed as they are read, so only one reader (such as Error or Streamer.Collect)
+// should read the errors of a Controller at a time
+func (c *Controller) errorsReady() <-chan struct{} {
+	return c.errReady
+}
+
+// root returns the top-most ancestor of the Controller, where shared state such as progress is kept
+func (c *Controller) root() *Controller {
+	root := c
+	for root.parent != nil {
+		root = root.parent
+	}
+	return root
+}
+
+// takeErrors removes and returns all of the errors waiting to be read
+func (c *Controller) takeErrors() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := c.pending
+	c.pending = nil
+	return pending
+}
+
+// takeError removes and returns the first error waiting to be read, or nil if there are none
+func (c *Controller) takeError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		return nil
+	}
+	err := c.pending[0]
+	c.pending = c.pending[1:]
+	return err
+}
+
 // Error waits for all workers to exit or reports the first error encountered by a worker
 //
-// If an error is encountered, it will call Quit to terminate all running workers
+// If an error is encountered, it will call Quit to terminate all running workers.
+//
+// If the Controller is collecting errors, it will instead wait for all workers to exit
+// and return a MultiError containing every error reported, or nil if there were none
 func (c *Controller) Error() error {
+	c.mu.Lock()
+	collecting := c.collecting
+	c.mu.Unlock()
+
+	if collecting {
+		return c.collectErrors()
+	}
+
+	done := c.Done()
+	for {
+		select {
+		case err := <-c.Err:
+			c.forward(err)
+			c.abort(err, true)
+			return err
+		case <-c.errReady:
+			if err := c.takeError(); err != nil {
+				c.abort(err, true)
+				return err
+			}
+		case <-done:
+			if err := c.takeError(); err != nil {
+				c.abort(err, true)
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+// collectErrors gathers errors until all workers have exited, aborting according
+// to the configured ErrorPolicy
+func (c *Controller) collectErrors() error {
+	done := c.Done()
+	for {
+		select {
+		case err := <-c.Err:
+			c.forward(err)
+			c.collect(err)
+		case <-c.errReady:
+			c.collect(c.takeErrors()...)
+		case <-done:
+			c.collect(c.takeErrors()...)
+			return c.Errors().ErrorOrNil()
+		}
+	}
+}
+
+// collect records the specified errors, aborting if the ErrorPolicy has been exceeded
+func (c *Controller) collect(errs ...error) {
+	if len(errs) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.errs = append(c.errs, errs...)
+	shouldAbort := c.policy.MaxErrors > 0 && len(c.errs) >= c.policy.MaxErrors
+	collected := append(MultiError{}, c.errs...)
+	c.mu.Unlock()
+
+	if shouldAbort {
+		c.abort(collected, true)
+	}
+}
+
+// Abort aborts all running workers and waits for them to finish.
+//
+// It is safe to call Abort multiple times, and from multiple goroutines.
+func (c *Controller) Abort() {
+	c.AbortWithReason(ErrAborted)
+}
+
+// AbortWithReason aborts all running workers, recording the reason they were aborted,
+// and waits for them to finish.
+//
+// Only the first reason is recorded. Calling it on a Controller that has already
+// been aborted will only wait for its workers to finish, and calling it on a Controller
+// that has finished has no effect.
+func (c *Controller) AbortWithReason(reason error) {
+	c.abort(reason, false)
+	c.Wait()
+}
+
+// abort transitions the Controller into an aborting (or failed) state and signals its workers to quit.
+// A Controller which has already finished is left as it is
+func (c *Controller) abort(reason error, failed bool) {
+	c.mu.Lock()
+	if c.state == StateFinished {
+		c.mu.Unlock()
+		return
+	}
+	if c.state == StateRunning || c.state == StateDraining {
+		c.reason = reason
+		if failed {
+			c.state = StateFailed
+		} else {
+			c.state = StateAborting
+		}
+	}
+	c.mu.Unlock()
+
+	c.quit()
+}
+
+// Drain stops the sources of the Controller from taking new work, while allowing the
+// workers downstream of them to finish processing (and flushing) the work that is
+// already in the pipeline. It waits for all of the workers to exit.
+//
+// If the workers have not exited after the specified timeout, the Controller will
+// be aborted and ErrDrainTimeout returned. A timeout of zero or less waits indefinitely
+func (c *Controller) Drain(timeout time.Duration) error {
+	c.startDrain()
+
+	if timeout <= 0 {
+		c.Wait()
+		return nil
+	}
+
 	select {
-	case err := <-c.Err:
-		close(c.Quit)
-		return err
 	case <-c.Done():
 		return nil
+	case <-time.After(timeout):
+		c.AbortWithReason(ErrDrainTimeout)
+		return ErrDrainTimeout
 	}
 }
 
-// Abort aborts all running workers and waits for them to finish
-func (c *Controller) Abort() {
-	close(c.Quit)
-	c.Wait()
+// Draining returns a channel that is closed when the Controller begins draining, or when it quits.
+//
+// Sources should stop taking new work once it has been closed.
+func (c *Controller) Draining() <-chan struct{} {
+	return c.drain
+}
+
+// Pause pauses the workers of the Controller (and of its children) at the next record boundary.
+//
+// Paused workers keep their state and will continue where they left off once Resume is called.
+// Pausing an already paused Controller has no effect
+func (c *Controller) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.paused {
+		c.paused = true
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Resume resumes the workers of a paused Controller
+func (c *Controller) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paused {
+		c.paused = false
+		close(c.resumed)
+	}
+}
+
+// Paused reports whether the Controller, or any of its ancestors, is paused
+func (c *Controller) Paused() bool {
+	for ctrl := c; ctrl != nil; ctrl = ctrl.parent {
+		ctrl.mu.Lock()
+		paused := ctrl.paused
+		ctrl.mu.Unlock()
+
+		if paused {
+			return true
+		}
+	}
+	return false
+}
+
+// AwaitResume is called by a Worker at a record boundary. It blocks while the Controller,
+// or any of its ancestors, is paused. A paused Controller which begins draining stops
+// blocking, so that the work in flight can finish.
+//
+// It returns false if the Controller quit, in which case the worker should exit
+func (c *Controller) AwaitResume() bool {
+Paused:
+	for ctrl := c; ctrl != nil; ctrl = ctrl.parent {
+		ctrl.mu.Lock()
+		resumed := ctrl.resumed
+		ctrl.mu.Unlock()
+
+		select {
+		case <-resumed:
+		case <-c.drain:
+			break Paused
+		case <-c.Quit:
+			return false
+		}
+	}
+
+	select {
+	case <-c.Quit:
+		return false
+	default:
+		return true
+	}
+}
+
+// IsDraining reports whether the Controller has begun draining (or has quit)
+func (c *Controller) IsDraining() bool {
+	select {
+	case <-c.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// startDrain transitions the Controller into the draining state and signals its sources
+func (c *Controller) startDrain() {
+	c.mu.Lock()
+	if c.state == StateRunning || c.state == StateFinished {
+		c.state = StateDraining
+	}
+	c.mu.Unlock()
+
+	c.closeDrain()
+}
+
+// closeDrain closes the Draining channel
+func (c *Controller) closeDrain() {
+	c.drainOnce.Do(func() {
+		close(c.drain)
+	})
+}
+
+// quit closes the Quit channel and cancels the Controller's context
+func (c *Controller) quit() {
+	c.quitOnce.Do(func() {
+		close(c.Quit)
+		c.closeDrain()
+
+		c.mu.Lock()
+		cancel := c.cancel
+		c.mu.Unlock()
+		cancel()
+	})
 }
 
 // ReportStartTo is syntactical sugar around sending an empty struct to a channel
@@ -112,27 +628,52 @@ func (c *Controller) ReportEndTo(end chan struct{}) *Controller {
 	return c
 }
 
-// Child creates a new child controller that will quit when the parent quits
-// and report errors back to the parent.
+// Child creates a new child controller that will quit (or drain) when the parent does
+// and report errors back to the parent. Errors reported to the child are returned by
+// both the child's and the parent's Error.
+//
+// Errors sent on the child's Err channel will be read and forwarded to the parent
+// until the child has finished, even after the parent has quit.
 //
 // It will, however keep independent wait groups and all of its workers
 // will only count as a single worker to its parent.
+//
+// The context of the child is derived from the parent, and is released once the
+// child has finished.
 func (c *Controller) Child() *Controller {
-	child := NewController()
+	return c.ChildNamed("child")
+}
+
+// ChildNamed creates a new child controller like Child, tracing it as a span with the specified
+// name. The span ends once the child has finished, and records the errors reported by its workers
+func (c *Controller) ChildNamed(name string) *Controller {
+	ctx, span := c.Tracer().Start(c.Context(), name)
+	child := newController(ctx)
 	child.parent = c
+	child.span = span
 	child.wg.Add(1) // use this to prevent child.Wait from returning immediately. ChildBuilt must be called
 	c.WorkerStart()
 
 	go func() {
 		defer c.WorkerEnd()
+		done := child.Done()
+		quit := c.Quit
+		drain := c.Draining()
 		for {
 			select {
 			case err := <-child.Err:
-				c.Err <- err
-			case <-c.Quit:
-				close(child.Quit)
-				return
-			case <-child.Done():
+				child.deliver(err)
+			case <-quit:
+				child.abort(c.AbortReason(), false)
+				quit = nil
+			case <-drain:
+				child.startDrain()
+				drain = nil
+			case <-done:
+				if reason := child.AbortReason(); reason != nil {
+					span.RecordError(reason)
+				}
+				span.End()
 				return
 			}
 		}
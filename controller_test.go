@@ -0,0 +1,394 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// finishes reports whether fn returns before the timeout elapses
+func finishes(fn func(), timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// startErroringWorkers starts count workers that report errors until the controller quits
+func startErroringWorkers(ctrl *Controller, count int) {
+	for i := 0; i < count; i++ {
+		ctrl.WorkerStart()
+		go func(id int) {
+			defer ctrl.WorkerEnd()
+			for {
+				select {
+				case <-ctrl.Quit:
+					return
+				default:
+					ctrl.ReportError("test", id, errors.New("failed"))
+				}
+			}
+		}(i)
+	}
+}
+
+func TestControllerErrors(t *testing.T) {
+	Convey("Controller error delivery", t, func() {
+		Convey("ReportError does not block when nobody is listening", func() {
+			ctrl := NewController()
+			ctrl.WorkerStart()
+			go func() {
+				defer ctrl.WorkerEnd()
+				ctrl.ReportError("test", 0, errors.New("failed"))
+			}()
+
+			So(finishes(ctrl.Wait, time.Second), ShouldBeTrue)
+			So(ctrl.Error(), ShouldNotBeNil)
+		})
+
+		Convey("Error returns errors reported by a child", func() {
+			ctrl := NewController()
+			child := ctrl.Child()
+			child.WorkerStart()
+			go func() {
+				defer child.WorkerEnd()
+				child.ReportError("child-task", 3, errors.New("failed"))
+			}()
+			child.ChildBuilt()
+
+			err := ctrl.Error()
+			So(err, ShouldNotBeNil)
+
+			taskErr, isTaskErr := err.(*TaskError)
+			So(isTaskErr, ShouldBeTrue)
+			So(taskErr.Task, ShouldEqual, "child-task")
+			So(taskErr.Worker, ShouldEqual, 3)
+		})
+
+		Convey("Error on a child returns the errors of its own workers", func() {
+			ctrl := NewController()
+			child := ctrl.Child()
+			child.WorkerStart()
+			go func() {
+				defer child.WorkerEnd()
+				child.ReportError("child-task", 1, errors.New("failed"))
+			}()
+			child.ChildBuilt()
+
+			So(child.Error(), ShouldNotBeNil)
+			So(ctrl.Error(), ShouldNotBeNil)
+		})
+
+		Convey("Error does not leave sibling workers blocked", func() {
+			ctrl := NewController()
+			startErroringWorkers(ctrl, 8)
+
+			So(ctrl.Error(), ShouldNotBeNil)
+			So(finishes(ctrl.Wait, time.Second), ShouldBeTrue)
+		})
+
+		Convey("Abort while workers are erroring does not wedge", func() {
+			ctrl := NewController()
+			child := ctrl.Child()
+			startErroringWorkers(child, 8)
+			child.ChildBuilt()
+			startErroringWorkers(ctrl, 8)
+
+			time.Sleep(10 * time.Millisecond)
+			So(finishes(ctrl.Abort, time.Second), ShouldBeTrue)
+		})
+
+		Convey("Errors sent directly on a child's Err channel are forwarded after an abort", func() {
+			ctrl := NewController()
+			child := ctrl.Child()
+			child.WorkerStart()
+			go func() {
+				defer child.WorkerEnd()
+				<-child.Quit
+				child.Err <- errors.New("late failure")
+			}()
+			child.ChildBuilt()
+
+			So(finishes(ctrl.Abort, time.Second), ShouldBeTrue)
+		})
+
+		Convey("CollectErrors", func() {
+			Convey("gathers every error with NeverFail", func() {
+				ctrl := NewController().CollectErrors(NeverFail)
+				child := ctrl.Child()
+				for i := 0; i < 5; i++ {
+					child.WorkerStart()
+					go func(id int) {
+						defer child.WorkerEnd()
+						child.ReportError("test", id, errors.New("failed"))
+					}(i)
+				}
+				child.ChildBuilt()
+
+				err := ctrl.Error()
+				So(err, ShouldHaveSameTypeAs, MultiError{})
+				So(err.(MultiError), ShouldHaveLength, 5)
+				So(ctrl.Errors(), ShouldHaveLength, 5)
+			})
+
+			Convey("aborts once FailAfter is exceeded", func() {
+				ctrl := NewController().CollectErrors(FailAfter(3))
+				startErroringWorkers(ctrl, 4)
+
+				err := ctrl.Error()
+				So(err, ShouldNotBeNil)
+				So(len(err.(MultiError)), ShouldBeGreaterThanOrEqualTo, 3)
+
+				_, isOpen := <-ctrl.Quit
+				So(isOpen, ShouldBeFalse)
+			})
+
+			Convey("returns nil when no errors are reported", func() {
+				ctrl := NewController().CollectErrors(FailFast)
+				ctrl.WorkerStart()
+				go ctrl.WorkerEnd()
+
+				So(ctrl.Error(), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestControllerState(t *testing.T) {
+	Convey("Controller state", t, func() {
+		Convey("is running until its workers exit", func() {
+			ctrl := NewController()
+			ctrl.WorkerStart()
+			So(ctrl.State(), ShouldEqual, StateRunning)
+
+			ctrl.WorkerEnd()
+			ctrl.Wait()
+			So(ctrl.State(), ShouldEqual, StateFinished)
+			So(ctrl.AbortReason(), ShouldBeNil)
+		})
+
+		Convey("Abort", func() {
+			ctrl := NewController()
+			child := ctrl.Child()
+			child.WorkerStart()
+			go func() {
+				defer child.WorkerEnd()
+				<-child.Quit
+			}()
+			child.ChildBuilt()
+
+			Convey("is idempotent", func() {
+				ctrl.Abort()
+				So(func() { ctrl.Abort() }, ShouldNotPanic)
+				So(ctrl.State(), ShouldEqual, StateAborted)
+				So(ctrl.AbortReason(), ShouldEqual, ErrAborted)
+			})
+
+			Convey("is safe to call from multiple goroutines", func() {
+				for i := 0; i < 5; i++ {
+					go ctrl.Abort()
+				}
+				So(finishes(ctrl.Abort, time.Second), ShouldBeTrue)
+				So(ctrl.State(), ShouldEqual, StateAborted)
+			})
+
+			Convey("records the first reason", func() {
+				reason := errors.New("shutting down")
+				ctrl.AbortWithReason(reason)
+				ctrl.AbortWithReason(errors.New("other"))
+				So(ctrl.AbortReason(), ShouldEqual, reason)
+				So(child.AbortReason(), ShouldEqual, reason)
+			})
+		})
+
+		Convey("is not changed by an Abort once finished", func() {
+			ctrl := NewController()
+			ctrl.WorkerStart()
+			ctrl.WorkerEnd()
+			ctrl.Wait()
+
+			ctrl.Abort()
+			So(ctrl.State(), ShouldEqual, StateFinished)
+			So(ctrl.AbortReason(), ShouldBeNil)
+		})
+
+		Convey("is failed after an error followed by an abort", func() {
+			ctrl := NewController()
+			ctrl.WorkerStart()
+			go func() {
+				defer ctrl.WorkerEnd()
+				ctrl.ReportError("test", 0, errors.New("failed"))
+				<-ctrl.Quit
+			}()
+
+			err := ctrl.Error()
+			So(func() { ctrl.Abort() }, ShouldNotPanic)
+			So(ctrl.State(), ShouldEqual, StateFailed)
+			So(ctrl.AbortReason(), ShouldEqual, err)
+		})
+	})
+}
+
+func TestControllerDrain(t *testing.T) {
+	Convey("Controller.Drain", t, func() {
+		Convey("stops sources while letting downstream stages finish", func() {
+			ctrl := NewController()
+
+			var taken, received int64
+			source := StreamArray(make([]int, 100000)).ForEach(func(rec interface{}) error {
+				atomic.AddInt64(&taken, 1)
+				return nil
+			}).Start(ctrl)
+
+			out := Stream(source).Start(ctrl)
+			ctrl.WorkerStart()
+			go func() {
+				defer ctrl.WorkerEnd()
+				for range out {
+					atomic.AddInt64(&received, 1)
+					time.Sleep(time.Microsecond)
+				}
+			}()
+
+			time.Sleep(5 * time.Millisecond)
+			So(ctrl.Drain(time.Second), ShouldBeNil)
+			So(ctrl.State(), ShouldEqual, StateFinished)
+			So(atomic.LoadInt64(&taken), ShouldBeLessThan, 100000)
+			So(atomic.LoadInt64(&received), ShouldEqual, atomic.LoadInt64(&taken))
+		})
+
+		Convey("escalates to an abort after the timeout", func() {
+			ctrl := NewController()
+			ctrl.WorkerStart()
+			go func() {
+				defer ctrl.WorkerEnd()
+				<-ctrl.Quit
+			}()
+
+			So(ctrl.Drain(10*time.Millisecond), ShouldEqual, ErrDrainTimeout)
+			So(ctrl.State(), ShouldEqual, StateAborted)
+			So(ctrl.AbortReason(), ShouldEqual, ErrDrainTimeout)
+		})
+	})
+}
+
+func TestControllerPause(t *testing.T) {
+	Convey("Controller.Pause", t, func() {
+		ctrl := NewController()
+
+		var processed int64
+		out := StreamArray(make([]int, 1000)).ForEach(func(rec interface{}) error {
+			atomic.AddInt64(&processed, 1)
+			return nil
+		}).Start(ctrl)
+
+		Convey("blocks the workers of children until resumed", func() {
+			ctrl.Pause()
+			So(ctrl.Paused(), ShouldBeTrue)
+
+			received := 0
+			done := make(chan struct{})
+			go func() {
+				for range out {
+					received++
+				}
+				close(done)
+			}()
+
+			time.Sleep(10 * time.Millisecond)
+			So(atomic.LoadInt64(&processed), ShouldBeLessThanOrEqualTo, 1)
+
+			ctrl.Resume()
+			So(ctrl.Paused(), ShouldBeFalse)
+			<-done
+			So(received, ShouldEqual, 1000)
+		})
+
+		Convey("does not prevent an abort", func() {
+			ctrl.Pause()
+			So(finishes(ctrl.Abort, time.Second), ShouldBeTrue)
+		})
+
+		Convey("does not prevent a drain", func() {
+			ctrl.Pause()
+			go func() {
+				for range out {
+				}
+			}()
+
+			So(finishes(func() { ctrl.Drain(0) }, time.Second), ShouldBeTrue)
+			So(ctrl.State(), ShouldEqual, StateFinished)
+		})
+	})
+}
+
+func TestControllerContext(t *testing.T) {
+	Convey("Controller context", t, func() {
+		Convey("cancelling the context aborts the workers of the Controller and its children", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			ctrl := NewControllerWithContext(ctx)
+			child := ctrl.Child()
+			child.WorkerStart()
+			go func() {
+				defer child.WorkerEnd()
+				<-child.Quit
+			}()
+			child.ChildBuilt()
+
+			cancel()
+			So(finishes(ctrl.Wait, time.Second), ShouldBeTrue)
+			So(ctrl.State(), ShouldEqual, StateAborted)
+			So(ctrl.AbortReason(), ShouldEqual, context.Canceled)
+			So(child.Context().Err(), ShouldNotBeNil)
+		})
+
+		Convey("is cancelled when the Controller aborts", func() {
+			ctrl := NewController()
+			child := ctrl.Child().ChildBuilt()
+			ctrl.Abort()
+			So(ctrl.Context().Err(), ShouldEqual, context.Canceled)
+			So(child.Context().Err(), ShouldEqual, context.Canceled)
+		})
+
+		Convey("is cancelled when the Controller finishes", func() {
+			ctrl := NewController()
+			ctrl.WorkerStart()
+			ctx := ctrl.Context()
+			So(ctx.Err(), ShouldBeNil)
+
+			ctrl.WorkerEnd()
+			ctrl.Wait()
+			So(ctx.Err(), ShouldEqual, context.Canceled)
+
+			Convey("and replaced if it starts more workers", func() {
+				ctrl.WorkerStart()
+				defer ctrl.WorkerEnd()
+				So(ctrl.Context().Err(), ShouldBeNil)
+			})
+		})
+
+		Convey("is no longer watched once the Controller finishes", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			ctrl := NewControllerWithContext(ctx)
+			ctrl.WorkerStart()
+			ctrl.WorkerEnd()
+			ctrl.Wait()
+
+			cancel()
+			time.Sleep(10 * time.Millisecond)
+			So(ctrl.State(), ShouldEqual, StateFinished)
+			So(ctrl.AbortReason(), ShouldBeNil)
+		})
+	})
+}
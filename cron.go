@@ -0,0 +1,192 @@
+package ingest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule decides when a scheduled Importer runs
+type Schedule interface {
+	// Next returns the first time after the specified time that the Importer should run, or the
+	// zero time if it should never run again
+	Next(after time.Time) time.Time
+}
+
+// Every builds a Schedule which runs at the specified interval, starting one interval after the
+// Scheduler starts
+func Every(interval time.Duration) Schedule {
+	return intervalSchedule(interval)
+}
+
+// intervalSchedule is a Schedule which runs at a fixed interval
+type intervalSchedule time.Duration
+
+func (i intervalSchedule) Next(after time.Time) time.Time {
+	if i <= 0 {
+		return time.Time{}
+	}
+	return after.Add(time.Duration(i))
+}
+
+// cronDescriptors are the shorthands accepted by Cron
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSchedule is a Schedule parsed from a cron expression. Each field is a bitset of the
+// values it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny are whether the day of month and day of week are unrestricted
+	domAny, dowAny bool
+}
+
+// Cron parses a standard 5 field cron expression (minute, hour, day of month, month and day of
+// week) into a Schedule. Fields may be *, a value, a range (1-5), a list (1,15), and may have a
+// step (*/15 or 0-30/10). Sunday is 0 (or 7). The shorthands @hourly, @daily, @weekly, @monthly
+// and @yearly are also accepted.
+//
+// Like cron, when both the day of month and the day of week are restricted, the Schedule runs
+// on days matching either of them. Times are in the location of the time passed to Next
+func Cron(expr string) (Schedule, error) {
+	if descriptor, known := cronDescriptors[strings.TrimSpace(expr)]; known {
+		expr = descriptor
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression %q: expected 5 fields, found %d", expr, len(fields))
+	}
+
+	schedule := &cronSchedule{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	bounds := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&schedule.minute, 0, 59},
+		{&schedule.hour, 0, 23},
+		{&schedule.dom, 1, 31},
+		{&schedule.month, 1, 12},
+		{&schedule.dow, 0, 7},
+	}
+	for i, field := range fields {
+		bits, err := parseCronField(field, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron expression %q: %s", expr, err.Error())
+		}
+		*bounds[i].bits = bits
+	}
+
+	// Sunday can be written as 7
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+
+	return schedule, nil
+}
+
+// MustCron is like Cron, but panics if the expression is invalid
+func MustCron(expr string) Schedule {
+	schedule, err := Cron(expr)
+	if err != nil {
+		panic(err)
+	}
+	return schedule
+}
+
+// parseCronField parses a single field of a cron expression into a bitset of the values it matches
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangeExpr, step := item, 1
+		if slash := strings.Index(item, "/"); slash >= 0 {
+			parsed, err := strconv.Atoi(item[slash+1:])
+			if err != nil || parsed < 1 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+			rangeExpr, step = item[:slash], parsed
+		}
+
+		start, end := min, max
+		if rangeExpr != "*" {
+			bounds := strings.SplitN(rangeExpr, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", item)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", item)
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is outside of %d-%d", item, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// cronSearchYears is how far ahead Next will look for a matching time
+const cronSearchYears = 5
+
+func (c *cronSchedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches reports whether the schedule runs on the day of t
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
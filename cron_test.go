@@ -0,0 +1,60 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCron(t *testing.T) {
+	Convey("Cron", t, func() {
+		at := func(value string) time.Time {
+			parsed, err := time.Parse("2006-01-02 15:04", value)
+			So(err, ShouldBeNil)
+			return parsed
+		}
+		next := func(expr string, after string) string {
+			schedule, err := Cron(expr)
+			So(err, ShouldBeNil)
+			return schedule.Next(at(after)).Format("2006-01-02 15:04")
+		}
+
+		Convey("runs every minute", func() {
+			So(next("* * * * *", "2024-03-10 12:30"), ShouldEqual, "2024-03-10 12:31")
+		})
+
+		Convey("runs at a fixed time", func() {
+			So(next("15 2 * * *", "2024-03-10 12:30"), ShouldEqual, "2024-03-11 02:15")
+			So(next("@daily", "2024-03-10 12:30"), ShouldEqual, "2024-03-11 00:00")
+		})
+
+		Convey("supports steps, ranges and lists", func() {
+			So(next("*/20 * * * *", "2024-03-10 12:41"), ShouldEqual, "2024-03-10 13:00")
+			So(next("0 9-17/4 * * *", "2024-03-10 13:00"), ShouldEqual, "2024-03-10 17:00")
+			So(next("0 0 1,15 * *", "2024-03-02 00:00"), ShouldEqual, "2024-03-15 00:00")
+		})
+
+		Convey("supports days of the week, with Sunday as 0 or 7", func() {
+			// 2024-03-10 is a Sunday
+			So(next("0 0 * * 1", "2024-03-10 12:00"), ShouldEqual, "2024-03-11 00:00")
+			So(next("0 0 * * 7", "2024-03-11 12:00"), ShouldEqual, "2024-03-17 00:00")
+		})
+
+		Convey("runs on either restricted day", func() {
+			So(next("0 0 1 * 5", "2024-03-10 12:00"), ShouldEqual, "2024-03-15 00:00")
+			So(next("0 0 1 * 5", "2024-03-29 12:00"), ShouldEqual, "2024-04-01 00:00")
+		})
+
+		Convey("skips months without the day", func() {
+			So(next("0 0 31 * *", "2024-04-01 00:00"), ShouldEqual, "2024-05-31 00:00")
+		})
+
+		Convey("rejects invalid expressions", func() {
+			for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+				_, err := Cron(expr)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
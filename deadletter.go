@@ -0,0 +1,131 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// A DeadLetter is a record which a stage failed to process, kept so it can be fixed and replayed
+type DeadLetter struct {
+	// Stage is the name of the stage which failed to process the record
+	Stage string
+	// Source is where the record was read from, such as the name of a file or an Elasticsearch
+	// index. It is empty if it is not known
+	Source string
+	// Offset is the index of the record within Source
+	Offset int64
+	// ID identifies the record within Source, when it has one
+	ID string
+	// Raw is the record as it was read, such as a CSV row, JSON value, XML element, or
+	// Elasticsearch document
+	Raw []byte
+	// Err is the error encountered while processing the record
+	Err error
+}
+
+// A DeadLetterSink receives the records which stages failed to process. It must be safe for
+// concurrent use, as it may be shared by several stages
+type DeadLetterSink interface {
+	Send(letter DeadLetter) error
+}
+
+// FileDeadLetterSink is a DeadLetterSink which appends each DeadLetter to a file as a line of JSON
+type FileDeadLetterSink struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// deadLetterLine is how a DeadLetter is written by a FileDeadLetterSink. Raw is base64 encoded,
+// so that records which are not valid UTF-8 are replayed exactly as they were read
+type deadLetterLine struct {
+	Time   time.Time `json:"time"`
+	Stage  string    `json:"stage"`
+	Source string    `json:"source,omitempty"`
+	Offset int64     `json:"offset"`
+	ID     string    `json:"id,omitempty"`
+	Raw    []byte    `json:"raw"`
+	Error  string    `json:"error"`
+}
+
+// NewFileDeadLetterSink builds a FileDeadLetterSink which appends to the file at path, creating it
+// if it does not exist. The sink must be closed once the stages using it have finished
+func NewFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterSink{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Send writes the DeadLetter to the file
+func (s *FileDeadLetterSink) Send(letter DeadLetter) error {
+	line := deadLetterLine{
+		Time:   time.Now().UTC(),
+		Stage:  letter.Stage,
+		Source: letter.Source,
+		Offset: letter.Offset,
+		ID:     letter.ID,
+		Raw:    letter.Raw,
+	}
+	if letter.Err != nil {
+		line.Error = letter.Err.Error()
+	}
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.writer.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+// Close closes the file
+func (s *FileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// ReadDeadLetters reads the DeadLetters written to the file at path by a FileDeadLetterSink,
+// so that they can be replayed
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	letters := []DeadLetter{}
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		line := deadLetterLine{}
+		if err := decoder.Decode(&line); err != nil {
+			return letters, err
+		}
+		letter := DeadLetter{
+			Stage:  line.Stage,
+			Source: line.Source,
+			Offset: line.Offset,
+			ID:     line.ID,
+			Raw:    line.Raw,
+		}
+		if line.Error != "" {
+			letter.Err = errors.New(line.Error)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
@@ -0,0 +1,67 @@
+package ingest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileDeadLetterSink(t *testing.T) {
+	Convey("FileDeadLetterSink", t, func() {
+		dir, err := ioutil.TempDir("", "ingest-dead-letters")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "dead-letters.jsonl")
+
+		Convey("writes dead letters which can be read back", func() {
+			sink, err := NewFileDeadLetterSink(path)
+			So(err, ShouldBeNil)
+			So(sink.Send(DeadLetter{Stage: "parse-csv", Source: "a.csv", Offset: 3, Raw: []byte("a,b"), Err: errors.New("bad row")}), ShouldBeNil)
+			So(sink.Send(DeadLetter{Stage: "write-elasticsearch", Source: "idx", ID: "7", Raw: []byte(`{"a":1}`)}), ShouldBeNil)
+			So(sink.Close(), ShouldBeNil)
+
+			letters, err := ReadDeadLetters(path)
+			So(err, ShouldBeNil)
+			So(letters, ShouldHaveLength, 2)
+			So(letters[0].Stage, ShouldEqual, "parse-csv")
+			So(letters[0].Source, ShouldEqual, "a.csv")
+			So(letters[0].Offset, ShouldEqual, 3)
+			So(string(letters[0].Raw), ShouldEqual, "a,b")
+			So(letters[0].Err.Error(), ShouldEqual, "bad row")
+			So(letters[1].ID, ShouldEqual, "7")
+			So(string(letters[1].Raw), ShouldEqual, `{"a":1}`)
+			So(letters[1].Err, ShouldBeNil)
+		})
+
+		Convey("keeps records which are not valid UTF-8", func() {
+			raw := []byte{'a', 0xff, 0xfe, ',', 'b'}
+			sink, err := NewFileDeadLetterSink(path)
+			So(err, ShouldBeNil)
+			So(sink.Send(DeadLetter{Stage: "parse-csv", Raw: raw}), ShouldBeNil)
+			So(sink.Close(), ShouldBeNil)
+
+			letters, err := ReadDeadLetters(path)
+			So(err, ShouldBeNil)
+			So(letters, ShouldHaveLength, 1)
+			So(letters[0].Raw, ShouldResemble, raw)
+		})
+
+		Convey("appends to an existing file", func() {
+			for i := 0; i < 2; i++ {
+				sink, err := NewFileDeadLetterSink(path)
+				So(err, ShouldBeNil)
+				So(sink.Send(DeadLetter{Stage: "parse-json", Offset: int64(i)}), ShouldBeNil)
+				So(sink.Close(), ShouldBeNil)
+			}
+
+			letters, err := ReadDeadLetters(path)
+			So(err, ShouldBeNil)
+			So(letters, ShouldHaveLength, 2)
+			So(letters[1].Offset, ShouldEqual, 1)
+		})
+	})
+}
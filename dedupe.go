@@ -0,0 +1,489 @@
+package ingest
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// DedupeKeyFn is a function that returns the key used to identify duplicate records
+type DedupeKeyFn func(rec interface{}) string
+
+// A DedupeStore remembers the keys of the records a Deduper has seen
+type DedupeStore interface {
+	// Seen records the key, returning whether it had already been recorded
+	Seen(key string) (bool, error)
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// A Deduper drops records whose key has already been seen during the run
+type Deduper struct {
+	Log   Logger
+	In    <-chan interface{}
+	KeyFn DedupeKeyFn
+	Store DedupeStore
+
+	dropped int64
+	err     error
+}
+
+// Dedupe builds a Deduper which identifies duplicate records by the key returned by keyFn.
+//
+// By default the keys are kept in memory. Use LRU or WithStore for datasets whose keys do not
+// fit in memory
+func Dedupe(keyFn DedupeKeyFn) *Deduper {
+	return &Deduper{
+		Log:   DefaultLogger.WithField("task", "dedupe"),
+		KeyFn: keyFn,
+		Store: NewMemoryDedupeStore(),
+	}
+}
+
+// LRU is a chainable configuration method that keeps only the size most recently seen keys,
+// so duplicates further apart than that will not be dropped.
+//
+// The size must be greater than zero, otherwise the Deduper reports an error when started
+func (d *Deduper) LRU(size int) *Deduper {
+	if size <= 0 {
+		d.err = invalidLRUSize(size)
+		return d
+	}
+	return d.WithStore(NewLRUDedupeStore(size))
+}
+
+// WithStore is a chainable configuration method used to set where the Deduper keeps the keys it
+// has seen. The store is closed once the Deduper finishes
+func (d *Deduper) WithStore(store DedupeStore) *Deduper {
+	d.Store = store
+	return d
+}
+
+// Dropped returns how many duplicate records have been dropped
+func (d *Deduper) Dropped() int64 {
+	return atomic.LoadInt64(&d.dropped)
+}
+
+// Start starts running the Dedupe task under the control of the specified controller, reading
+// records from In and writing the first record for each key to the returned channel
+func (d *Deduper) Start(ctrl *Controller) <-chan interface{} {
+	in := d.In
+	out := make(chan interface{})
+
+	ctrl = ctrl.ChildNamed("dedupe")
+	defer ctrl.ChildBuilt()
+
+	// A Deduper which was configured with invalid options reports why and emits nothing
+	if d.err != nil {
+		ctrl.ReportError("dedupe", 0, d.err)
+		close(out)
+		return out
+	}
+
+	checkpoints := ctrl.Checkpointer()
+
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+		defer close(out)
+		defer d.Store.Close()
+
+		d.Log.Debug("Starting worker")
+		defer func() {
+			d.Log.WithField("dropped", d.Dropped()).Info("Finished deduplicating")
+		}()
+
+		for rec := range in {
+			if !ctrl.AwaitResume() {
+				return
+			}
+
+			seen, err := d.Store.Seen(d.KeyFn(rec))
+			if err != nil {
+				ctrl.ReportError("dedupe", 0, err)
+				continue
+			}
+			if seen {
+				atomic.AddInt64(&d.dropped, 1)
+				checkpoints.Transfer(rec, nil)
+				continue
+			}
+
+			select {
+			case <-ctrl.Quit:
+				return
+			case out <- rec:
+			}
+		}
+	}()
+
+	return out
+}
+
+// Transform reads from the specified input and starts the Deduper under the control of the
+// specified controller, allowing it to be used as a Transform in a Pipeline
+func (d *Deduper) Transform(ctrl *Controller, in <-chan interface{}) <-chan interface{} {
+	d.In = in
+	return d.Start(ctrl)
+}
+
+// MemoryDedupeStore is a DedupeStore which keeps every key in memory
+type MemoryDedupeStore struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// NewMemoryDedupeStore builds a new MemoryDedupeStore
+func NewMemoryDedupeStore() *MemoryDedupeStore {
+	return &MemoryDedupeStore{keys: map[string]struct{}{}}
+}
+
+// Seen records the key, returning whether it had already been recorded
+func (s *MemoryDedupeStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, seen := s.keys[key]; seen {
+		return true, nil
+	}
+	s.keys[key] = struct{}{}
+	return false, nil
+}
+
+// Close releases the keys held by the store
+func (s *MemoryDedupeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = map[string]struct{}{}
+	return nil
+}
+
+// LRUDedupeStore is a DedupeStore which keeps a bounded number of the most recently seen keys
+type LRUDedupeStore struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+	err   error
+}
+
+// NewLRUDedupeStore builds a new LRUDedupeStore which keeps up to size keys. The size must be
+// greater than zero, otherwise Seen returns an error
+func NewLRUDedupeStore(size int) *LRUDedupeStore {
+	store := &LRUDedupeStore{
+		size:  size,
+		order: list.New(),
+		keys:  map[string]*list.Element{},
+	}
+	if size <= 0 {
+		store.err = invalidLRUSize(size)
+	}
+	return store
+}
+
+// invalidLRUSize is the error reported when an LRUDedupeStore is built with a size which is not positive
+func invalidLRUSize(size int) error {
+	return fmt.Errorf("Invalid LRU: size must be greater than zero, received %d", size)
+}
+
+// Seen records the key, returning whether it is one of the most recently seen keys
+func (s *LRUDedupeStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return false, s.err
+	}
+
+	if elem, seen := s.keys[key]; seen {
+		s.order.MoveToFront(elem)
+		return true, nil
+	}
+
+	s.keys[key] = s.order.PushFront(key)
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.keys, oldest.Value.(string))
+	}
+	return false, nil
+}
+
+// Close releases the keys held by the store
+func (s *LRUDedupeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.order.Init()
+	s.keys = map[string]*list.Element{}
+	return nil
+}
+
+// FileDedupeInitialSlots is how many keys a FileDedupeStore has room for before it first grows
+var FileDedupeInitialSlots int64 = 1 << 16
+
+// dedupeSlotBytes is the size of each slot of a FileDedupeStore, which holds the hash of a key
+const dedupeSlotBytes = 8
+
+// verifiedSlotBytes is the size of each slot of a FileDedupeStore which verifies its keys, which
+// also holds the offset of the key in the key log
+const verifiedSlotBytes = 16
+
+// FileDedupeStore is a DedupeStore which keeps a 64 bit hash of each key in a hash table on disk,
+// for datasets whose keys do not fit in memory.
+//
+// The table doubles in size whenever it becomes half full. Because only the hashes of the keys are
+// stored, there is a very small chance of distinct keys being reported as duplicates, unless
+// VerifyKeys is used
+type FileDedupeStore struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	keys   *os.File
+	keyEnd int64
+	slots  int64
+	count  int64
+	err    error
+}
+
+// NewFileDedupeStore builds a new FileDedupeStore which keeps its table at the specified path. Any
+// existing file at the path is replaced, and the file is removed when the store is closed
+func NewFileDedupeStore(path string) (*FileDedupeStore, error) {
+	file, err := createDedupeTable(path, FileDedupeInitialSlots*dedupeSlotBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDedupeStore{path: path, file: file, slots: FileDedupeInitialSlots}, nil
+}
+
+// VerifyKeys is a chainable configuration method that makes the store keep each key in a log next to
+// its table, so keys whose hashes match are compared before being reported as duplicates. This
+// doubles the size of the table, and the log holds every distinct key.
+//
+// It must be called before the store is used
+func (s *FileDedupeStore) VerifyKeys() *FileDedupeStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys != nil || s.err != nil {
+		return s
+	}
+	if s.count > 0 {
+		s.err = errors.New("FileDedupeStore.VerifyKeys must be called before the store is used")
+		return s
+	}
+
+	keys, err := os.Create(s.keysPath())
+	if err != nil {
+		s.err = err
+		return s
+	}
+	if err := s.file.Truncate(s.slots * verifiedSlotBytes); err != nil {
+		keys.Close()
+		s.err = err
+		return s
+	}
+	s.keys = keys
+	return s
+}
+
+// Seen records the key, returning whether it had already been recorded
+func (s *FileDedupeStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return false, s.err
+	}
+
+	// The table grows before the key is inserted, so a failed grow leaves the key unrecorded and
+	// it is not taken for a duplicate when it is seen again
+	if (s.count+1)*2 > s.slots {
+		if err := s.grow(); err != nil {
+			return false, err
+		}
+	}
+
+	seen, err := s.insert(dedupeHash(key), key)
+	if err != nil || seen {
+		return seen, err
+	}
+	s.count++
+	return false, nil
+}
+
+// Close closes and removes the files holding the table and the key log
+func (s *FileDedupeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if s.keys != nil {
+		if err := s.keys.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(s.keysPath()); err != nil {
+			return err
+		}
+	}
+	return os.Remove(s.path)
+}
+
+// keysPath returns the path of the key log
+func (s *FileDedupeStore) keysPath() string {
+	return s.path + ".keys"
+}
+
+// slotBytes returns the size of each slot of the table
+func (s *FileDedupeStore) slotBytes() int64 {
+	if s.keys != nil {
+		return verifiedSlotBytes
+	}
+	return dedupeSlotBytes
+}
+
+// insert adds the key to the table using linear probing, returning whether it was already present.
+// When verifying keys, a slot with the same hash only holds the key if the logged key matches
+func (s *FileDedupeStore) insert(hash uint64, key string) (bool, error) {
+	slot := make([]byte, s.slotBytes())
+	for i := int64(hash % uint64(s.slots)); ; i = (i + 1) % s.slots {
+		if _, err := s.file.ReadAt(slot, i*s.slotBytes()); err != nil {
+			return false, err
+		}
+		switch binary.LittleEndian.Uint64(slot) {
+		case hash:
+			if s.keys == nil {
+				return true, nil
+			}
+			logged, err := s.readKey(int64(binary.LittleEndian.Uint64(slot[8:])))
+			if err != nil {
+				return false, err
+			}
+			if logged == key {
+				return true, nil
+			}
+		case 0:
+			binary.LittleEndian.PutUint64(slot, hash)
+			if s.keys != nil {
+				offset, err := s.logKey(key)
+				if err != nil {
+					return false, err
+				}
+				binary.LittleEndian.PutUint64(slot[8:], uint64(offset))
+			}
+			_, err := s.file.WriteAt(slot, i*s.slotBytes())
+			return false, err
+		}
+	}
+}
+
+// logKey appends the key to the key log, returning its offset
+func (s *FileDedupeStore) logKey(key string) (int64, error) {
+	entry := make([]byte, 4+len(key))
+	binary.LittleEndian.PutUint32(entry, uint32(len(key)))
+	copy(entry[4:], key)
+
+	offset := s.keyEnd
+	if _, err := s.keys.WriteAt(entry, offset); err != nil {
+		return 0, err
+	}
+	s.keyEnd += int64(len(entry))
+	return offset, nil
+}
+
+// readKey reads the key logged at the specified offset
+func (s *FileDedupeStore) readKey(offset int64) (string, error) {
+	length := make([]byte, 4)
+	if _, err := s.keys.ReadAt(length, offset); err != nil {
+		return "", err
+	}
+	key := make([]byte, binary.LittleEndian.Uint32(length))
+	if _, err := s.keys.ReadAt(key, offset+4); err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// grow moves the slots into a table twice the size. The new table replaces the old one on disk
+// before the store switches to it, so a failed grow leaves the store using the old table
+func (s *FileDedupeStore) grow() error {
+	slots := s.slots * 2
+	slotBytes := s.slotBytes()
+	growPath := s.path + ".grow"
+	grown, err := createDedupeTable(growPath, slots*slotBytes)
+	if err != nil {
+		return err
+	}
+	abandon := func(err error) error {
+		grown.Close()
+		os.Remove(growPath)
+		return err
+	}
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return abandon(err)
+	}
+	reader := bufio.NewReader(s.file)
+	slot := make([]byte, slotBytes)
+	for i := int64(0); i < s.slots; i++ {
+		if _, err := io.ReadFull(reader, slot); err != nil {
+			return abandon(err)
+		}
+		if binary.LittleEndian.Uint64(slot) != 0 {
+			if err := placeDedupeSlot(grown, slots, slot); err != nil {
+				return abandon(err)
+			}
+		}
+	}
+
+	if err := os.Rename(growPath, s.path); err != nil {
+		return abandon(err)
+	}
+	s.file.Close()
+	s.file = grown
+	s.slots = slots
+	return nil
+}
+
+// createDedupeTable creates an empty table of the specified size
+func createDedupeTable(path string, size int64) (*os.File, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// placeDedupeSlot writes a slot into the first empty slot of the table after the one its hash maps to
+func placeDedupeSlot(file *os.File, slots int64, slot []byte) error {
+	existing := make([]byte, len(slot))
+	for i := int64(binary.LittleEndian.Uint64(slot) % uint64(slots)); ; i = (i + 1) % slots {
+		if _, err := file.ReadAt(existing, i*int64(len(slot))); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint64(existing) == 0 {
+			_, err := file.WriteAt(slot, i*int64(len(slot)))
+			return err
+		}
+	}
+}
+
+// dedupeHash hashes the key, reserving 0 for empty slots
+func dedupeHash(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	if sum := hash.Sum64(); sum != 0 {
+		return sum
+	}
+	return 1
+}
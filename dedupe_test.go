@@ -0,0 +1,142 @@
+package ingest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDedupe(t *testing.T) {
+	Convey("Dedupe", t, func() {
+		ctrl := NewController()
+		key := func(rec interface{}) string {
+			return fmt.Sprint(rec)
+		}
+
+		Convey("drops repeated records and counts them", func() {
+			dedupe := Dedupe(key)
+			dedupe.In = StreamArray([]int{1, 2, 1, 3, 2, 1}).Start(ctrl)
+
+			results, err := Stream(dedupe.Start(ctrl)).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []interface{}{1, 2, 3})
+			So(dedupe.Dropped(), ShouldEqual, 3)
+		})
+
+		Convey("LRU forgets the least recently seen keys", func() {
+			dedupe := Dedupe(key).LRU(2)
+			dedupe.In = StreamArray([]int{1, 2, 3, 1, 3}).Start(ctrl)
+
+			results, err := Stream(dedupe.Start(ctrl)).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []interface{}{1, 2, 3, 1})
+			So(dedupe.Dropped(), ShouldEqual, 1)
+		})
+
+		Convey("LRU reports an error instead of starting when the size is not positive", func() {
+			dedupe := Dedupe(key).LRU(0)
+			dedupe.In = StreamArray([]int{1, 1}).Start(ctrl)
+
+			results, err := Stream(dedupe.Start(ctrl)).Collect(ctrl)
+			So(err, ShouldNotBeNil)
+			So(results, ShouldBeEmpty)
+
+			_, err = NewLRUDedupeStore(-1).Seen("a")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("FileDedupeStore", func() {
+			dir, err := ioutil.TempDir("", "dedupe")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			initialSlots := FileDedupeInitialSlots
+			FileDedupeInitialSlots = 4
+			defer func() { FileDedupeInitialSlots = initialSlots }()
+
+			store, err := NewFileDedupeStore(filepath.Join(dir, "keys"))
+			So(err, ShouldBeNil)
+
+			// dedupeTwice runs every number below 100 through the store twice
+			dedupeTwice := func(store DedupeStore) {
+				input := []int{}
+				for i := 0; i < 100; i++ {
+					input = append(input, i, i)
+				}
+				dedupe := Dedupe(key).WithStore(store)
+				dedupe.In = StreamArray(input).Start(ctrl)
+
+				results, err := Stream(dedupe.Start(ctrl)).Collect(ctrl)
+				So(err, ShouldBeNil)
+				So(results, ShouldHaveLength, 100)
+				So(dedupe.Dropped(), ShouldEqual, 100)
+				ctrl.Wait()
+			}
+
+			Convey("keeps keys on disk as it grows", func() {
+				dedupeTwice(store)
+
+				_, err = os.Stat(filepath.Join(dir, "keys"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Convey("VerifyKeys keeps the keys as the table grows", func() {
+				dedupeTwice(store.VerifyKeys())
+
+				_, err = os.Stat(filepath.Join(dir, "keys.keys"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Convey("VerifyKeys tells apart distinct keys whose hashes collide", func() {
+				store.VerifyKeys()
+				defer store.Close()
+
+				seen, err := store.insert(42, "first")
+				So(err, ShouldBeNil)
+				So(seen, ShouldBeFalse)
+
+				seen, err = store.insert(42, "second")
+				So(err, ShouldBeNil)
+				So(seen, ShouldBeFalse)
+
+				seen, err = store.insert(42, "first")
+				So(err, ShouldBeNil)
+				So(seen, ShouldBeTrue)
+			})
+
+			Convey("does not record a key when the table fails to grow", func() {
+				defer store.Close()
+				for _, key := range []string{"a", "b"} {
+					seen, err := store.Seen(key)
+					So(err, ShouldBeNil)
+					So(seen, ShouldBeFalse)
+				}
+
+				// A directory where the grown table would be created makes the grow fail
+				growPath := filepath.Join(dir, "keys.grow")
+				So(os.Mkdir(growPath, 0755), ShouldBeNil)
+				_, err := store.Seen("c")
+				So(err, ShouldNotBeNil)
+
+				So(os.Remove(growPath), ShouldBeNil)
+				seen, err := store.Seen("c")
+				So(err, ShouldBeNil)
+				So(seen, ShouldBeFalse)
+			})
+
+			Convey("VerifyKeys fails once the store has been used", func() {
+				defer store.Close()
+
+				_, err := store.Seen("first")
+				So(err, ShouldBeNil)
+
+				_, err = store.VerifyKeys().Seen("second")
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
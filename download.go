@@ -1,16 +1,36 @@
 package ingest
 
 import (
+	"context"
+	"fmt"
 	"github.com/alexflint/go-cloudfile"
 	"github.com/mcuadros/go-defaults"
+	"github.com/urbint/ingest/trace"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
 )
 
 // DownloadCopyBlockBytes is how many bytes will be written between checking for aborts
 var DownloadCopyBlockBytes int64 = 256000
 
+// DownloadHTTPClient is the client used to download files served over HTTP. It times out if the
+// server takes too long to connect or respond, but not while the body is read, so large files can
+// take as long as they need. A download whose body stalls is cancelled when the controller quits
+var DownloadHTTPClient = &http.Client{Transport: downloadTransport()}
+
+// downloadTransport returns the http.DefaultTransport, which times out connecting, with a timeout
+// for the response headers
+func downloadTransport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return transport
+}
+
 // A Downloader will download the specified URLs
 type Downloader struct {
 	Opts     DownloadOpts
@@ -34,6 +54,16 @@ type DownloadOpts struct {
 
 	// Cleanup defines whether the `DownloadTo` directory will be removed when the invoking controller finishes
 	Cleanup bool
+
+	// BandwidthLimiter is an optional RateLimiter which limits how many bytes per second are downloaded.
+	// It is shared by all of the downloads of the Downloader
+	BandwidthLimiter *RateLimiter
+
+	// Retries is how many times a failed download will be retried before its error is reported
+	Retries int
+
+	// RetryDelay is how long to wait before retrying a failed download
+	RetryDelay time.Duration `default:"1s"`
 }
 
 // DownloadProgress represents download progress
@@ -65,7 +95,7 @@ func (d *Downloader) Start(ctrl *Controller) <-chan *os.File {
 	result := make(chan *os.File)
 	queue := d.downloadQueue()
 
-	childCtrl := ctrl.Child()
+	childCtrl := ctrl.ChildNamed("download")
 	defer childCtrl.ChildBuilt()
 
 	d.depGroup.Wait()
@@ -83,12 +113,40 @@ func (d *Downloader) Start(ctrl *Controller) <-chan *os.File {
 	}()
 
 	for i := 0; i < d.Opts.MaxParallelDownloads; i++ {
-		d.startDownloadWorker(childCtrl, queue, result)
+		d.startDownloadWorker(childCtrl, i, queue, result)
 	}
 
 	return result
 }
 
+// Produce starts the Downloader under the control of the specified controller, allowing it to
+// be used as the Source of a Pipeline
+func (d *Downloader) Produce(ctrl *Controller) <-chan interface{} {
+	files := d.Start(ctrl)
+	out := make(chan interface{})
+
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+		defer close(out)
+		for file := range files {
+			select {
+			case <-ctrl.Quit:
+				file.Close()
+				return
+			case out <- file:
+			}
+		}
+	}()
+
+	return out
+}
+
+// Produces returns the type of record produced by the Downloader
+func (d *Downloader) Produces() reflect.Type {
+	return reflect.TypeOf((*os.File)(nil))
+}
+
 // DownloadTo is a chainable configuration method to set the directory where files are
 // downloaded to
 func (d *Downloader) DownloadTo(path string) *Downloader {
@@ -109,12 +167,31 @@ func (d *Downloader) WithOpts(opts DownloadOpts) *Downloader {
 	return d
 }
 
-// ReportProgressTo is a chainable configuration method used to configure where Download Progress Reported To
+// ReportProgressTo is a chainable configuration method used to configure where Download Progress Reported To.
+//
+// A goroutine is started for each event, so Controller.ReportProgressEvery is preferred
 func (d *Downloader) ReportProgressTo(progress chan DownloadProgress) *Downloader {
 	d.Opts.Progress = progress
 	return d
 }
 
+// LimitBandwidth is a chainable configuration method used to limit the Downloader to
+// bytesPerSecond across all of its downloads, with bursts of up to burst bytes.
+//
+// The limit can be changed while downloading by calling SetRate on Opts.BandwidthLimiter
+func (d *Downloader) LimitBandwidth(bytesPerSecond float64, burst int) *Downloader {
+	d.Opts.BandwidthLimiter = NewRateLimiter(bytesPerSecond, burst)
+	return d
+}
+
+// Retry is a chainable configuration method used to retry failed downloads up to times times,
+// waiting delay before each attempt. Retries are counted by the download stage's metrics
+func (d *Downloader) Retry(times int, delay time.Duration) *Downloader {
+	d.Opts.Retries = times
+	d.Opts.RetryDelay = delay
+	return d
+}
+
 // DependOn is a chainable configuration method that will not proceed until all
 // specified controllers have resolved
 func (d *Downloader) DependOn(ctrls ...*Controller) *Downloader {
@@ -122,18 +199,62 @@ func (d *Downloader) DependOn(ctrls ...*Controller) *Downloader {
 	return d
 }
 
+// DownloadURLContext will download the specified URL into the configured temp directory, aborting
+// the download if the context is cancelled
+func (d *Downloader) DownloadURLContext(ctx context.Context, url string) (*os.File, error) {
+	return d.DownloadURL(url, ctx.Done())
+}
+
 // DownloadURL will download the specified URL into the configured temp directory. If the URL
 // is a file that exists on disk, the file will be read directly from the file system instead
-func (d *Downloader) DownloadURL(url string, abort chan struct{}) (*os.File, error) {
+func (d *Downloader) DownloadURL(url string, abort <-chan struct{}) (*os.File, error) {
+	ctrl := NewController()
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-abort:
+			ctrl.quit()
+		case <-finished:
+		}
+	}()
+
+	return d.download(url, ctrl)
+}
+
+// download will download the specified URL under the control of the specified controller, pausing
+// between blocks while the controller is paused. The download is traced as a span
+func (d *Downloader) download(url string, ctrl *Controller) (file *os.File, err error) {
+	_, span := ctrl.Tracer().Start(ctrl.Context(), "download-file", trace.String("file", url))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
 	log := d.Log.WithField("file", url)
 	log.Info("Opening...")
 
-	err := os.MkdirAll(d.Opts.DownloadTo, 0770)
+	err = os.MkdirAll(d.Opts.DownloadTo, 0770)
 	if err != nil {
 		return nil, err
 	}
 
-	reader, err := cloudfile.Open(url)
+	_, outName := filepath.Split(url)
+	destPath := filepath.Join(d.Opts.DownloadTo, outName)
+
+	// Reuse the file downloaded by a previous run if it was completed
+	checkpoints := ctrl.Checkpointer()
+	if resumed := checkpoints.Resume("download", url); resumed.Done {
+		if info, statErr := os.Stat(destPath); statErr == nil && info.Size() == resumed.Bytes {
+			log.Info("Already downloaded")
+			return os.Open(destPath)
+		}
+	}
+
+	reader, err := openDownload(ctrl.Context(), url)
 	if err != nil {
 		log.WithError(err).Error("Error opening file")
 		return nil, err
@@ -148,32 +269,128 @@ func (d *Downloader) DownloadURL(url string, abort chan struct{}) (*os.File, err
 		defer asCloser.Close()
 	}
 
-	_, outName := filepath.Split(url)
-	destFile, err := os.Create(filepath.Join(d.Opts.DownloadTo, outName))
+	destFile, err := os.Create(destPath)
 	if err != nil {
 		log.WithError(err).Error("Error creating local file")
 		return nil, err
 	}
 
+	// A file which was not completely downloaded is removed, so it is never taken for the whole file
+	discard := func(err error) (*os.File, error) {
+		destFile.Close()
+		os.Remove(destPath)
+		return nil, err
+	}
+
+	progress := ctrl.Stage("download")
+	source := progress.Reader(reader)
+
+	var total int64
+	defer func() { span.SetAttributes(trace.Int("bytes", total)) }()
+
 	for {
-		select {
-		case <-abort:
-			return nil, ErrAborted
-		default:
-			coppied, err := io.CopyN(destFile, reader, DownloadCopyBlockBytes)
-			d.reportProgress(outName, coppied)
+		if !ctrl.AwaitResume() {
+			return discard(ErrAborted)
+		}
+
+		coppied, err := io.CopyN(destFile, source, d.copyBlockBytes())
+		total += coppied
+		d.reportProgress(outName, coppied)
 
-			if err != nil {
-				if err == io.EOF {
-					return destFile, nil
+		if !d.Opts.BandwidthLimiter.Wait(int(coppied), ctrl.Quit) {
+			return discard(ErrAborted)
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				d.checkpoint(checkpoints, log, url, destFile, total)
+				// Rewind the file, so it is read from the start as a reused download is
+				if _, err := destFile.Seek(0, io.SeekStart); err != nil {
+					return discard(err)
 				}
-				log.WithError(err).Error("Error writing to local file")
-				return nil, err
+				return destFile, nil
 			}
+			log.WithError(err).Error("Error writing to local file")
+			return discard(err)
 		}
 	}
 }
 
+// checkpoint records that the file has been downloaded, once it has been flushed to disk
+func (d *Downloader) checkpoint(checkpoints *Checkpointer, log Logger, url string, file *os.File, size int64) {
+	if checkpoints == nil {
+		return
+	}
+	err := file.Sync()
+	if err == nil {
+		err = checkpoints.Complete("download", url, size)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Error checkpointing download")
+	}
+}
+
+// copyBlockBytes returns how many bytes to copy between checks, which is no more than the
+// burst size of the bandwidth limit so the download proceeds smoothly
+func (d *Downloader) copyBlockBytes() int64 {
+	if _, burst := d.Opts.BandwidthLimiter.Rate(); burst > 0 && int64(burst) < DownloadCopyBlockBytes {
+		return int64(burst)
+	}
+	return DownloadCopyBlockBytes
+}
+
+// openDownload opens the file at url. Files served over HTTP are requested under ctx, so the
+// request is cancelled if the download is aborted, and their size is read from the response
+func openDownload(ctx context.Context, url string) (io.Reader, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return cloudfile.Open(url)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := DownloadHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("Error downloading %s: %s", url, res.Status)
+	}
+	if res.ContentLength < 0 {
+		return res.Body, nil
+	}
+	return sizedBody{res.Body, res.ContentLength}, nil
+}
+
+// sizedBody is the body of an HTTP response whose size is known from its Content-Length
+type sizedBody struct {
+	io.ReadCloser
+	size int64
+}
+
+// Size returns the size of the body
+func (b sizedBody) Size() int64 {
+	return b.size
+}
+
+// downloadWithRetries downloads the specified URL, retrying up to Opts.Retries times if it fails
+func (d *Downloader) downloadWithRetries(url string, ctrl *Controller, log Logger, progress *StageProgress) (*os.File, error) {
+	res, err := d.download(url, ctrl)
+	for attempt := 0; err != nil && err != ErrAborted && attempt < d.Opts.Retries; attempt++ {
+		log.WithError(err).WithField("file", url).Warn("Retrying download")
+		select {
+		case <-ctrl.Quit:
+			return nil, ErrAborted
+		case <-time.After(d.Opts.RetryDelay):
+		}
+		progress.Retried(1)
+		res, err = d.download(url, ctrl)
+	}
+	return res, err
+}
+
 func (d *Downloader) reportProgress(file string, bytes int64) {
 	if d.Opts.Progress != nil {
 		go func() {
@@ -192,28 +409,41 @@ func (d *Downloader) downloadQueue() <-chan string {
 	return queue
 }
 
-func (d *Downloader) startDownloadWorker(ctrl *Controller, queue <-chan string, results chan *os.File) {
-	d.Log.Debug("Starting worker")
+func (d *Downloader) startDownloadWorker(ctrl *Controller, id int, queue <-chan string, results chan *os.File) {
+	log := d.Log.WithField("worker", id)
+	log.Debug("Starting worker")
+	progress := ctrl.Stage("download")
 	ctrl.WorkerStart()
 	go func() {
 		defer ctrl.WorkerEnd()
-		defer d.Log.Debug("Exiting worker")
+		defer log.Debug("Exiting worker")
 		for {
+			// Stop taking new downloads once the controller begins draining
+			if ctrl.IsDraining() {
+				return
+			}
 			select {
-			case <-ctrl.Quit:
+			case <-ctrl.Draining():
 				return
 			case url, ok := <-queue:
 				if !ok {
 					return
 				}
-				res, err := d.DownloadURL(url, ctrl.Quit)
+				progress.In(1)
+				started := time.Now()
+				res, err := d.downloadWithRetries(url, ctrl, log, progress)
+				progress.Observe(time.Since(started))
 				if err != nil {
-					ctrl.Err <- err
+					progress.Failed(1)
+					ctrl.ReportError("download", id, err)
 				} else {
+					// Finished downloads are passed on while draining
 					select {
 					case <-ctrl.Quit:
+						res.Close()
 						return
 					case results <- res:
+						progress.Out(1)
 						continue
 					}
 				}
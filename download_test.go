@@ -0,0 +1,61 @@
+package ingest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDownloader(t *testing.T) {
+	Convey("Downloader", t, func() {
+		dir, err := ioutil.TempDir("", "ingest-download")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		dest := filepath.Join(dir, "file.txt")
+
+		Convey("removes the partial file when the download fails", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(100))
+				w.Write([]byte("too short"))
+			}))
+			defer server.Close()
+
+			file, err := Download().DownloadTo(dir).DownloadURL(server.URL+"/file.txt", nil)
+			So(err, ShouldNotBeNil)
+			So(file, ShouldBeNil)
+
+			_, err = os.Stat(dest)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("removes the partial file when the download is aborted", func() {
+			started := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("partial"))
+				w.(http.Flusher).Flush()
+				close(started)
+				<-r.Context().Done()
+			}))
+			defer server.Close()
+
+			abort := make(chan struct{})
+			go func() {
+				<-started
+				close(abort)
+			}()
+
+			file, err := Download().DownloadTo(dir).DownloadURL(server.URL+"/file.txt", abort)
+			So(err, ShouldNotBeNil)
+			So(file, ShouldBeNil)
+
+			_, err = os.Stat(dest)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
@@ -1,6 +1,54 @@
 package ingest
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // ErrAborted is returned when an abortable task is aborted
 var ErrAborted = errors.New("Task was aborted")
+
+// ErrDrainTimeout is the reason recorded when a Controller is aborted because it did not finish draining in time
+var ErrDrainTimeout = errors.New("Timed out waiting for tasks to drain")
+
+// A TaskError is an error that was reported by a worker of a task
+type TaskError struct {
+	// Task is the name of the task that reported the error
+	Task string
+	// Worker is the index of the worker within the task that reported the error
+	Worker int
+	// Err is the error that was encountered
+	Err error
+}
+
+func (t *TaskError) Error() string {
+	return fmt.Sprintf("%s (worker %d): %s", t.Task, t.Worker, t.Err.Error())
+}
+
+// Unwrap returns the error that was encountered by the worker
+func (t *TaskError) Unwrap() error {
+	return t.Err
+}
+
+// A MultiError is a collection of errors reported by the workers of a Controller
+type MultiError []error
+
+func (m MultiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = "  * " + err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred:\n%s", len(m), strings.Join(msgs, "\n"))
+}
+
+// ErrorOrNil returns nil if the MultiError is empty, or the MultiError otherwise
+func (m MultiError) ErrorOrNil() error {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
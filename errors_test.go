@@ -0,0 +1,108 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestErrors(t *testing.T) {
+	Convey("TaskError", t, func() {
+		cause := errors.New("bad row")
+		err := &TaskError{Task: "parse-csv", Worker: 2, Err: cause}
+
+		Convey("identifies the task and worker", func() {
+			So(err.Error(), ShouldEqual, "parse-csv (worker 2): bad row")
+		})
+
+		Convey("unwraps to the error encountered", func() {
+			So(errors.Is(err, cause), ShouldBeTrue)
+		})
+	})
+
+	Convey("MultiError", t, func() {
+		first := &TaskError{Task: "download", Worker: 0, Err: errors.New("timeout")}
+		second := &TaskError{Task: "parse-csv", Worker: 1, Err: errors.New("bad row")}
+
+		Convey("formats a single error as itself", func() {
+			So(MultiError{first}.Error(), ShouldEqual, first.Error())
+		})
+
+		Convey("lists every error", func() {
+			So(MultiError{first, second}.Error(), ShouldEqual,
+				"2 errors occurred:\n  * download (worker 0): timeout\n  * parse-csv (worker 1): bad row")
+		})
+
+		Convey("ErrorOrNil is nil only when empty", func() {
+			So(MultiError{}.ErrorOrNil(), ShouldBeNil)
+			So(MultiError(nil).ErrorOrNil(), ShouldBeNil)
+			So(MultiError{first}.ErrorOrNil(), ShouldResemble, MultiError{first})
+		})
+	})
+
+	Convey("ErrorPolicy", t, func() {
+		Convey("FailFast aborts on the first error", func() {
+			So(FailFast.MaxErrors, ShouldEqual, 1)
+
+			ctrl := NewController().CollectErrors(FailFast)
+			startErroringWorkers(ctrl, 2)
+
+			err := ctrl.Error()
+			So(err, ShouldNotBeNil)
+			So(ctrl.State(), ShouldEqual, StateFailed)
+		})
+
+		Convey("FailAfter aborts after the specified number of errors", func() {
+			ctrl := NewController().CollectErrors(FailAfter(3))
+			report := make(chan struct{})
+			ctrl.WorkerStart()
+			go func() {
+				defer ctrl.WorkerEnd()
+				for i := 1; ; i++ {
+					select {
+					case <-ctrl.Quit:
+						return
+					case <-report:
+						ctrl.ReportError("test", 0, fmt.Errorf("error %d", i))
+					}
+				}
+			}()
+			result := make(chan error, 1)
+			go func() { result <- ctrl.Error() }()
+
+			for reported := 1; reported < 3; reported++ {
+				report <- struct{}{}
+				So(waitFor(func() bool { return len(ctrl.Errors()) == reported }, time.Second), ShouldBeTrue)
+				So(ctrl.State(), ShouldEqual, StateRunning)
+			}
+
+			report <- struct{}{}
+			err := <-result
+			So(err, ShouldHaveSameTypeAs, MultiError{})
+			So(err.(MultiError), ShouldHaveLength, 3)
+			So(ctrl.State(), ShouldEqual, StateFailed)
+		})
+
+		Convey("NeverFail collects errors sent on Err as well as those reported", func() {
+			ctrl := NewController().CollectErrors(NeverFail)
+			ctrl.WorkerStart()
+			go func() {
+				defer ctrl.WorkerEnd()
+				ctrl.Err <- errors.New("sent")
+				ctrl.ReportError("test", 4, errors.New("reported"))
+			}()
+
+			err := ctrl.Error()
+			So(err, ShouldHaveSameTypeAs, MultiError{})
+			So(err.(MultiError), ShouldHaveLength, 2)
+			So(ctrl.State(), ShouldEqual, StateFinished)
+
+			taskErr, isTaskErr := err.(MultiError)[1].(*TaskError)
+			So(isTaskErr, ShouldBeTrue)
+			So(taskErr.Worker, ShouldEqual, 4)
+		})
+	})
+}
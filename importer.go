@@ -1,22 +1,57 @@
 package ingest
 
 import (
+	"errors"
 	"sync"
+	"time"
 )
 
+// ErrAlreadyRunning is returned when an Importer is run while it is already running
+var ErrAlreadyRunning = errors.New("Importer is already running")
+
 // An ImportFn is a function that will be called by an importer when it is run
 // it recieves the active ingest controller and is expected to return any
 // error encountered during the run
 type ImportFn func(ctrl *Controller) error
 
+// An ImportErrorFn is a function that will be called by an importer when a run fails,
+// with the error that caused the run to fail
+type ImportErrorFn func(ctrl *Controller, err error)
+
+// ImporterStatus is a snapshot of the status of an Importer
+type ImporterStatus struct {
+	// Running is whether the importer is running
+	Running bool
+	// Started is when the current (or last) run started, or the zero time if it has never run
+	Started time.Time
+	// Elapsed is how long the current run has been running
+	Elapsed time.Duration
+	// LastDuration is how long the last finished run took
+	LastDuration time.Duration
+	// LastError is the error returned by the last finished run, if any
+	LastError error
+	// Progress is the Progress of each stage of the current (or last) run, which includes its record counts
+	Progress []Progress
+}
+
 // An Importer is a control structure around an ingest.Controller that reduces
 // the amount of boilerplate required for simple importers.
 //
 // It implements a foreman.Abortable interface
 type Importer struct {
-	ctrl *Controller
-	fn   ImportFn
-	mu   sync.Mutex
+	ctrl        *Controller
+	fn          ImportFn
+	mu          sync.Mutex
+	checkpoints CheckpointStore
+
+	beforeRun []ImportFn
+	afterRun  []ImportFn
+	onError   []ImportErrorFn
+
+	running      bool
+	started      time.Time
+	lastDuration time.Duration
+	lastErr      error
 }
 
 // NewImporter builds an importer with the speicifed ImportFn
@@ -26,31 +61,180 @@ func NewImporter(fn ImportFn) *Importer {
 	}
 }
 
-// Run runs the specified importer calling the function specified at construction
-func (i *Importer) Run() error {
-	ctrl := i.BuildNewController()
-	return i.fn(ctrl)
+// ResumeFrom is a chainable configuration method that enables checkpointing into the store. If a
+// run fails, the next run resumes after the last durable checkpoint. The checkpoints are cleared
+// once a run succeeds, so the run after it starts from the beginning
+func (i *Importer) ResumeFrom(store CheckpointStore) *Importer {
+	i.checkpoints = store
+	return i
+}
+
+// BeforeRun is a chainable configuration method that adds a hook which is called before the
+// ImportFn of each run, such as to create an index. If the hook returns an error, the run fails
+// without calling the ImportFn.
+//
+// Hooks are called in the order they were added, and must be added before the importer is run
+func (i *Importer) BeforeRun(fn ImportFn) *Importer {
+	i.beforeRun = append(i.beforeRun, fn)
+	return i
+}
+
+// AfterRun is a chainable configuration method that adds a hook which is called after the
+// ImportFn of each successful run, such as to swap an alias to a new index. If the hook
+// returns an error, the run fails.
+//
+// Hooks are called in the order they were added, and must be added before the importer is run
+func (i *Importer) AfterRun(fn ImportFn) *Importer {
+	i.afterRun = append(i.afterRun, fn)
+	return i
+}
+
+// OnError is a chainable configuration method that adds a hook which is called when a run
+// fails, whether the error came from the ImportFn or from a BeforeRun or AfterRun hook.
+//
+// Hooks are called in the order they were added, and must be added before the importer is run
+func (i *Importer) OnError(fn ImportErrorFn) *Importer {
+	i.onError = append(i.onError, fn)
+	return i
+}
+
+// Run runs the specified importer calling the function specified at construction, along with
+// its hooks. ErrAlreadyRunning is returned if the importer is already running.
+//
+// The importer stops running even if the ImportFn or one of its hooks panics, so it can be run again
+func (i *Importer) Run() (err error) {
+	i.mu.Lock()
+	if i.running {
+		i.mu.Unlock()
+		return ErrAlreadyRunning
+	}
+	i.running = true
+	i.started = time.Now()
+	i.ctrl = NewController()
+	ctrl := i.ctrl
+	i.mu.Unlock()
+
+	defer func() {
+		i.mu.Lock()
+		i.running = false
+		i.lastDuration = time.Since(i.started)
+		i.lastErr = err
+		i.mu.Unlock()
+	}()
+
+	err = i.run(ctrl)
+	if err != nil {
+		for _, fn := range i.onError {
+			fn(ctrl, err)
+		}
+	}
+	return err
+}
+
+// run runs the hooks and ImportFn under the control of the specified controller
+func (i *Importer) run(ctrl *Controller) error {
+	var checkpointer *Checkpointer
+	if i.checkpoints != nil {
+		var err error
+		if checkpointer, err = NewCheckpointer(i.checkpoints); err != nil {
+			return err
+		}
+		ctrl.WithCheckpointer(checkpointer)
+	}
+
+	for _, fn := range i.beforeRun {
+		if err := fn(ctrl); err != nil {
+			return err
+		}
+	}
+	if err := i.fn(ctrl); err != nil {
+		return err
+	}
+	for _, fn := range i.afterRun {
+		if err := fn(ctrl); err != nil {
+			return err
+		}
+	}
+	return checkpointer.Clear()
+}
+
+// Status returns a snapshot of the status of the importer
+func (i *Importer) Status() ImporterStatus {
+	i.mu.Lock()
+	status := ImporterStatus{
+		Running:      i.running,
+		Started:      i.started,
+		LastDuration: i.lastDuration,
+		LastError:    i.lastErr,
+	}
+	ctrl := i.ctrl
+	i.mu.Unlock()
+
+	if status.Running {
+		status.Elapsed = time.Since(status.Started)
+	}
+	if ctrl != nil {
+		status.Progress = ctrl.Progress()
+	}
+	return status
 }
 
-// Abort will abort the importer if it is running
+// Abort will abort the importer if it is running. Aborting an importer which is not running
+// has no effect, so a finished run is never reported as aborted.
+//
+// It is safe to call Abort multiple times, and from multiple goroutines.
 func (i *Importer) Abort() {
 	i.mu.Lock()
-	defer i.mu.Unlock()
+	ctrl := i.ctrl
+	running := i.running
+	i.mu.Unlock()
+
+	if running && ctrl != nil {
+		ctrl.Abort()
+	}
+}
+
+// Pause pauses the importer if it is running
+func (i *Importer) Pause() {
+	i.mu.Lock()
+	ctrl := i.ctrl
+	i.mu.Unlock()
+
+	if ctrl != nil {
+		ctrl.Pause()
+	}
+}
 
-	if i.ctrl != nil {
-		i.ctrl.Abort()
-		i.ctrl = nil
+// Resume resumes the importer if it has been paused
+func (i *Importer) Resume() {
+	i.mu.Lock()
+	ctrl := i.ctrl
+	i.mu.Unlock()
+
+	if ctrl != nil {
+		ctrl.Resume()
 	}
 }
 
+// Controller returns the controller of the current (or last) run of the importer, or nil if it
+// has never run
+func (i *Importer) Controller() *Controller {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.ctrl
+}
+
 // BuildNewController allocates a new ingest.Controller for the importer, while
-// waiting for the appropriate locks
+// waiting for the appropriate locks. It returns the controller for convenience.
+// The controller of a run in progress is never replaced, and is returned instead
 //
-// It returns the controller for convenience
+// Deprecated: Run allocates a new Controller for each run, which Controller returns
 func (i *Importer) BuildNewController() *Controller {
 	i.mu.Lock()
-	i.ctrl = NewController()
-	i.mu.Unlock()
+	defer i.mu.Unlock()
 
+	if !i.running {
+		i.ctrl = NewController()
+	}
 	return i.ctrl
 }
@@ -0,0 +1,136 @@
+package ingest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImporter(t *testing.T) {
+	Convey("Importer", t, func() {
+		calls := []string{}
+		hook := func(name string, err error) ImportFn {
+			return func(ctrl *Controller) error {
+				calls = append(calls, name)
+				return err
+			}
+		}
+		onError := func(ctrl *Controller, err error) {
+			calls = append(calls, "error: "+err.Error())
+		}
+
+		Convey("calls its hooks around the ImportFn", func() {
+			importer := NewImporter(hook("run", nil)).
+				BeforeRun(hook("before", nil)).
+				AfterRun(hook("after", nil)).
+				OnError(onError)
+
+			So(importer.Run(), ShouldBeNil)
+			So(calls, ShouldResemble, []string{"before", "run", "after"})
+		})
+
+		Convey("does not run the ImportFn when a BeforeRun hook fails", func() {
+			importer := NewImporter(hook("run", nil)).
+				BeforeRun(hook("before", errors.New("no index"))).
+				AfterRun(hook("after", nil)).
+				OnError(onError)
+
+			So(importer.Run(), ShouldNotBeNil)
+			So(calls, ShouldResemble, []string{"before", "error: no index"})
+		})
+
+		Convey("calls the OnError hooks when the ImportFn fails", func() {
+			importer := NewImporter(hook("run", errors.New("boom"))).
+				AfterRun(hook("after", nil)).
+				OnError(onError)
+
+			So(importer.Run(), ShouldNotBeNil)
+			So(calls, ShouldResemble, []string{"run", "error: boom"})
+			So(importer.Status().LastError.Error(), ShouldEqual, "boom")
+		})
+
+		Convey("Controller returns the controller handed to the ImportFn", func() {
+			var ran *Controller
+			importer := NewImporter(func(ctrl *Controller) error {
+				ran = ctrl
+				return nil
+			})
+			So(importer.Controller(), ShouldBeNil)
+			So(importer.Run(), ShouldBeNil)
+			So(importer.Controller(), ShouldEqual, ran)
+		})
+
+		Convey("Abort does not change a run which has finished", func() {
+			importer := NewImporter(func(ctrl *Controller) error {
+				ctrl.WorkerStart()
+				ctrl.WorkerEnd()
+				return ctrl.Error()
+			})
+			So(importer.Run(), ShouldBeNil)
+
+			importer.Abort()
+			So(importer.Controller().State(), ShouldEqual, StateFinished)
+			So(importer.Controller().AbortReason(), ShouldBeNil)
+		})
+
+		Convey("stops running when the ImportFn panics", func() {
+			panics := true
+			importer := NewImporter(func(ctrl *Controller) error {
+				if panics {
+					panic("boom")
+				}
+				return nil
+			})
+
+			So(func() { importer.Run() }, ShouldPanicWith, "boom")
+			So(importer.Status().Running, ShouldBeFalse)
+
+			panics = false
+			So(importer.Run(), ShouldBeNil)
+		})
+
+		Convey("reports its status", func() {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			importer := NewImporter(func(ctrl *Controller) error {
+				ctrl.Stage("stream").Out(3)
+				close(started)
+				<-release
+				return nil
+			})
+			So(importer.Status().Running, ShouldBeFalse)
+			So(importer.Status().Started.IsZero(), ShouldBeTrue)
+
+			done := make(chan error)
+			go func() { done <- importer.Run() }()
+			<-started
+
+			status := importer.Status()
+			So(status.Running, ShouldBeTrue)
+			So(status.Progress, ShouldHaveLength, 1)
+			So(status.Progress[0].RecordsOut, ShouldEqual, 3)
+
+			Convey("and does not allow concurrent runs", func() {
+				So(importer.Run(), ShouldEqual, ErrAlreadyRunning)
+			})
+
+			Convey("and does not replace the controller of the run", func() {
+				ctrl := importer.Controller()
+				So(importer.BuildNewController(), ShouldEqual, ctrl)
+				So(importer.Controller(), ShouldEqual, ctrl)
+			})
+
+			time.Sleep(5 * time.Millisecond)
+			close(release)
+			So(<-done, ShouldBeNil)
+
+			status = importer.Status()
+			So(status.Running, ShouldBeFalse)
+			So(status.LastError, ShouldBeNil)
+			So(status.LastDuration, ShouldBeGreaterThanOrEqualTo, 5*time.Millisecond)
+			So(status.Progress[0].RecordsOut, ShouldEqual, 3)
+		})
+	})
+}
@@ -9,21 +9,99 @@ func defaultLogOpts() *LogOpts {
 	return &LogOpts{DefaultLogger}
 }
 
-// DefaultLogger is where ingest will log to. By default, it wont log. We recommend
-// setting it to Logrus, or Apex, or your own.
-var DefaultLogger Logger = &EmptyLogger{}
+// DefaultLogger is where ingest will log to. By default, warnings and errors are logged to the
+// log/slog default logger. Set it to a SlogLogger, Logrus, Apex, or your own, before building
+// any tasks, to change where ingest logs to.
+//
+// Every task logs with a "task" field. Workers add a "worker" field, and where they are known,
+// "file" and "offset" fields identify the file and record being processed
+var DefaultLogger Logger = WithLevel(NewSlogLogger(nil), LevelWarn)
 
 // Logger is a logging interface which mirrors pico.Logger, apex.Logger, and logrus.Logger
 type Logger interface {
 	WithError(err error) Logger
 	WithField(field string, value interface{}) Logger
+	WithFields(fields map[string]interface{}) Logger
 	Debug(args ...interface{})
 	Info(args ...interface{})
 	Warn(args ...interface{})
 	Error(args ...interface{})
 }
 
-// EmptyLogger is the Default Logger used. It wont log. We recommend you set it to something better.
+// Level is the severity of a log entry
+type Level int
+
+// The levels a Logger logs at, from least to most severe
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the name of the level
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// WithLevel wraps log so that entries less severe than level are dropped
+func WithLevel(log Logger, level Level) Logger {
+	return &levelLogger{log, level}
+}
+
+// levelLogger drops the entries less severe than its level
+type levelLogger struct {
+	log   Logger
+	level Level
+}
+
+func (l *levelLogger) WithError(err error) Logger {
+	return &levelLogger{l.log.WithError(err), l.level}
+}
+
+func (l *levelLogger) WithField(field string, value interface{}) Logger {
+	return &levelLogger{l.log.WithField(field, value), l.level}
+}
+
+func (l *levelLogger) WithFields(fields map[string]interface{}) Logger {
+	return &levelLogger{l.log.WithFields(fields), l.level}
+}
+
+func (l *levelLogger) Debug(args ...interface{}) {
+	if l.level <= LevelDebug {
+		l.log.Debug(args...)
+	}
+}
+
+func (l *levelLogger) Info(args ...interface{}) {
+	if l.level <= LevelInfo {
+		l.log.Info(args...)
+	}
+}
+
+func (l *levelLogger) Warn(args ...interface{}) {
+	if l.level <= LevelWarn {
+		l.log.Warn(args...)
+	}
+}
+
+func (l *levelLogger) Error(args ...interface{}) {
+	if l.level <= LevelError {
+		l.log.Error(args...)
+	}
+}
+
+// EmptyLogger is a Logger which wont log. Set DefaultLogger to it to silence ingest.
 type EmptyLogger struct{}
 
 // WithError placeholder
@@ -32,6 +110,9 @@ func (e *EmptyLogger) WithError(err error) Logger { return e }
 // WithField placeholder
 func (e *EmptyLogger) WithField(field string, value interface{}) Logger { return e }
 
+// WithFields placeholder
+func (e *EmptyLogger) WithFields(fields map[string]interface{}) Logger { return e }
+
 // Debug placeholder
 func (e *EmptyLogger) Debug(args ...interface{}) {}
 
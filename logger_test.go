@@ -0,0 +1,52 @@
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSlogLogger(t *testing.T) {
+	Convey("SlogLogger", t, func() {
+		buf := &bytes.Buffer{}
+		handler := slog.NewTextHandler(buf, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+			ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+				if attr.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return attr
+			},
+		})
+		log := NewSlogLogger(slog.New(handler))
+
+		Convey("logs fields as attributes", func() {
+			log.WithField("task", "stream").WithFields(map[string]interface{}{"worker": 1, "file": "a.csv"}).Info("Starting worker")
+			So(buf.String(), ShouldEqual, "level=INFO msg=\"Starting worker\" task=stream file=a.csv worker=1\n")
+		})
+
+		Convey("logs errors", func() {
+			log.WithError(errors.New("boom")).Error("Failed")
+			So(buf.String(), ShouldEqual, "level=ERROR msg=Failed error=boom\n")
+		})
+
+		Convey("does not share fields between derived loggers", func() {
+			base := log.WithField("task", "a")
+			base.WithField("worker", 1)
+			base.Warn("done")
+			So(buf.String(), ShouldEqual, "level=WARN msg=done task=a\n")
+		})
+
+		Convey("gates levels when wrapped WithLevel", func() {
+			gated := WithLevel(log, LevelWarn).WithField("task", "a")
+			gated.Debug("debug")
+			gated.Info("info")
+			gated.Warn("warn")
+			gated.Error("error")
+			So(buf.String(), ShouldEqual, "level=WARN msg=warn task=a\nlevel=ERROR msg=error task=a\n")
+		})
+	})
+}
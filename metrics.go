@@ -0,0 +1,69 @@
+package ingest
+
+import (
+	"time"
+
+	"github.com/urbint/ingest/metrics"
+)
+
+// DefaultMetrics is the registry ingest will report metrics into when a Controller has not been
+// configured with WithMetrics. By default, metrics are discarded
+var DefaultMetrics metrics.Registry = metrics.Discard
+
+// WithMetrics is a chainable configuration method that sets the registry the stages run under the
+// Controller (and its children) report metrics into. It must be called before the stages are started
+func (c *Controller) WithMetrics(registry metrics.Registry) *Controller {
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	root.metrics = registry
+	return c
+}
+
+// Metrics returns the registry the stages run under the Controller report metrics into
+func (c *Controller) Metrics() metrics.Registry {
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if root.metrics == nil {
+		return DefaultMetrics
+	}
+	return root.metrics
+}
+
+// stageMetrics are the metrics reported by a stage as its progress is counted
+type stageMetrics struct {
+	in      metrics.Counter
+	out     metrics.Counter
+	failed  metrics.Counter
+	bytes   metrics.Counter
+	retries metrics.Counter
+	latency metrics.Histogram
+}
+
+// newStageMetrics builds the metrics for the named stage
+func newStageMetrics(registry metrics.Registry, stage string) stageMetrics {
+	labels := metrics.Labels{"stage": stage}
+	return stageMetrics{
+		in:      registry.Counter("ingest_records_in_total", "Records read by the stage.", labels),
+		out:     registry.Counter("ingest_records_out_total", "Records written by the stage.", labels),
+		failed:  registry.Counter("ingest_records_failed_total", "Records the stage failed to process.", labels),
+		bytes:   registry.Counter("ingest_bytes_total", "Bytes read by the stage.", labels),
+		retries: registry.Counter("ingest_retries_total", "Operations the stage retried after they failed.", labels),
+		latency: registry.Histogram("ingest_record_duration_seconds", "Time taken by the stage to process each record.", labels, nil),
+	}
+}
+
+// reportErrorMetric counts an error reported by the specified task
+func (c *Controller) reportErrorMetric(task string) {
+	c.Metrics().Counter("ingest_errors_total", "Errors reported by the task.", metrics.Labels{"task": task}).Add(1)
+}
+
+// Observe records how long the stage took to process a single record
+func (p *StageProgress) Observe(duration time.Duration) {
+	if p != nil {
+		p.metrics.latency.Observe(duration.Seconds())
+	}
+}
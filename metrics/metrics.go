@@ -0,0 +1,44 @@
+// Package metrics defines the registry that ingest stages report metrics into, along with an
+// in-memory implementation which exposes them in the Prometheus text exposition format
+package metrics
+
+// Labels are the names and values which identify a single series of a metric
+type Labels map[string]string
+
+// A Counter is a metric which only ever increases
+type Counter interface {
+	Add(value float64)
+}
+
+// A Histogram is a metric which counts observations into buckets
+type Histogram interface {
+	Observe(value float64)
+}
+
+// A Registry creates the metrics reported by ingest stages. Calling Counter or Histogram
+// with the same name and labels returns the same series. A name is used by a single kind of
+// metric, so a Registry may panic if a name is reused for a different kind.
+//
+// Implementations must be safe for concurrent use, and can adapt other metrics libraries
+type Registry interface {
+	// Counter returns the counter with the specified name and labels
+	Counter(name, help string, labels Labels) Counter
+	// Histogram returns the histogram with the specified name and labels. If buckets is nil,
+	// DefaultBuckets are used
+	Histogram(name, help string, labels Labels, buckets []float64) Histogram
+}
+
+// DefaultBuckets are the upper bounds of histogram buckets, in seconds, suitable for latencies
+var DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10, 30}
+
+// Discard is a Registry whose metrics are thrown away
+var Discard Registry = discard{}
+
+type discard struct{}
+
+func (discard) Counter(name, help string, labels Labels) Counter { return discard{} }
+func (discard) Histogram(name, help string, labels Labels, buckets []float64) Histogram {
+	return discard{}
+}
+func (discard) Add(value float64)     {}
+func (discard) Observe(value float64) {}
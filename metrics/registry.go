@@ -0,0 +1,207 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A MemoryRegistry is a Registry which keeps its metrics in memory. It is an http.Handler which
+// writes the metrics in the Prometheus text exposition format
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// family is all of the series of a single metric
+type family struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*series
+}
+
+// series is a single counter or histogram
+type series struct {
+	mu     sync.Mutex
+	labels string
+	bounds []float64
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// NewRegistry builds a new, empty MemoryRegistry
+func NewRegistry() *MemoryRegistry {
+	return &MemoryRegistry{families: map[string]*family{}}
+}
+
+// Counter returns the counter with the specified name and labels
+func (r *MemoryRegistry) Counter(name, help string, labels Labels) Counter {
+	return (*counter)(r.series(name, help, "counter", nil, labels))
+}
+
+// Histogram returns the histogram with the specified name and labels
+func (r *MemoryRegistry) Histogram(name, help string, labels Labels, buckets []float64) Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return (*histogram)(r.series(name, help, "histogram", buckets, labels))
+}
+
+// series returns the series of the named family with the specified labels, creating them if needed.
+//
+// The kind and buckets of a family are set by the first call for its name. It panics if the name
+// is reused for a different kind of metric, as the exposition would otherwise be invalid
+func (r *MemoryRegistry) series(name, help, kind string, buckets []float64, labels Labels) *series {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fam, exists := r.families[name]
+	if !exists {
+		fam = &family{name: name, help: help, kind: kind, buckets: buckets, series: map[string]*series{}}
+		r.families[name] = fam
+	} else if fam.kind != kind {
+		panic(fmt.Sprintf("metrics: %s is a %s, it can not be used as a %s", name, fam.kind, kind))
+	}
+
+	key := formatLabels(labels)
+	s, exists := fam.series[key]
+	if !exists {
+		s = &series{labels: key, bounds: fam.buckets, counts: make([]uint64, len(fam.buckets))}
+		fam.series[key] = s
+	}
+	return s
+}
+
+// WriteText writes all of the metrics to w in the Prometheus text exposition format
+func (r *MemoryRegistry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, fam := range r.families {
+		families = append(families, fam)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	out := bufio.NewWriter(w)
+	for _, fam := range families {
+		r.mu.Lock()
+		all := make([]*series, 0, len(fam.series))
+		for _, s := range fam.series {
+			all = append(all, s)
+		}
+		r.mu.Unlock()
+		sort.Slice(all, func(i, j int) bool { return all[i].labels < all[j].labels })
+
+		fmt.Fprintf(out, "# HELP %s %s\n", fam.name, escapeHelp(fam.help))
+		fmt.Fprintf(out, "# TYPE %s %s\n", fam.name, fam.kind)
+		for _, s := range all {
+			s.write(out, fam)
+		}
+	}
+	return out.Flush()
+}
+
+// ServeHTTP writes all of the metrics in the Prometheus text exposition format
+func (r *MemoryRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+// write writes the samples of the series
+func (s *series) write(out io.Writer, fam *family) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fam.kind == "counter" {
+		fmt.Fprintf(out, "%s%s %s\n", fam.name, wrapLabels(s.labels), formatValue(s.value))
+		return
+	}
+
+	var cumulative uint64
+	for i, bound := range s.bounds {
+		cumulative += s.counts[i]
+		fmt.Fprintf(out, "%s_bucket%s %d\n", fam.name, wrapLabels(joinLabels(s.labels, `le="`+formatValue(bound)+`"`)), cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket%s %d\n", fam.name, wrapLabels(joinLabels(s.labels, `le="+Inf"`)), s.count)
+	fmt.Fprintf(out, "%s_sum%s %s\n", fam.name, wrapLabels(s.labels), formatValue(s.value))
+	fmt.Fprintf(out, "%s_count%s %d\n", fam.name, wrapLabels(s.labels), s.count)
+}
+
+// counter is a series used as a Counter
+type counter series
+
+func (c *counter) Add(value float64) {
+	if value < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.value += value
+	c.mu.Unlock()
+}
+
+// histogram is a series used as a Histogram
+type histogram series
+
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.value += value
+	h.count++
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+// formatLabels formats labels in a stable order, without the surrounding braces
+func formatLabels(labels Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabel(labels[name]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(value string) string { return labelEscaper.Replace(value) }
+func escapeHelp(help string) string   { return helpEscaper.Replace(help) }
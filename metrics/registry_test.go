@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	Convey("MemoryRegistry", t, func() {
+		registry := NewRegistry()
+
+		Convey("returns the same series for the same name and labels", func() {
+			registry.Counter("records_total", "Records.", Labels{"stage": "a"}).Add(1)
+			registry.Counter("records_total", "Records.", Labels{"stage": "a"}).Add(2)
+			registry.Counter("records_total", "Records.", Labels{"stage": "b"}).Add(5)
+
+			server := httptest.NewServer(registry)
+			defer server.Close()
+
+			res, err := server.Client().Get(server.URL)
+			So(err, ShouldBeNil)
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			So(res.Header.Get("Content-Type"), ShouldStartWith, "text/plain")
+			So(string(body), ShouldEqual, "# HELP records_total Records.\n"+
+				"# TYPE records_total counter\n"+
+				"records_total{stage=\"a\"} 3\n"+
+				"records_total{stage=\"b\"} 5\n")
+		})
+
+		Convey("writes histograms with cumulative buckets", func() {
+			latency := registry.Histogram("latency_seconds", "Latency.", nil, []float64{0.1, 1})
+			latency.Observe(0.05)
+			latency.Observe(0.5)
+			latency.Observe(2)
+
+			recorder := httptest.NewRecorder()
+			registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+			So(recorder.Body.String(), ShouldEqual, "# HELP latency_seconds Latency.\n"+
+				"# TYPE latency_seconds histogram\n"+
+				"latency_seconds_bucket{le=\"0.1\"} 1\n"+
+				"latency_seconds_bucket{le=\"1\"} 2\n"+
+				"latency_seconds_bucket{le=\"+Inf\"} 3\n"+
+				"latency_seconds_sum 2.55\n"+
+				"latency_seconds_count 3\n")
+		})
+
+		Convey("panics if a name is reused for a different kind of metric", func() {
+			registry.Counter("records_total", "Records.", nil)
+
+			So(func() { registry.Histogram("records_total", "Records.", nil, nil) }, ShouldPanic)
+			So(func() { registry.Counter("records_total", "Records.", Labels{"stage": "a"}) }, ShouldNotPanic)
+		})
+
+		Convey("escapes label values", func() {
+			registry.Counter("errors_total", "Errors.", Labels{"task": "a\"b"}).Add(1)
+
+			recorder := httptest.NewRecorder()
+			registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			So(recorder.Body.String(), ShouldContainSubstring, `errors_total{task="a\"b"} 1`)
+		})
+	})
+}
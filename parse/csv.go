@@ -1,6 +1,8 @@
 package parse
 
 import (
+	"bytes"
+	"context"
 	"encoding/csv"
 	"fmt"
 	"io"
@@ -20,10 +22,20 @@ type CSVUnmarshaler interface {
 	UnmarshalCSVRow(row []string) error
 }
 
+// CSVContextUnmarshaler is a CSVUnmarshaler which is handed the context of the parser's Controller,
+// which is cancelled when the Controller quits
+type CSVContextUnmarshaler interface {
+	UnmarshalCSVRowContext(ctx context.Context, row []string) error
+}
+
 // CSVDecodeError is an error encountered while decoding a parsed CSV row into
 // an interface
 type CSVDecodeError struct {
 	SrcErr error
+	// Offset is the index of the row among the rows following the header
+	Offset int
+	// Column is the header of the column which could not be decoded, or "" if it is not known
+	Column string
 }
 
 func (c *CSVDecodeError) Error() string {
@@ -38,6 +50,7 @@ type CSVParser struct {
 	In     <-chan io.ReadCloser
 	Out    chan interface{}
 	newRec func() interface{}
+	output ingest.Output
 
 	depGroup  *ingest.DependencyGroup
 	delimiter rune
@@ -53,6 +66,7 @@ type CSVParserOpts struct {
 	DateFormat     string `default:"01/02/2006"`
 	Progress       chan struct{}
 	HeaderRowIndex int `default:"0"`
+	DeadLetters    ingest.DeadLetterSink
 }
 
 // NewCSVParser builds a CSVParser. Usually, parse.CSV is preferred
@@ -116,12 +130,21 @@ func (c *CSVParser) LazyQuotes(lazy bool) *CSVParser {
 }
 
 // ReportProgressTo is a chainable configuration method that sets where
-// progress will be reported to
+// progress will be reported to.
+//
+// A goroutine is started for each event, so ingest.Controller.ReportProgressEvery is preferred
 func (c *CSVParser) ReportProgressTo(dest chan struct{}) *CSVParser {
 	c.Opts.Progress = dest
 	return c
 }
 
+// DeadLetterTo is a chainable configuration method that sets where rows which fail
+// to parse are sent, along with the file and offset they were read from
+func (c *CSVParser) DeadLetterTo(sink ingest.DeadLetterSink) *CSVParser {
+	c.Opts.DeadLetters = sink
+	return c
+}
+
 // DependOn is a chainable configuration method that will not proceed until all
 // specified controllers have resolved
 func (c *CSVParser) DependOn(ctrls ...*ingest.Controller) *CSVParser {
@@ -136,6 +159,13 @@ func (c *CSVParser) WriteTo(out chan interface{}) *CSVParser {
 	return c
 }
 
+// SendTo sets an Output the parser writes records to instead of Out, such as a channel of
+// another type adapted with ingest.OutputOf. The Output is closed once the parser finishes
+func (c *CSVParser) SendTo(out ingest.Output) *CSVParser {
+	c.output = out
+	return c
+}
+
 // DateFormat is a chainable configuration method used
 // to configure the format string that will be used by
 // time.Parse to read dates found within the CSV
@@ -154,6 +184,15 @@ func (c *CSVParser) Struct(rec interface{}) *CSVParser {
 	return c
 }
 
+// Maps is a chainable configuration method that makes the parser produce a map[string]interface{}
+// for each row instead of a struct, keyed by the header of each column. Empty columns are omitted
+func (c *CSVParser) Maps() *CSVParser {
+	c.newRec = func() interface{} {
+		return map[string]interface{}{}
+	}
+	return c
+}
+
 // AllocateWith is a chainable configuration method that specifies a function to be called
 // to allocate a new record. This allows for much more performant allocation than reflect-based allocation
 func (c *CSVParser) AllocateWith(fn func() interface{}) *CSVParser {
@@ -161,18 +200,40 @@ func (c *CSVParser) AllocateWith(fn func() interface{}) *CSVParser {
 	return c
 }
 
+// Transform reads from the specified input and starts the parser under the control of the
+// specified controller, allowing it to be used as a Transform in a Pipeline
+func (c *CSVParser) Transform(ctrl *ingest.Controller, in <-chan interface{}) <-chan interface{} {
+	c.In = readClosers(ctrl, "parse-csv", in)
+	return c.Start(ctrl)
+}
+
+// Accepts returns the type of record accepted by the parser
+func (c *CSVParser) Accepts() reflect.Type {
+	return readCloserType
+}
+
+// Produces returns the type of record produced by the parser, or nil if it has not been configured
+func (c *CSVParser) Produces() reflect.Type {
+	return recordType(c.newRec)
+}
+
 // Start starts running the parser under the control of the specified controller
 func (c *CSVParser) Start(ctrl *ingest.Controller) chan interface{} {
 	if c.newRec == nil {
 		panic("No known instantiating function. Configure the parser using .Struct")
 	}
 
-	childCtrl := ctrl.Child()
+	childCtrl := ctrl.ChildNamed("parse-csv")
 	defer childCtrl.ChildBuilt()
 
 	c.depGroup.Wait()
 
-	if c.Out == nil {
+	if c.output != nil {
+		go func() {
+			childCtrl.Wait()
+			c.output.Close()
+		}()
+	} else if c.Out == nil {
 		c.Out = make(chan interface{})
 		go func() {
 			childCtrl.Wait()
@@ -181,9 +242,12 @@ func (c *CSVParser) Start(ctrl *ingest.Controller) chan interface{} {
 	}
 
 	for i := 0; i < c.Opts.NumWorkers; i++ {
-		c.startDecodeWorker(childCtrl)
+		c.startDecodeWorker(childCtrl, i)
 	}
 
+	if c.output != nil {
+		return closedChannel()
+	}
 	return c.Out
 }
 
@@ -191,52 +255,106 @@ func (c *CSVParser) Start(ctrl *ingest.Controller) chan interface{} {
 //
 // If the Parser is configured to AbortOnError it will quit on a Parse error.
 func (c *CSVParser) Decode(input io.ReadCloser, abort chan struct{}) (chan interface{}, chan error) {
+	return c.decode(input, abortController(abort), nil)
+}
+
+// decode reads records from a single reader until it has finished, the controller quits,
+// the controller begins draining, or stop is closed
+func (c *CSVParser) decode(input io.ReadCloser, ctrl *ingest.Controller, stop <-chan struct{}) (chan interface{}, chan error) {
 	done := make(chan interface{})
 	errs := make(chan error)
 
 	go func() {
 		defer func() { close(done) }()
-		reader := csv.NewReader(input)
+		progress := ctrl.Stage("parse-csv")
+		reader := csv.NewReader(progress.Reader(input))
 		reader.Comma = c.delimiter
 		reader.LazyQuotes = c.Opts.LazyQuotes
 		defer input.Close()
 		for i := 0; i < c.Opts.HeaderRowIndex; i++ {
 			if _, err := reader.Read(); err != nil {
-				errs <- err
+				reportDecodeError(ctrl, stop, errs, err)
 				return
 			}
 		}
 		header, err := reader.Read()
 		if err != nil {
-			errs <- err
+			reportDecodeError(ctrl, stop, errs, err)
 			return
 		}
-		fieldMap := c.parseHeaderForType(header, c.newRec())
+		parseRow := c.rowParser(ctrl.Context(), header)
 
-		for {
+		// Skip the rows which were written by a previous run
+		checkpoints, source := checkpointer(ctrl, input)
+		resumed := checkpoints.Resume("parse-csv", source)
+		if resumed.Done {
+			return
+		}
+		for skipped := int64(0); skipped < resumed.Offset; skipped++ {
+			if _, err := reader.Read(); err == io.EOF {
+				return
+			}
+		}
+
+		// Dry runs only read the first rows of each file. Empty columns are omitted from maps, so
+		// the Sampler is told every column to count them as null
+		sampler := ctrl.Sampler()
+		if c.parsesMaps() {
+			sampler.Columns(trimHeader(header)...)
+		}
+
+		for offset := int(resumed.Offset); ; offset++ {
 			select {
-			case <-abort:
+			case <-ctrl.Quit:
+				return
+			case <-stop:
 				return
 			default:
+				if !ctrl.AwaitResume() || sampler.Reached(int64(offset)-resumed.Offset) {
+					return
+				}
 				row, err := reader.Read()
 				if err == io.EOF {
+					finishCheckpoint(checkpoints, c.Log, "parse-csv", source)
 					return
-				} else if err != nil {
-					errs <- err
+				}
+				progress.In(1)
+				if err != nil {
+					progress.Failed(1)
+					sampleCSVError(sampler, header, row, err)
+					c.deadLetter(sampler, input, offset, row, err)
+					if !reportDecodeError(ctrl, stop, errs, err) || c.Opts.AbortOnError {
+						return
+					}
 					continue
 				}
-				rec, err := c.parseRowWithFieldMap(row, fieldMap)
+				started := time.Now()
+				rec, err := parseRow(row)
+				progress.Observe(time.Since(started))
 				if err != nil {
-					errs <- err
+					if decodeErr, isDecodeErr := err.(*CSVDecodeError); isDecodeErr {
+						decodeErr.Offset = offset
+					}
+					progress.Failed(1)
+					sampleCSVError(sampler, header, row, err)
+					c.deadLetter(sampler, input, offset, row, err)
+					if !reportDecodeError(ctrl, stop, errs, err) || c.Opts.AbortOnError {
+						return
+					}
 					continue
 				}
-				select {
-				case <-abort:
-					return
-				case c.Out <- rec:
-					c.reportProgress()
+				checkpoints.Track(rec, "parse-csv", source, int64(offset))
+				sent, err := send(ctrl, c.Out, c.output, rec)
+				if err != nil {
+					if !reportDecodeError(ctrl, stop, errs, err) {
+						return
+					}
 					continue
+				} else if !sent {
+					return
 				}
+				progress.Out(1)
+				c.reportProgress()
 			}
 		}
 	}()
@@ -244,39 +362,79 @@ func (c *CSVParser) Decode(input io.ReadCloser, abort chan struct{}) (chan inter
 	return done, errs
 }
 
-func (c *CSVParser) startDecodeWorker(ctrl *ingest.Controller) {
+// deadLetter sends a row which failed to parse to the configured DeadLetterSink, unless it is a
+// dry run, which must not write anything
+func (c *CSVParser) deadLetter(sampler *ingest.Sampler, input io.Reader, offset int, row []string, err error) {
+	if c.Opts.DeadLetters == nil || sampler != nil {
+		return
+	}
+
+	raw := &bytes.Buffer{}
+	if row != nil {
+		writer := csv.NewWriter(raw)
+		writer.Comma = c.delimiter
+		writer.Write(row)
+		writer.Flush()
+	}
+
+	sendDeadLetter(sampler, c.Opts.DeadLetters, c.Log, ingest.DeadLetter{
+		Stage:  "parse-csv",
+		Source: readerName(input),
+		Offset: int64(offset),
+		Raw:    bytes.TrimRight(raw.Bytes(), "\r\n"),
+		Err:    err,
+	})
+}
+
+func (c *CSVParser) startDecodeWorker(ctrl *ingest.Controller, id int) {
+	workerLog := c.Log.WithField("worker", id)
 	ctrl.WorkerStart()
-	c.Log.Debug("Starting worker")
+	workerLog.Debug("Starting worker")
 	go func() {
 		defer ctrl.WorkerEnd()
-		defer c.Log.Debug("Exiting worker")
+		defer workerLog.Debug("Exiting worker")
 	WorkerAvailable:
 		for {
+			// Stop taking new readers once the controller begins draining
+			if ctrl.IsDraining() {
+				return
+			}
 			select {
-			case <-ctrl.Quit:
+			case <-ctrl.Draining():
 				return
 			case reader, ok := <-c.In:
 				if !ok {
 					return
 				}
-				done, errs := c.Decode(reader, ctrl.Quit)
+				fileLog := readerLog(workerLog, reader)
+				// The decode is stopped and waited for before the worker exits, as the output is closed
+				// once every worker has
+				stop := make(chan struct{})
+				done, errs := c.decode(reader, ctrl, stop)
 				for {
 					select {
 					case <-done:
 						continue WorkerAvailable
 					case err := <-errs:
 						if c.Opts.AbortOnError {
-							ctrl.Err <- err
+							ctrl.ReportError("parse-csv", id, err)
+							close(stop)
+							<-done
 							return
 						}
-						log := c.Log.WithError(err)
+						log := fileLog.WithError(err)
 						if parseErr, isParseError := err.(*csv.ParseError); isParseError && parseErr.Err == csv.ErrFieldCount {
-							log.Warn("Error parsing CSV Row")
-						} else if _, isDecodeErr := err.(*CSVDecodeError); isDecodeErr {
-							log.Warn("Error decoding CSV Row")
+							log.WithField("line", parseErr.Line).Warn("Error parsing CSV Row")
+						} else if decodeErr, isDecodeErr := err.(*CSVDecodeError); isDecodeErr {
+							if decodeErr.Column != "" {
+								log = log.WithField("column", decodeErr.Column)
+							}
+							log.WithField("offset", decodeErr.Offset).Warn("Error decoding CSV Row")
 						} else {
 							log.Error("Unknown CSV Error")
-							ctrl.Err <- err
+							ctrl.ReportError("parse-csv", id, err)
+							close(stop)
+							<-done
 							return
 						}
 					}
@@ -286,6 +444,61 @@ func (c *CSVParser) startDecodeWorker(ctrl *ingest.Controller) {
 	}()
 }
 
+// rowParser returns the function used to parse the rows following the header
+func (c *CSVParser) rowParser(ctx context.Context, header []string) func(row []string) (interface{}, error) {
+	if c.parsesMaps() {
+		columns := trimHeader(header)
+		return func(row []string) (interface{}, error) {
+			return c.parseRowToMap(row, columns), nil
+		}
+	}
+
+	fieldMap := c.parseHeaderForType(header, c.newRec())
+	return func(row []string) (interface{}, error) {
+		return c.parseRowWithFieldMap(ctx, row, header, fieldMap)
+	}
+}
+
+// parsesMaps reports whether the parser produces a map for each row, as configured by Maps
+func (c *CSVParser) parsesMaps() bool {
+	_, isMap := c.newRec().(map[string]interface{})
+	return isMap
+}
+
+// trimHeader returns the names of the columns of a header, without surrounding spaces
+func trimHeader(header []string) []string {
+	columns := make([]string, len(header))
+	for i, column := range header {
+		columns[i] = strings.TrimSpace(column)
+	}
+	return columns
+}
+
+// sampleCSVError reports a row which failed to parse to the Sampler of a dry run. Rows which are
+// missing columns are attributed to the first column which is missing
+func sampleCSVError(sampler *ingest.Sampler, header []string, row []string, err error) {
+	if parseErr, isParseErr := err.(*csv.ParseError); isParseErr && parseErr.Err == csv.ErrFieldCount && len(row) < len(header) {
+		sampler.ParseError(strings.TrimSpace(header[len(row)]), err)
+		return
+	}
+	sampleError(sampler, err)
+}
+
+// parseRowToMap reads a single row into a map keyed by the column names
+func (c *CSVParser) parseRowToMap(row []string, columns []string) map[string]interface{} {
+	rec := c.newRec().(map[string]interface{})
+	for j := 0; j < len(row) && j < len(columns); j++ {
+		str := row[j]
+		if c.Opts.TrimSpaces {
+			str = strings.TrimSpace(str)
+		}
+		if len(str) > 0 {
+			rec[columns[j]] = str
+		}
+	}
+	return rec
+}
+
 // parseHeaderForType builds a header map from a single row using
 // the struct tags specified in the mapper.
 //
@@ -302,18 +515,34 @@ func (c *CSVParser) parseHeaderForType(header []string, mapper interface{}) map[
 	return result
 }
 
-// parseRowWithFieldMap reads a single row with the specified field map and returns a newly built record
-func (c *CSVParser) parseRowWithFieldMap(row []string, fieldMap map[int][]int) (rec interface{}, err error) {
+// parseRowWithFieldMap reads a single row with the specified field map and returns a newly built record.
+//
+// If a column can't be decoded, the CSVDecodeError returned names it using the header
+func (c *CSVParser) parseRowWithFieldMap(ctx context.Context, row []string, header []string, fieldMap map[int][]int) (rec interface{}, err error) {
 	rec = c.newRec()
+	if asUnmarshaler, canUnmarshal := rec.(CSVContextUnmarshaler); canUnmarshal {
+		if err := asUnmarshaler.UnmarshalCSVRowContext(ctx, row); err != nil {
+			return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing row\n  message: %s\n  row: %v", err.Error(), row)}
+		}
+		return rec, nil
+	}
 	if asUnmarshaler, canUnmarshal := rec.(CSVUnmarshaler); canUnmarshal {
 		if err := asUnmarshaler.UnmarshalCSVRow(row); err != nil {
-			return nil, &CSVDecodeError{fmt.Errorf("Error parsing row\n  message: %s\n  row: %v", err.Error(), row)}
+			return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing row\n  message: %s\n  row: %v", err.Error(), row)}
 		}
 		return rec, nil
 	}
 	instance := reflect.ValueOf(rec).Elem()
 
+	column := 0
+	defer func() {
+		if decodeErr, isDecodeErr := err.(*CSVDecodeError); isDecodeErr && column < len(header) {
+			decodeErr.Column = strings.TrimSpace(header[column])
+		}
+	}()
+
 	for j := 0; j < len(row); j++ {
+		column = j
 		fieldIndicies := fieldMap[j]
 
 		// If the length of the string is 0, or we don't have a mapping
@@ -341,47 +570,47 @@ func (c *CSVParser) parseRowWithFieldMap(row []string, fieldMap map[int][]int) (
 		case float32:
 			val, err := strconv.ParseFloat(row[j], 32)
 			if err != nil {
-				return nil, &CSVDecodeError{fmt.Errorf("Error parsing float: %v", row[j])}
+				return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing float: %v", row[j])}
 			}
 			field.SetFloat(val)
 		case int:
 			val, err := strconv.Atoi(row[j])
 			if err != nil {
-				return nil, &CSVDecodeError{fmt.Errorf("Error parsing int: %v", row[j])}
+				return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing int: %v", row[j])}
 			}
 			field.SetInt(int64(val))
 		case int8:
 			val, err := strconv.ParseInt(row[j], 10, 8)
 			if err != nil {
-				return nil, &CSVDecodeError{fmt.Errorf("Error parsing int: %v", row[j])}
+				return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing int: %v", row[j])}
 			}
 			field.SetInt(val)
 		case uint8:
 			val, err := strconv.ParseUint(row[j], 10, 8)
 			if err != nil {
-				return nil, &CSVDecodeError{fmt.Errorf("Error parsing uint: %v", row[j])}
+				return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing uint: %v", row[j])}
 			}
 			field.SetUint(val)
 		case uint16:
 			val, err := strconv.ParseUint(row[j], 10, 16)
 			if err != nil {
-				return nil, &CSVDecodeError{fmt.Errorf("Error parsing uint: %v", row[j])}
+				return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing uint: %v", row[j])}
 			}
 			field.SetUint(val)
 		case uint32:
 			val, err := strconv.ParseUint(row[j], 10, 32)
 			if err != nil {
-				return nil, &CSVDecodeError{fmt.Errorf("Error parsing uint: %v", row[j])}
+				return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing uint: %v", row[j])}
 			}
 			field.SetUint(val)
 		case time.Time:
 			time, err := time.Parse(c.Opts.DateFormat, row[j])
 			if err != nil {
-				return nil, &CSVDecodeError{fmt.Errorf("Error parsing date: %v", row[j])}
+				return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Error parsing date: %v", row[j])}
 			}
 			field.Set(reflect.ValueOf(time))
 		default:
-			return nil, &CSVDecodeError{fmt.Errorf("Unhandled type: %v", field.Type().String())}
+			return nil, &CSVDecodeError{SrcErr: fmt.Errorf("Unhandled type: %v", field.Type().String())}
 		}
 	}
 	return rec, nil
@@ -7,6 +7,7 @@ import (
 	"io"
 	"reflect"
 	"strings"
+	"time"
 )
 
 // A JSONParser handles parsing JSON
@@ -18,6 +19,7 @@ type JSONParser struct {
 	Out chan interface{}
 
 	newRec   func() interface{}
+	output   ingest.Output
 	depGroup *ingest.DependencyGroup
 }
 
@@ -27,6 +29,7 @@ type JSONParseOpts struct {
 	AbortOnError bool
 	NumWorkers   int `default:"1"`
 	Progress     chan struct{}
+	DeadLetters  ingest.DeadLetterSink
 }
 
 // NewJSONParser builds a JSONParser. You will usually want to use parse.JSON instead
@@ -74,12 +77,21 @@ func (j *JSONParser) AbortOnError(abort bool) *JSONParser {
 }
 
 // ReportProgressTo is a chainable configuration method that sets where
-// progress will be reported to
+// progress will be reported to.
+//
+// A goroutine is started for each event, so ingest.Controller.ReportProgressEvery is preferred
 func (j *JSONParser) ReportProgressTo(dest chan struct{}) *JSONParser {
 	j.Opts.Progress = dest
 	return j
 }
 
+// DeadLetterTo is a chainable configuration method that sets where records which fail
+// to unmarshal are sent, along with the file and offset they were read from
+func (j *JSONParser) DeadLetterTo(sink ingest.DeadLetterSink) *JSONParser {
+	j.Opts.DeadLetters = sink
+	return j
+}
+
 // DependOn is a chainable configuration method that will not proceed until all
 // specified controllers have resolved
 func (j *JSONParser) DependOn(ctrls ...*ingest.Controller) *JSONParser {
@@ -94,6 +106,13 @@ func (j *JSONParser) WriteTo(out chan interface{}) *JSONParser {
 	return j
 }
 
+// SendTo sets an Output the parser writes records to instead of Out, such as a channel of
+// another type adapted with ingest.OutputOf. The Output is closed once the parser finishes
+func (j *JSONParser) SendTo(out ingest.Output) *JSONParser {
+	j.output = out
+	return j
+}
+
 // Struct sets the type that will be used to allocate new records
 func (j *JSONParser) Struct(rec interface{}) *JSONParser {
 	indirectType := reflect.Indirect(reflect.ValueOf(rec)).Type()
@@ -108,19 +127,41 @@ func (j *JSONParser) Collect(ctrl *ingest.Controller) ([]interface{}, error) {
 	return ingest.Stream(j.Start(ctrl)).Collect(ctrl)
 }
 
+// Transform reads from the specified input and starts the parser under the control of the
+// specified controller, allowing it to be used as a Transform in a Pipeline
+func (j *JSONParser) Transform(ctrl *ingest.Controller, in <-chan interface{}) <-chan interface{} {
+	j.In = readClosers(ctrl, "parse-json", in)
+	return j.Start(ctrl)
+}
+
+// Accepts returns the type of record accepted by the parser
+func (j *JSONParser) Accepts() reflect.Type {
+	return readCloserType
+}
+
+// Produces returns the type of record produced by the parser, or nil if it has not been configured
+func (j *JSONParser) Produces() reflect.Type {
+	return recordType(j.newRec)
+}
+
 // Start starts running the parser under the control of the specified controller
 func (j *JSONParser) Start(ctrl *ingest.Controller) <-chan interface{} {
 	if j.newRec == nil {
 		panic("No known instantiating function. Configure the parser using .Struct")
 	}
 
-	childCtrl := ctrl.Child()
+	childCtrl := ctrl.ChildNamed("parse-json")
 	defer childCtrl.ChildBuilt()
 
 	j.depGroup.Wait()
 
 	// If we don't have an output channel, make one and close it after we read all the records
-	if j.Out == nil {
+	if j.output != nil {
+		go func() {
+			childCtrl.Wait()
+			j.output.Close()
+		}()
+	} else if j.Out == nil {
 		j.Out = make(chan interface{})
 		go func() {
 			childCtrl.Wait()
@@ -129,39 +170,53 @@ func (j *JSONParser) Start(ctrl *ingest.Controller) <-chan interface{} {
 	}
 
 	for i := 0; i < j.Opts.NumWorkers; i++ {
-		j.startDecodeWorker(childCtrl)
+		j.startDecodeWorker(childCtrl, i)
 	}
 
+	if j.output != nil {
+		return closedChannel()
+	}
 	return j.Out
 }
 
-func (j *JSONParser) startDecodeWorker(ctrl *ingest.Controller) {
+func (j *JSONParser) startDecodeWorker(ctrl *ingest.Controller, id int) {
+	workerLog := j.Log.WithField("worker", id)
 	ctrl.WorkerStart()
-	j.Log.Debug("Starting worker")
+	workerLog.Debug("Starting worker")
 	go func() {
 		defer ctrl.WorkerEnd()
-		defer j.Log.Debug("Exiting worker")
+		defer workerLog.Debug("Exiting worker")
 	WorkerAvailable:
 		for {
+			// Stop taking new readers once the controller begins draining
+			if ctrl.IsDraining() {
+				return
+			}
 			select {
-			case <-ctrl.Quit:
+			case <-ctrl.Draining():
 				return
 			case reader, ok := <-j.In:
 				if !ok {
 					return
 				}
-				done, errs := j.Decode(reader, ctrl.Quit)
+				fileLog := readerLog(workerLog, reader)
+				// The decode is stopped and waited for before the worker exits, as the output is closed
+				// once every worker has
+				stop := make(chan struct{})
+				done, errs := j.decode(reader, ctrl, stop)
 				for {
 					select {
 					case <-done:
 						continue WorkerAvailable
 					case err := <-errs:
 						if j.Opts.AbortOnError {
-							ctrl.Err <- err
+							ctrl.ReportError("parse-json", id, err)
+							close(stop)
+							<-done
 							return
 						}
 
-						log := j.Log.WithError(err)
+						log := fileLog.WithError(err)
 						switch err := err.(type) {
 						case *json.UnmarshalTypeError:
 							log = log.WithField("offset", err.Offset).WithField("value", err.Value)
@@ -178,45 +233,106 @@ func (j *JSONParser) startDecodeWorker(ctrl *ingest.Controller) {
 
 // Decode reads an io.Reader into the output channel. It will report errors on the specified error channel.
 func (j *JSONParser) Decode(reader io.Reader, abort chan struct{}) (done chan struct{}, errs chan error) {
+	return j.decode(reader, abortController(abort), nil)
+}
+
+// decode reads an io.Reader into the output channel until it has finished, the controller quits,
+// the controller begins draining, or stop is closed
+func (j *JSONParser) decode(reader io.Reader, ctrl *ingest.Controller, stop <-chan struct{}) (done chan struct{}, errs chan error) {
 	done = make(chan struct{})
 	errs = make(chan error)
 	go func() {
 		defer func() { close(done) }()
 
-		decoder := json.NewDecoder(reader)
+		progress := ctrl.Stage("parse-json")
+		decoder := json.NewDecoder(progress.Reader(reader))
 		if err := j.navigateToSelection(decoder); err != nil {
-			errs <- err
+			reportDecodeError(ctrl, stop, errs, err)
 			return
 		}
 
-		for {
+		// Skip the records which were written by a previous run
+		checkpoints, source := checkpointer(ctrl, reader)
+		resumed := checkpoints.Resume("parse-json", source)
+		if resumed.Done {
+			return
+		}
+		for skipped := int64(0); skipped < resumed.Offset; skipped++ {
+			var raw json.RawMessage
+			if !decoder.More() || decoder.Decode(&raw) != nil {
+				return
+			}
+		}
+
+		// Dry runs only read the first records of each file
+		sampler := ctrl.Sampler()
+
+		for offset := resumed.Offset; ; offset++ {
 			select {
-			case <-abort:
+			case <-ctrl.Quit:
+				return
+			case <-stop:
 				return
 			default:
+				if !ctrl.AwaitResume() || sampler.Reached(offset-resumed.Offset) {
+					return
+				}
 				if !decoder.More() {
+					finishCheckpoint(checkpoints, j.Log, "parse-json", source)
 					return
 				}
 				rec := j.newRec()
-				if err := decoder.Decode(rec); err != nil {
-					errs <- err
-					if j.Opts.AbortOnError {
+				progress.In(1)
+				started := time.Now()
+				raw, err := j.decodeRecord(decoder, rec)
+				progress.Observe(time.Since(started))
+				if err != nil {
+					progress.Failed(1)
+					sampleError(sampler, err)
+					sendDeadLetter(sampler, j.Opts.DeadLetters, j.Log, ingest.DeadLetter{
+						Stage:  "parse-json",
+						Source: readerName(reader),
+						Offset: offset,
+						Raw:    raw,
+						Err:    err,
+					})
+					if !reportDecodeError(ctrl, stop, errs, err) || j.Opts.AbortOnError {
 						return
 					}
+					continue
 				}
-				select {
-				case <-abort:
-					return
-				case j.Out <- rec:
-					j.reportProgress()
+				checkpoints.Track(rec, "parse-json", source, offset)
+				sent, err := send(ctrl, j.Out, j.output, rec)
+				if err != nil {
+					if !reportDecodeError(ctrl, stop, errs, err) {
+						return
+					}
 					continue
+				} else if !sent {
+					return
 				}
+				progress.Out(1)
+				j.reportProgress()
 			}
 		}
 	}()
 	return done, errs
 }
 
+// decodeRecord decodes the next value into rec. If dead letters are being kept, the value is
+// read before it is unmarshalled so that it can be returned
+func (j *JSONParser) decodeRecord(decoder *json.Decoder, rec interface{}) (json.RawMessage, error) {
+	if j.Opts.DeadLetters == nil {
+		return nil, decoder.Decode(rec)
+	}
+
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return raw, err
+	}
+	return raw, json.Unmarshal(raw, rec)
+}
+
 func (j *JSONParser) navigateToSelection(decoder *json.Decoder) error {
 	nestIn := strings.Split(j.Opts.Selection, ".")
 	for len(nestIn) > 0 {
@@ -0,0 +1,147 @@
+package parse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/urbint/ingest"
+)
+
+// readCloserType is the type of record accepted by the parsers
+var readCloserType = reflect.TypeOf((*io.ReadCloser)(nil)).Elem()
+
+// abortController builds a Controller that quits when the specified abort channel is closed.
+//
+// It allows the Decode methods, which accept an abort channel, to share their implementation
+// with the workers started by a parser, which are run under a Controller
+func abortController(abort chan struct{}) *ingest.Controller {
+	ctrl := ingest.NewController()
+	ctrl.Quit = abort
+	return ctrl
+}
+
+// readClosers relays the records of a Pipeline to a channel of io.ReadClosers so that they
+// can be read by a parser. Records which are not io.ReadClosers are reported to the controller
+func readClosers(ctrl *ingest.Controller, task string, in <-chan interface{}) <-chan io.ReadCloser {
+	out := make(chan io.ReadCloser)
+
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+		defer close(out)
+		for rec := range in {
+			reader, isReader := rec.(io.ReadCloser)
+			if !isReader {
+				ctrl.ReportError(task, 0, fmt.Errorf("Expected an io.ReadCloser, received %T", rec))
+				continue
+			}
+			select {
+			case <-ctrl.Quit:
+				reader.Close()
+				return
+			case out <- reader:
+			}
+		}
+	}()
+
+	return out
+}
+
+// send writes rec to output if one is set, or to out otherwise, returning false if the controller
+// quit first. An error is returned if rec can not be written to output
+func send(ctrl *ingest.Controller, out chan interface{}, output ingest.Output, rec interface{}) (bool, error) {
+	if output == nil {
+		output = ingest.OutputOf(out)
+	}
+	return output.Send(ctrl.Quit, rec)
+}
+
+// reportDecodeError hands an error encountered by a decode to the worker reading errs, returning
+// false if the worker stopped the decode or the controller quit before it was read
+func reportDecodeError(ctrl *ingest.Controller, stop <-chan struct{}, errs chan<- error, err error) bool {
+	select {
+	case errs <- err:
+		return true
+	case <-stop:
+		return false
+	case <-ctrl.Quit:
+		return false
+	}
+}
+
+// closedChannel returns a channel which is already closed, returned by parsers which write their
+// records to an Output
+func closedChannel() chan interface{} {
+	closed := make(chan interface{})
+	close(closed)
+	return closed
+}
+
+// readerLog adds the name of the file being read to log, if the reader is a file
+func readerLog(log ingest.Logger, reader io.Reader) ingest.Logger {
+	if name := readerName(reader); name != "" {
+		return log.WithField("file", name)
+	}
+	return log
+}
+
+// readerName returns the name of the file being read, or "" if the reader is not a file
+func readerName(reader io.Reader) string {
+	if named, isNamed := reader.(interface{ Name() string }); isNamed {
+		return named.Name()
+	}
+	return ""
+}
+
+// checkpointer returns the Checkpointer used to resume reading the reader, along with the name it
+// is checkpointed under. The Checkpointer is nil if checkpointing is not enabled, or the reader is
+// not named, as files and the entries of zip archives are
+func checkpointer(ctrl *ingest.Controller, reader io.Reader) (*ingest.Checkpointer, string) {
+	source := readerName(reader)
+	if source == "" {
+		return nil, ""
+	}
+	return ctrl.Checkpointer(), source
+}
+
+// finishCheckpoint records that every record of the source has been read, logging any error
+// encountered while saving the checkpoint
+func finishCheckpoint(checkpoints *ingest.Checkpointer, log ingest.Logger, stage string, source string) {
+	if err := checkpoints.Finished(stage, source); err != nil {
+		log.WithError(err).WithField("file", source).Warn("Error saving checkpoint")
+	}
+}
+
+// sendDeadLetter sends the record to the sink, if one is configured, logging any error
+// encountered while sending it. Nothing is sent during a dry run, which must not write anything
+func sendDeadLetter(sampler *ingest.Sampler, sink ingest.DeadLetterSink, log ingest.Logger, letter ingest.DeadLetter) {
+	if sink == nil || sampler != nil {
+		return
+	}
+	if err := sink.Send(letter); err != nil {
+		log.WithError(err).Error("Error sending dead letter")
+	}
+}
+
+// sampleError reports a record which failed to parse to the Sampler of a dry run, along with
+// the column that caused it, if it is known
+func sampleError(sampler *ingest.Sampler, err error) {
+	column := ""
+	switch err := err.(type) {
+	case *CSVDecodeError:
+		column = err.Column
+	case *json.UnmarshalTypeError:
+		column = err.Field
+	}
+	sampler.ParseError(column, err)
+}
+
+// recordType returns the type of record allocated by newRec, or nil if it has not been configured
+func recordType(newRec func() interface{}) reflect.Type {
+	if newRec == nil {
+		return nil
+	}
+	return reflect.TypeOf(newRec())
+}
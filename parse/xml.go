@@ -1,11 +1,13 @@
 package parse
 
 import (
+	"bytes"
 	"encoding/xml"
 	"github.com/mcuadros/go-defaults"
 	"github.com/urbint/ingest"
 	"io"
 	"reflect"
+	"time"
 )
 
 // A XMLParser handles parsing XML
@@ -17,6 +19,7 @@ type XMLParser struct {
 	Out chan interface{}
 
 	newRec   func() interface{}
+	output   ingest.Output
 	depGroup *ingest.DependencyGroup
 }
 
@@ -28,6 +31,7 @@ type XMLParseOpts struct {
 	Progress     chan struct{}
 	Strict       bool `default:"true"`
 	Entities     map[string]string
+	DeadLetters  ingest.DeadLetterSink
 }
 
 // NewXMLParser builds a XMLParser. You will usually want to use parse.XML instead
@@ -87,12 +91,21 @@ func (x *XMLParser) AbortOnError(abort bool) *XMLParser {
 }
 
 // ReportProgressTo is a chainable configuration method that sets where
-// progress will be reported to
+// progress will be reported to.
+//
+// A goroutine is started for each event, so ingest.Controller.ReportProgressEvery is preferred
 func (x *XMLParser) ReportProgressTo(dest chan struct{}) *XMLParser {
 	x.Opts.Progress = dest
 	return x
 }
 
+// DeadLetterTo is a chainable configuration method that sets where elements which fail
+// to unmarshal are sent, along with the file and offset they were read from
+func (x *XMLParser) DeadLetterTo(sink ingest.DeadLetterSink) *XMLParser {
+	x.Opts.DeadLetters = sink
+	return x
+}
+
 // DependOn is a chainable configuration method that will not proceed until all
 // specified controllers have resolved
 func (x *XMLParser) DependOn(ctrls ...*ingest.Controller) *XMLParser {
@@ -107,6 +120,13 @@ func (x *XMLParser) WriteTo(out chan interface{}) *XMLParser {
 	return x
 }
 
+// SendTo sets an Output the parser writes records to instead of Out, such as a channel of
+// another type adapted with ingest.OutputOf. The Output is closed once the parser finishes
+func (x *XMLParser) SendTo(out ingest.Output) *XMLParser {
+	x.output = out
+	return x
+}
+
 // Struct sets the type that will be used to allocate new records
 func (x *XMLParser) Struct(rec interface{}) *XMLParser {
 	indirectType := reflect.Indirect(reflect.ValueOf(rec)).Type()
@@ -121,19 +141,41 @@ func (x *XMLParser) Collect(ctrl *ingest.Controller) ([]interface{}, error) {
 	return ingest.Stream(x.Start(ctrl)).Collect(ctrl)
 }
 
+// Transform reads from the specified input and starts the parser under the control of the
+// specified controller, allowing it to be used as a Transform in a Pipeline
+func (x *XMLParser) Transform(ctrl *ingest.Controller, in <-chan interface{}) <-chan interface{} {
+	x.In = readClosers(ctrl, "parse-xml", in)
+	return x.Start(ctrl)
+}
+
+// Accepts returns the type of record accepted by the parser
+func (x *XMLParser) Accepts() reflect.Type {
+	return readCloserType
+}
+
+// Produces returns the type of record produced by the parser, or nil if it has not been configured
+func (x *XMLParser) Produces() reflect.Type {
+	return recordType(x.newRec)
+}
+
 // Start starts running the parser under the control of the specified controller
 func (x *XMLParser) Start(ctrl *ingest.Controller) <-chan interface{} {
 	if x.newRec == nil {
 		panic("No known instantiating function. Configure the parser using .Struct")
 	}
 
-	childCtrl := ctrl.Child()
+	childCtrl := ctrl.ChildNamed("parse-xml")
 	defer childCtrl.ChildBuilt()
 
 	x.depGroup.Wait()
 
 	// If we don't have an output channel, make one and close it after we read all the records
-	if x.Out == nil {
+	if x.output != nil {
+		go func() {
+			childCtrl.Wait()
+			x.output.Close()
+		}()
+	} else if x.Out == nil {
 		x.Out = make(chan interface{})
 		go func() {
 			childCtrl.Wait()
@@ -142,38 +184,56 @@ func (x *XMLParser) Start(ctrl *ingest.Controller) <-chan interface{} {
 	}
 
 	for i := 0; i < x.Opts.NumWorkers; i++ {
-		x.startDecodeWorker(childCtrl)
+		x.startDecodeWorker(childCtrl, i)
 	}
 
+	if x.output != nil {
+		return closedChannel()
+	}
 	return x.Out
 }
 
-func (x *XMLParser) startDecodeWorker(ctrl *ingest.Controller) {
+func (x *XMLParser) startDecodeWorker(ctrl *ingest.Controller, id int) {
+	workerLog := x.Log.WithField("worker", id)
 	ctrl.WorkerStart()
-	x.Log.Debug("Starting worker")
+	workerLog.Debug("Starting worker")
 	go func() {
 		defer ctrl.WorkerEnd()
-		defer x.Log.Debug("Exiting worker")
+		defer workerLog.Debug("Exiting worker")
 	WorkerAvailable:
 		for {
+			// Stop taking new readers once the controller begins draining
+			if ctrl.IsDraining() {
+				return
+			}
 			select {
-			case <-ctrl.Quit:
+			case <-ctrl.Draining():
 				return
 			case reader, ok := <-x.In:
 				if !ok {
 					return
 				}
-				done, errs := x.Decode(reader, ctrl.Quit)
+				fileLog := readerLog(workerLog, reader)
+				// The decode is stopped and waited for before the worker exits, as the output is closed
+				// once every worker has
+				stop := make(chan struct{})
+				done, errs := x.decode(reader, ctrl, stop)
 				for {
 					select {
 					case <-done:
 						continue WorkerAvailable
 					case err := <-errs:
 						if x.Opts.AbortOnError {
-							ctrl.Err <- err
+							ctrl.ReportError("parse-xml", id, err)
+							close(stop)
+							<-done
 							return
 						}
-						x.Log.WithError(err).Warn("Error unmarshalling XML record")
+						log := fileLog.WithError(err)
+						if syntaxErr, isSyntaxErr := err.(*xml.SyntaxError); isSyntaxErr {
+							log = log.WithField("line", syntaxErr.Line)
+						}
+						log.Warn("Error unmarshalling XML record")
 					}
 				}
 			}
@@ -183,6 +243,12 @@ func (x *XMLParser) startDecodeWorker(ctrl *ingest.Controller) {
 
 // Decode reads an io.Reader into the output channel. It will report errors on the specified error channel.
 func (x *XMLParser) Decode(reader io.Reader, abort chan struct{}) (done chan struct{}, errs chan error) {
+	return x.decode(reader, abortController(abort), nil)
+}
+
+// decode reads an io.Reader into the output channel until it has finished, the controller quits,
+// the controller begins draining, or stop is closed
+func (x *XMLParser) decode(reader io.Reader, ctrl *ingest.Controller, stop <-chan struct{}) (done chan struct{}, errs chan error) {
 	done = make(chan struct{})
 	errs = make(chan error)
 	if x.Opts.Selection == "" {
@@ -191,20 +257,52 @@ func (x *XMLParser) Decode(reader io.Reader, abort chan struct{}) (done chan str
 	go func() {
 		defer func() { close(done) }()
 
-		decoder := xml.NewDecoder(reader)
+		progress := ctrl.Stage("parse-xml")
+		decoder := xml.NewDecoder(progress.Reader(reader))
 		decoder.Strict = x.Opts.Strict
 		decoder.Entity = x.Opts.Entities
 
+		// Skip the elements which were written by a previous run
+		checkpoints, source := checkpointer(ctrl, reader)
+		resumed := checkpoints.Resume("parse-xml", source)
+		if resumed.Done {
+			return
+		}
+		offset := int64(0)
+		for offset < resumed.Offset {
+			token, err := decoder.Token()
+			if err != nil {
+				return
+			}
+			if se, ok := token.(xml.StartElement); ok && se.Name.Local == x.Opts.Selection {
+				if err := decoder.Skip(); err != nil {
+					return
+				}
+				offset++
+			}
+		}
+
+		// Dry runs only read the first elements of each file
+		sampler := ctrl.Sampler()
+
 		for {
 			select {
-			case <-abort:
+			case <-ctrl.Quit:
+				return
+			case <-stop:
 				return
 			default:
+				if !ctrl.AwaitResume() || sampler.Reached(offset-resumed.Offset) {
+					return
+				}
 				token, err := decoder.Token()
 				if err == io.EOF {
+					finishCheckpoint(checkpoints, x.Log, "parse-xml", source)
 					return
 				} else if err != nil {
-					errs <- err
+					if !reportDecodeError(ctrl, stop, errs, err) {
+						return
+					}
 					continue
 				}
 				rec := x.newRec()
@@ -212,22 +310,42 @@ func (x *XMLParser) Decode(reader io.Reader, abort chan struct{}) (done chan str
 				if se, ok := token.(xml.StartElement); ok {
 					if se.Name.Local == x.Opts.Selection {
 						found = true
-						if err := decoder.DecodeElement(rec, &se); err != nil {
-							errs <- err
-							if x.Opts.AbortOnError {
+						progress.In(1)
+						started := time.Now()
+						raw, err := x.decodeElement(decoder, rec, &se)
+						progress.Observe(time.Since(started))
+						if err != nil {
+							progress.Failed(1)
+							sampleError(sampler, err)
+							sendDeadLetter(sampler, x.Opts.DeadLetters, x.Log, ingest.DeadLetter{
+								Stage:  "parse-xml",
+								Source: readerName(reader),
+								Offset: offset,
+								Raw:    raw,
+								Err:    err,
+							})
+							if !reportDecodeError(ctrl, stop, errs, err) || x.Opts.AbortOnError {
 								return
 							}
+							offset++
+							continue
 						}
 					}
 				}
 				if found {
-					select {
-					case <-abort:
-						return
-					case x.Out <- rec:
-						x.reportProgress()
+					checkpoints.Track(rec, "parse-xml", source, offset)
+					offset++
+					sent, err := send(ctrl, x.Out, x.output, rec)
+					if err != nil {
+						if !reportDecodeError(ctrl, stop, errs, err) {
+							return
+						}
 						continue
+					} else if !sent {
+						return
 					}
+					progress.Out(1)
+					x.reportProgress()
 				}
 			}
 		}
@@ -235,6 +353,35 @@ func (x *XMLParser) Decode(reader io.Reader, abort chan struct{}) (done chan str
 	return done, errs
 }
 
+// rawXMLElement holds an element exactly as it was read
+type rawXMLElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// decodeElement decodes the element into rec. If dead letters are being kept, the element is
+// read before it is unmarshalled so that it can be returned
+func (x *XMLParser) decodeElement(decoder *xml.Decoder, rec interface{}, start *xml.StartElement) ([]byte, error) {
+	if x.Opts.DeadLetters == nil {
+		return nil, decoder.DecodeElement(rec, start)
+	}
+
+	element := rawXMLElement{}
+	if err := decoder.DecodeElement(&element, start); err != nil {
+		return element.Inner, err
+	}
+	raw, err := xml.Marshal(element)
+	if err != nil {
+		return element.Inner, err
+	}
+
+	elementDecoder := xml.NewDecoder(bytes.NewReader(raw))
+	elementDecoder.Strict = x.Opts.Strict
+	elementDecoder.Entity = x.Opts.Entities
+	return raw, elementDecoder.Decode(rec)
+}
+
 func (x *XMLParser) reportProgress() {
 	if x.Opts.Progress != nil {
 		go func() {
@@ -0,0 +1,363 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Source is a stage that produces the records which flow through a Pipeline
+type Source interface {
+	// Produce starts the stage under the control of the specified controller and returns the
+	// channel records will be written to. The channel must be closed when the stage finishes
+	Produce(ctrl *Controller) <-chan interface{}
+}
+
+// A Transform is a stage that consumes the records produced by the previous stage of a Pipeline
+// and produces records for the next one
+type Transform interface {
+	// Transform starts the stage under the control of the specified controller, reading from in,
+	// and returns the channel records will be written to. The channel must be closed when the
+	// stage finishes
+	Transform(ctrl *Controller, in <-chan interface{}) <-chan interface{}
+}
+
+// A Sink is a stage that consumes the records at the end of a Pipeline
+type Sink interface {
+	// Consume reads records from in until it is closed or the controller quits. Errors should
+	// be reported to the controller
+	Consume(ctrl *Controller, in <-chan interface{})
+}
+
+// An Acknowledger is a Sink that acknowledges the records it has durably written with the
+// Checkpointer of its Controller, so a run can resume after them.
+//
+// When a Pipeline is run with a Checkpointer, records are released before they reach a Sink
+// which does not acknowledge them, as they would otherwise be tracked until the run finishes
+type Acknowledger interface {
+	// Acknowledges reports whether the Sink acknowledges the records it writes
+	Acknowledges() bool
+}
+
+// A Producer is a stage that declares the type of the records it produces.
+//
+// It is used by Pipeline to validate stages before running them
+type Producer interface {
+	Produces() reflect.Type
+}
+
+// An Acceptor is a stage that declares the type of the records it accepts.
+//
+// It is used by Pipeline to validate stages before running them
+type Acceptor interface {
+	Accepts() reflect.Type
+}
+
+// SourceFunc is an adapter to allow the use of a function as a Source
+type SourceFunc func(ctrl *Controller) <-chan interface{}
+
+// Produce calls fn(ctrl)
+func (fn SourceFunc) Produce(ctrl *Controller) <-chan interface{} {
+	return fn(ctrl)
+}
+
+// TransformFunc is an adapter to allow the use of a function as a Transform
+type TransformFunc func(ctrl *Controller, in <-chan interface{}) <-chan interface{}
+
+// Transform calls fn(ctrl, in)
+func (fn TransformFunc) Transform(ctrl *Controller, in <-chan interface{}) <-chan interface{} {
+	return fn(ctrl, in)
+}
+
+// SinkFunc is an adapter to allow the use of a function as a Sink
+type SinkFunc func(ctrl *Controller, in <-chan interface{})
+
+// Consume calls fn(ctrl, in)
+func (fn SinkFunc) Consume(ctrl *Controller, in <-chan interface{}) {
+	fn(ctrl, in)
+}
+
+// AckSinkFunc is an adapter to allow the use of a function which acknowledges the records it
+// writes with the Controller's Checkpointer as a Sink
+type AckSinkFunc func(ctrl *Controller, in <-chan interface{})
+
+// Consume calls fn(ctrl, in)
+func (fn AckSinkFunc) Consume(ctrl *Controller, in <-chan interface{}) {
+	fn(ctrl, in)
+}
+
+// Acknowledges returns true, as the function acknowledges the records it writes
+func (fn AckSinkFunc) Acknowledges() bool {
+	return true
+}
+
+// ErrNoSource is returned when a Pipeline is run without a Source
+var ErrNoSource = errors.New("Pipeline has no source")
+
+// ErrNoSink is returned when a Pipeline is run without a Sink
+var ErrNoSink = errors.New("Pipeline has no sink")
+
+// A Pipeline composes a Source, any number of Transforms, and a Sink and runs them
+// under a single Controller
+type Pipeline struct {
+	Log Logger
+
+	source     Source
+	transforms []Transform
+	sink       Sink
+}
+
+// PipelineResult is the result of running a Pipeline
+type PipelineResult struct {
+	// Stages contains the results of each stage, in the order they were run
+	Stages []StageResult
+	// Records is the number of records that reached the Sink
+	Records int64
+	// Duration is how long the Pipeline ran for
+	Duration time.Duration
+	// State is the state of the Controller once the Pipeline finished
+	State State
+	// Err is the error returned by the Controller, or the reason the Pipeline could not be run
+	Err error
+}
+
+// StageResult is the result of a single stage of a Pipeline
+type StageResult struct {
+	// Name is the name of the stage
+	Name string
+	// Records is the number of records the stage produced
+	Records int64
+}
+
+// NewPipeline builds a new, empty Pipeline
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		Log: DefaultLogger.WithField("task", "pipeline"),
+	}
+}
+
+// From is a chainable configuration method that sets the Source of the Pipeline
+func (p *Pipeline) From(source Source) *Pipeline {
+	p.source = source
+	return p
+}
+
+// Through is a chainable configuration method that adds Transforms to the Pipeline.
+//
+// Through can be called multiple times, in which case records will flow through the
+// transforms in the order that they were added
+func (p *Pipeline) Through(transforms ...Transform) *Pipeline {
+	p.transforms = append(p.transforms, transforms...)
+	return p
+}
+
+// To is a chainable configuration method that sets the Sink of the Pipeline
+func (p *Pipeline) To(sink Sink) *Pipeline {
+	p.sink = sink
+	return p
+}
+
+// Validate verifies that the Pipeline has a source and sink, that none of its stages are nil,
+// and that the records produced by each stage are accepted by the next one, when the
+// stages declare their types
+func (p *Pipeline) Validate() error {
+	if p.source == nil {
+		return ErrNoSource
+	}
+	if p.sink == nil {
+		return ErrNoSink
+	}
+
+	stages := p.stages()
+	for i, stage := range stages {
+		if isNilStage(stage) {
+			return fmt.Errorf("Pipeline stage %d is nil", i)
+		}
+	}
+
+	for i := 1; i < len(stages); i++ {
+		producer, isProducer := stages[i-1].(Producer)
+		acceptor, isAcceptor := stages[i].(Acceptor)
+		if !isProducer || !isAcceptor {
+			continue
+		}
+
+		produces, accepts := producer.Produces(), acceptor.Accepts()
+		if produces == nil || accepts == nil {
+			continue
+		}
+		if !produces.AssignableTo(accepts) {
+			return fmt.Errorf("Pipeline stage %s produces %s, which is not accepted by %s (expects %s)",
+				stageName(stages[i-1]), produces, stageName(stages[i]), accepts)
+		}
+	}
+
+	return nil
+}
+
+// Run validates the Pipeline and runs all of its stages under the control of the specified
+// controller, waiting for them to finish. If the controller has a Checkpointer, the Sink should
+// be an Acknowledger, or the progress of the run will not be checkpointed.
+//
+// Errors reported by the stages are returned in the result as they would be by ctrl.Error
+func (p *Pipeline) Run(ctrl *Controller) *PipelineResult {
+	result := &PipelineResult{}
+	start := time.Now()
+
+	if err := p.Validate(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	stages := p.stages()
+	result.Stages = make([]StageResult, len(stages)-1)
+	for i := range result.Stages {
+		result.Stages[i].Name = stageName(stages[i])
+	}
+
+	p.Log.Debug("Starting pipeline")
+
+	// Records are released before a sink which won't acknowledge them, so they aren't tracked forever
+	var release *Checkpointer
+	if checkpoints := ctrl.Checkpointer(); checkpoints != nil && !acknowledges(p.sink) {
+		p.Log.WithField("sink", stageName(p.sink)).Warn("Sink does not acknowledge records, so progress will not be checkpointed")
+		release = checkpoints
+	}
+
+	last := len(p.transforms)
+	records := p.count(ctrl, p.source.Produce(ctrl), &result.Stages[0].Records, releaseIf(last == 0, release))
+	for i, transform := range p.transforms {
+		records = p.count(ctrl, transform.Transform(ctrl, records), &result.Stages[i+1].Records, releaseIf(i+1 == last, release))
+	}
+
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+		p.sink.Consume(ctrl, records)
+	}()
+
+	result.Err = ctrl.Error()
+	ctrl.Wait()
+
+	result.Records = result.Stages[len(result.Stages)-1].Records
+	result.Duration = time.Since(start)
+	result.State = ctrl.State()
+
+	p.Log.WithField("records", result.Records).WithField("duration", result.Duration).Debug("Pipeline finished")
+
+	return result
+}
+
+// DryRunResult is the result of a dry run of a Pipeline
+type DryRunResult struct {
+	*PipelineResult
+	// Sample contains the first DefaultSampleKeep records which would have been written to the
+	// Sink, in the order they arrived
+	Sample []interface{}
+	// Report describes the fields of the sampled records, and the records which failed to parse
+	Report *SampleReport
+}
+
+// DryRun runs the Pipeline as Run does, except that the records are recorded instead of being
+// written to the Sink, and the parsers stop reading each file after limit records. If limit
+// is 0 every record is read.
+//
+// The Pipeline does not need a Sink to be dry run
+func (p *Pipeline) DryRun(ctrl *Controller, limit int) *DryRunResult {
+	sampler := NewSampler(limit)
+	ctrl.WithSampler(sampler)
+
+	dryRun := *p
+	dryRun.sink = sampleSink{sampler}
+
+	p.Log.WithField("limit", limit).Debug("Starting dry run")
+	result := dryRun.Run(ctrl)
+
+	return &DryRunResult{
+		PipelineResult: result,
+		Sample:         sampler.Records(),
+		Report:         sampler.Report(),
+	}
+}
+
+// stages returns all of the stages of the Pipeline in order
+func (p *Pipeline) stages() []interface{} {
+	stages := []interface{}{p.source}
+	for _, transform := range p.transforms {
+		stages = append(stages, transform)
+	}
+	return append(stages, p.sink)
+}
+
+// count relays records from in to the returned channel, counting them as they pass. Records are
+// released from the checkpoints as they pass, if it is not nil
+func (p *Pipeline) count(ctrl *Controller, in <-chan interface{}, counter *int64, checkpoints *Checkpointer) <-chan interface{} {
+	out := make(chan interface{})
+
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+		defer close(out)
+		for rec := range in {
+			select {
+			case <-ctrl.Quit:
+				return
+			case out <- rec:
+				atomic.AddInt64(counter, 1)
+				checkpoints.Release(rec)
+			}
+		}
+	}()
+
+	return out
+}
+
+// acknowledges reports whether the Sink acknowledges the records it writes
+func acknowledges(sink Sink) bool {
+	acknowledger, isAcknowledger := sink.(Acknowledger)
+	return isAcknowledger && acknowledger.Acknowledges()
+}
+
+// releaseIf returns checkpoints if release is true, and nil otherwise
+func releaseIf(release bool, checkpoints *Checkpointer) *Checkpointer {
+	if release {
+		return checkpoints
+	}
+	return nil
+}
+
+// isNilStage reports whether the stage is nil, or a typed nil value
+func isNilStage(stage interface{}) bool {
+	if stage == nil {
+		return true
+	}
+	value := reflect.ValueOf(stage)
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Func, reflect.Map, reflect.Chan, reflect.Interface, reflect.Slice:
+		return value.IsNil()
+	}
+	return false
+}
+
+// stageName builds a readable name for a stage from its type
+func stageName(stage interface{}) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", stage), "*")
+}
+
+// sampleSink is the Sink a Pipeline is dry run with, which records every record with a Sampler
+type sampleSink struct {
+	sampler *Sampler
+}
+
+// Consume records the records read from in until it is closed
+func (s sampleSink) Consume(ctrl *Controller, in <-chan interface{}) {
+	progress := ctrl.Stage("dry-run")
+	for rec := range in {
+		progress.In(1)
+		s.sampler.Record(rec)
+		progress.Out(1)
+	}
+}
@@ -0,0 +1,88 @@
+package ingest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// typedSink is a Sink which declares the type of records it accepts
+type typedSink struct {
+	SinkFunc
+	accepts reflect.Type
+}
+
+func (t *typedSink) Accepts() reflect.Type {
+	return t.accepts
+}
+
+// typedSource is a Source which declares the type of records it produces
+type typedSource struct {
+	*Streamer
+	produces reflect.Type
+}
+
+func (t *typedSource) Produces() reflect.Type {
+	return t.produces
+}
+
+func TestPipeline(t *testing.T) {
+	Convey("Pipeline", t, func() {
+		received := []interface{}{}
+		sink := SinkFunc(func(ctrl *Controller, in <-chan interface{}) {
+			for rec := range in {
+				received = append(received, rec)
+			}
+		})
+
+		Convey("runs records from the source, through transforms, to the sink", func() {
+			rejectThree := Stream(nil).ForEach(func(rec interface{}) error {
+				if rec.(int) == 3 {
+					return errors.New("three")
+				}
+				return nil
+			})
+
+			result := NewPipeline().
+				From(StreamArray([]int{1, 2, 3, 4})).
+				Through(rejectThree).
+				To(sink).
+				Run(NewController().CollectErrors(NeverFail))
+
+			So(received, ShouldResemble, []interface{}{1, 2, 4})
+			So(result.Records, ShouldEqual, 3)
+			So(result.Stages, ShouldHaveLength, 2)
+			So(result.Stages[0].Records, ShouldEqual, 4)
+			So(result.Stages[1].Records, ShouldEqual, 3)
+			So(result.Err, ShouldHaveSameTypeAs, MultiError{})
+			So(result.State, ShouldEqual, StateFinished)
+		})
+
+		Convey("validates", func() {
+			Convey("that there is a source and sink", func() {
+				So(NewPipeline().To(sink).Validate(), ShouldEqual, ErrNoSource)
+				So(NewPipeline().From(StreamArray([]int{})).Validate(), ShouldEqual, ErrNoSink)
+			})
+
+			Convey("that there are no nil stages", func() {
+				var transform *Streamer
+				p := NewPipeline().From(StreamArray([]int{})).Through(transform).To(sink)
+				So(p.Validate(), ShouldNotBeNil)
+			})
+
+			Convey("that the type of records produced is accepted by the next stage", func() {
+				source := &typedSource{StreamArray([]int{}), reflect.TypeOf(0)}
+				strings := &typedSink{sink, reflect.TypeOf("")}
+				ints := &typedSink{sink, reflect.TypeOf(0)}
+
+				So(NewPipeline().From(source).To(strings).Validate(), ShouldNotBeNil)
+				So(NewPipeline().From(source).To(ints).Validate(), ShouldBeNil)
+
+				result := NewPipeline().From(source).To(strings).Run(NewController())
+				So(result.Err, ShouldNotBeNil)
+			})
+		})
+	})
+}
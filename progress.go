@@ -0,0 +1,237 @@
+package ingest
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a snapshot of the progress of a single stage of a pipeline
+type Progress struct {
+	// Stage is the name of the stage, which is generally the name of its task
+	Stage string
+	// RecordsIn is the number of records (or files) the stage has read
+	RecordsIn int64
+	// RecordsOut is the number of records (or files) the stage has written
+	RecordsOut int64
+	// RecordsFailed is the number of records (or files) the stage failed to process
+	RecordsFailed int64
+	// Retries is the number of operations the stage retried after they failed
+	Retries int64
+	// Bytes is the number of bytes the stage has read
+	Bytes int64
+	// TotalBytes is the number of bytes the stage expects to read, or 0 if it is not known
+	TotalBytes int64
+	// Elapsed is how long it has been since the stage started
+	Elapsed time.Duration
+	// Throughput is the number of records written per second
+	Throughput float64
+	// ByteRate is the number of bytes read per second
+	ByteRate float64
+	// ETA is the estimated time until the stage has read TotalBytes, or 0 if it is not known
+	ETA time.Duration
+}
+
+// StageProgress counts the progress of a stage. It is safe for concurrent use, and all of its
+// methods are no-ops on a nil StageProgress.
+//
+// Stages get their StageProgress from Controller.Stage
+type StageProgress struct {
+	name    string
+	started time.Time
+
+	in      int64
+	out     int64
+	failed  int64
+	retries int64
+	bytes   int64
+	total   int64
+
+	metrics stageMetrics
+}
+
+// In records that the stage read n records
+func (p *StageProgress) In(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.in, int64(n))
+		p.metrics.in.Add(float64(n))
+	}
+}
+
+// Out records that the stage wrote n records
+func (p *StageProgress) Out(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.out, int64(n))
+		p.metrics.out.Add(float64(n))
+	}
+}
+
+// Failed records that the stage failed to process n records
+func (p *StageProgress) Failed(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.failed, int64(n))
+		p.metrics.failed.Add(float64(n))
+	}
+}
+
+// Retried records that the stage retried n operations which failed, such as downloads or bulk requests
+func (p *StageProgress) Retried(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.retries, int64(n))
+		p.metrics.retries.Add(float64(n))
+	}
+}
+
+// Bytes records that the stage read n bytes
+func (p *StageProgress) Bytes(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.bytes, n)
+		p.metrics.bytes.Add(float64(n))
+	}
+}
+
+// TotalBytes records that the stage expects to read n more bytes, such as when it opens a file
+// of a known size
+func (p *StageProgress) TotalBytes(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.total, n)
+	}
+}
+
+// Snapshot returns the current Progress of the stage
+func (p *StageProgress) Snapshot() Progress {
+	if p == nil {
+		return Progress{}
+	}
+
+	progress := Progress{
+		Stage:         p.name,
+		RecordsIn:     atomic.LoadInt64(&p.in),
+		RecordsOut:    atomic.LoadInt64(&p.out),
+		RecordsFailed: atomic.LoadInt64(&p.failed),
+		Retries:       atomic.LoadInt64(&p.retries),
+		Bytes:         atomic.LoadInt64(&p.bytes),
+		TotalBytes:    atomic.LoadInt64(&p.total),
+		Elapsed:       time.Since(p.started),
+	}
+
+	if seconds := progress.Elapsed.Seconds(); seconds > 0 {
+		progress.Throughput = float64(progress.RecordsOut) / seconds
+		progress.ByteRate = float64(progress.Bytes) / seconds
+	}
+	if remaining := progress.TotalBytes - progress.Bytes; progress.TotalBytes > 0 && remaining > 0 && progress.ByteRate > 0 {
+		progress.ETA = time.Duration(float64(remaining) / progress.ByteRate * float64(time.Second))
+	}
+
+	return progress
+}
+
+// Stage returns the StageProgress used to count the progress of the named stage. The counters
+// are kept by the root Controller, so every stage with the same name shares them.
+//
+// The counts are also reported into the Controller's metrics registry
+func (c *Controller) Stage(name string) *StageProgress {
+	registry := c.Metrics()
+
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	for _, stage := range root.stages {
+		if stage.name == name {
+			return stage
+		}
+	}
+	stage := &StageProgress{name: name, started: time.Now(), metrics: newStageMetrics(registry, name)}
+	root.stages = append(root.stages, stage)
+	return stage
+}
+
+// Progress returns the current Progress of every stage run under the Controller, in the order
+// the stages started
+func (c *Controller) Progress() []Progress {
+	root := c.root()
+	root.mu.Lock()
+	stages := append([]*StageProgress{}, root.stages...)
+	root.mu.Unlock()
+
+	progress := make([]Progress, len(stages))
+	for i, stage := range stages {
+		progress[i] = stage.Snapshot()
+	}
+	return progress
+}
+
+// ReportProgressEvery is a chainable configuration method that will send the Progress of every stage
+// to dest at the specified interval, and once more when the Controller finishes. It should be called
+// once the stages have been started, as the Controller is finished as soon as it has no workers.
+//
+// If dest is not ready to receive when a sample is taken, the sample is dropped, so the final sample
+// is only delivered if dest has room for it. dest is not closed
+func (c *Controller) ReportProgressEvery(interval time.Duration, dest chan<- []Progress) *Controller {
+	done := c.Done()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				select {
+				case dest <- c.Progress():
+				default:
+				}
+				return
+			case <-ticker.C:
+				select {
+				case dest <- c.Progress():
+				default:
+				}
+			}
+		}
+	}()
+
+	return c
+}
+
+// Reader wraps r so that every byte read from it is counted by the stage. If the size of r is
+// known, because it is a file or an in-memory reader, it is added to the stage's TotalBytes
+func (p *StageProgress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	if size, known := readerSize(r); known {
+		p.TotalBytes(size)
+	}
+	return &progressReader{r, p}
+}
+
+// progressReader counts the bytes read from a reader
+type progressReader struct {
+	io.Reader
+	progress *StageProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.progress.Bytes(int64(n))
+	return n, err
+}
+
+// readerSize returns the number of bytes that can be read from r, if it is known
+func readerSize(r io.Reader) (int64, bool) {
+	switch sized := r.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := sized.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		return info.Size(), true
+	case interface{ Len() int }:
+		return int64(sized.Len()), true
+	case interface{ Size() int64 }:
+		return sized.Size(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,156 @@
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/urbint/ingest/metrics"
+)
+
+func TestProgress(t *testing.T) {
+	Convey("Progress", t, func() {
+		ctrl := NewController().CollectErrors(NeverFail)
+
+		Convey("counts the records of each stage", func() {
+			out := StreamArray([]int{1, 2, 3, 4}).Map(func(rec interface{}) (interface{}, error) {
+				if rec.(int) == 3 {
+					return nil, errors.New("three")
+				}
+				return rec, nil
+			}).Start(ctrl)
+
+			progress := make(chan []Progress, 1)
+			ctrl.ReportProgressEvery(time.Hour, progress)
+
+			for range out {
+			}
+
+			final := <-progress
+			So(final, ShouldHaveLength, 1)
+			So(final[0].Stage, ShouldEqual, "stream-array")
+			So(final[0].RecordsIn, ShouldEqual, 4)
+			So(final[0].RecordsOut, ShouldEqual, 3)
+			So(final[0].RecordsFailed, ShouldEqual, 1)
+		})
+
+		Convey("samples at the configured interval", func() {
+			input := make(chan interface{})
+			out := Stream(input).Named("slow").Start(ctrl)
+			go func() {
+				for range out {
+				}
+			}()
+
+			progress := make(chan []Progress)
+			ctrl.ReportProgressEvery(5*time.Millisecond, progress)
+
+			input <- 1
+			sample := <-progress
+			So(sample[0].Stage, ShouldEqual, "slow")
+
+			close(input)
+		})
+
+		Convey("estimates the time remaining from the size of readers", func() {
+			stage := ctrl.Stage("read")
+			reader := stage.Reader(strings.NewReader(strings.Repeat("x", 100)))
+			reader.Read(make([]byte, 10))
+			time.Sleep(10 * time.Millisecond)
+
+			snapshot := stage.Snapshot()
+			So(snapshot.Bytes, ShouldEqual, 10)
+			So(snapshot.TotalBytes, ShouldEqual, 100)
+			So(snapshot.ByteRate, ShouldBeGreaterThan, 0)
+			So(snapshot.ETA, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("reads the size of downloads from the response", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(strings.Repeat("x", 100)))
+			}))
+			defer server.Close()
+
+			dir, err := ioutil.TempDir("", "ingest-progress")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			for file := range Download(server.URL + "/file.txt").DownloadTo(dir).Start(ctrl) {
+				file.Close()
+			}
+
+			progress := ctrl.Progress()
+			So(progress, ShouldHaveLength, 1)
+			So(progress[0].Bytes, ShouldEqual, 100)
+			So(progress[0].TotalBytes, ShouldEqual, 100)
+		})
+
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Stages report into the Controller's metrics registry", t, func() {
+		registry := metrics.NewRegistry()
+		ctrl := NewController().WithMetrics(registry).CollectErrors(NeverFail)
+
+		out := StreamArray([]int{1, 2}).ForEach(func(rec interface{}) error {
+			if rec.(int) == 2 {
+				return errors.New("two")
+			}
+			return nil
+		}).Start(ctrl)
+		for range out {
+		}
+		ctrl.Wait()
+
+		text := &bytes.Buffer{}
+		So(registry.WriteText(text), ShouldBeNil)
+		So(text.String(), ShouldContainSubstring, `ingest_records_in_total{stage="stream-array"} 2`)
+		So(text.String(), ShouldContainSubstring, `ingest_records_out_total{stage="stream-array"} 1`)
+		So(text.String(), ShouldContainSubstring, `ingest_records_failed_total{stage="stream-array"} 1`)
+		So(text.String(), ShouldContainSubstring, `ingest_errors_total{task="stream-array"} 1`)
+		So(text.String(), ShouldContainSubstring, `ingest_record_duration_seconds_count{stage="stream-array"} 2`)
+	})
+}
+
+func TestRetryMetrics(t *testing.T) {
+	Convey("Downloads which are retried are counted", t, func() {
+		registry := metrics.NewRegistry()
+		ctrl := NewController().WithMetrics(registry)
+
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("contents"))
+		}))
+		defer server.Close()
+
+		dir, err := ioutil.TempDir("", "ingest-retry")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		files := 0
+		for file := range Download(server.URL+"/file.txt").DownloadTo(dir).Retry(2, time.Millisecond).Start(ctrl) {
+			file.Close()
+			files++
+		}
+
+		So(files, ShouldEqual, 1)
+		So(ctrl.Progress()[0].Retries, ShouldEqual, 1)
+
+		text := &bytes.Buffer{}
+		So(registry.WriteText(text), ShouldBeNil)
+		So(text.String(), ShouldContainSubstring, `ingest_retries_total{stage="download"} 1`)
+	})
+}
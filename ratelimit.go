@@ -0,0 +1,135 @@
+package ingest
+
+import (
+	"sync"
+	"time"
+)
+
+// A RateLimiter is a token bucket which limits how fast work proceeds. Tokens are added at a
+// fixed rate per second, up to the burst size.
+//
+// Callers may take more tokens than are available, in which case they wait until the debt has
+// been repaid. This allows a single call to take more tokens than the burst size.
+//
+// The rate can be changed with SetRate while callers are waiting. A nil RateLimiter, or one with
+// a rate of 0, does not limit at all
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	filled float64
+	last   time.Time
+	change chan struct{}
+}
+
+// NewRateLimiter builds a RateLimiter which allows perSecond tokens per second, with bursts of up to
+// burst tokens. A burst of less than 1 is treated as 1
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	r := &RateLimiter{
+		last:   time.Now(),
+		change: make(chan struct{}),
+	}
+	r.set(perSecond, burst)
+	r.tokens = float64(r.burst)
+	return r
+}
+
+// SetRate changes the rate and burst size of the RateLimiter, waking any callers which are waiting
+// so they use the new rate. It has no effect on a nil RateLimiter
+func (r *RateLimiter) SetRate(perSecond float64, burst int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill(time.Now())
+	r.set(perSecond, burst)
+	if r.tokens > float64(r.burst) {
+		r.tokens = float64(r.burst)
+	}
+
+	close(r.change)
+	r.change = make(chan struct{})
+}
+
+// Rate returns the current rate and burst size of the RateLimiter
+func (r *RateLimiter) Rate() (perSecond float64, burst int) {
+	if r == nil {
+		return 0, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate, r.burst
+}
+
+// Wait takes n tokens from the RateLimiter, waiting until they are available.
+//
+// It returns false if quit is closed before then
+func (r *RateLimiter) Wait(n int, quit <-chan struct{}) bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	r.refill(time.Now())
+	if r.rate <= 0 {
+		r.mu.Unlock()
+		return true
+	}
+	r.tokens -= float64(n)
+	// The tokens are ours once everything taken before us has been repaid
+	target := r.filled
+	if r.tokens < 0 {
+		target -= r.tokens
+	}
+
+	for {
+		if r.rate <= 0 || r.filled >= target {
+			r.mu.Unlock()
+			return true
+		}
+		wait := time.Duration((target - r.filled) / r.rate * float64(time.Second))
+		change := r.change
+		r.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-quit:
+			timer.Stop()
+			return false
+		case <-change:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		r.mu.Lock()
+		r.refill(time.Now())
+	}
+}
+
+// set sets the rate and burst size. It must be called with the lock held
+func (r *RateLimiter) set(perSecond float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	r.rate = perSecond
+	r.burst = burst
+}
+
+// refill adds the tokens accumulated since the last refill. It must be called with the lock held
+func (r *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(r.last)
+	r.last = now
+	if r.rate <= 0 || elapsed <= 0 {
+		return
+	}
+
+	added := elapsed.Seconds() * r.rate
+	r.filled += added
+	r.tokens += added
+	if r.tokens > float64(r.burst) {
+		r.tokens = float64(r.burst)
+	}
+}
@@ -0,0 +1,68 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimiter(t *testing.T) {
+	Convey("RateLimiter", t, func() {
+		Convey("allows a burst and then limits to the rate", func() {
+			limiter := NewRateLimiter(100, 5)
+			quit := make(chan struct{})
+
+			start := time.Now()
+			for i := 0; i < 15; i++ {
+				So(limiter.Wait(1, quit), ShouldBeTrue)
+			}
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 90*time.Millisecond)
+		})
+
+		Convey("allows taking more than the burst size", func() {
+			limiter := NewRateLimiter(1000, 1)
+			So(finishes(func() { limiter.Wait(50, nil) }, time.Second), ShouldBeTrue)
+		})
+
+		Convey("stops waiting when quit is closed", func() {
+			limiter := NewRateLimiter(0.001, 1)
+			limiter.Wait(1, nil)
+
+			quit := make(chan struct{})
+			close(quit)
+			So(limiter.Wait(1, quit), ShouldBeFalse)
+		})
+
+		Convey("wakes waiters when the rate changes", func() {
+			limiter := NewRateLimiter(0.001, 1)
+			limiter.Wait(1, nil)
+
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				limiter.SetRate(0, 1)
+			}()
+			So(finishes(func() { limiter.Wait(1, nil) }, time.Second), ShouldBeTrue)
+		})
+
+		Convey("a nil RateLimiter does not limit", func() {
+			var limiter *RateLimiter
+			So(limiter.Wait(1000, nil), ShouldBeTrue)
+
+			limiter.SetRate(10, 1)
+			perSecond, burst := limiter.Rate()
+			So(perSecond, ShouldEqual, 0)
+			So(burst, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Streamer.RateLimit limits how fast records are written", t, func() {
+		ctrl := NewController()
+		start := time.Now()
+		results, err := StreamArray(make([]int, 10)).RateLimit(200, 1).Collect(ctrl)
+
+		So(err, ShouldBeNil)
+		So(results, ShouldHaveLength, 10)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 40*time.Millisecond)
+	})
+}
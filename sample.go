@@ -0,0 +1,383 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultSampleKeep is the number of records a Sampler keeps by default
+var DefaultSampleKeep = 100
+
+// SampleDateFormats are the layouts a string must match to be inferred as a date by a Sampler
+var SampleDateFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02", "01/02/2006"}
+
+// The types a Sampler infers for the values of a field
+const (
+	SampleTypeString  = "string"
+	SampleTypeInteger = "integer"
+	SampleTypeFloat   = "float"
+	SampleTypeBoolean = "boolean"
+	SampleTypeDate    = "date"
+	SampleTypeObject  = "object"
+	SampleTypeArray   = "array"
+	SampleTypeMixed   = "mixed"
+)
+
+// A Sampler profiles the fields of the records that reach the sink of a dry run as they stream
+// past, keeping only the first of them as a sample.
+//
+// Stages find the Sampler with Controller.Sampler. Parsers stop reading each file once they have
+// read Limit records from it, and report the records they fail to parse with ParseError. All of
+// its methods are safe for concurrent use, and are no-ops on a nil Sampler
+type Sampler struct {
+	// Limit is the maximum number of records read from each file, or 0 to read every record
+	Limit int
+	// Keep is the maximum number of records kept to be returned by Records, or 0 to keep none
+	Keep int
+
+	mu          sync.Mutex
+	count       int64
+	records     []interface{}
+	fields      map[string]*fieldProfile
+	parseErrors map[string]int64
+}
+
+// SampleReport describes the records seen by a Sampler
+type SampleReport struct {
+	// Records is the number of records which reached the sink
+	Records int64
+	// ParseErrors is the number of records which failed to parse
+	ParseErrors int64
+	// Fields describes each field seen, ordered by name. Fields of nested objects are named
+	// with their path, separated by periods
+	Fields []FieldReport
+}
+
+// FieldReport describes the values of a single field seen by a Sampler
+type FieldReport struct {
+	// Name is the name of the field, or of the column it was parsed from
+	Name string
+	// Type is the type inferred for the field. It is SampleTypeMixed if its values have
+	// different types, or "" if it was always null
+	Type string
+	// Types is the number of values of each type
+	Types map[string]int64
+	// Nulls is the number of records where the field was missing, null, or empty
+	Nulls int64
+	// NullRate is the fraction of records where the field was missing, null, or empty
+	NullRate float64
+	// ParseErrors is the number of records which failed to parse because of the field
+	ParseErrors int64
+}
+
+// fieldProfile counts the values of a field
+type fieldProfile struct {
+	types map[string]int64
+}
+
+// NewSampler builds a new Sampler which reads up to limit records from each file, and keeps the
+// first DefaultSampleKeep records which reach the sink
+func NewSampler(limit int) *Sampler {
+	return &Sampler{Limit: limit, Keep: DefaultSampleKeep}
+}
+
+// Reached reports whether a stage which has read n records from a file should stop reading it
+func (s *Sampler) Reached(n int64) bool {
+	return s != nil && s.Limit > 0 && n >= int64(s.Limit)
+}
+
+// Record profiles the fields of a record which reached the sink, keeping it if fewer than Keep
+// records have been kept.
+//
+// Maps are profiled directly. Other records are profiled as they would be encoded by
+// encoding/json
+func (s *Sampler) Record(rec interface{}) {
+	if s == nil {
+		return
+	}
+
+	values := map[string]string{}
+	for name, value := range sampleFields(rec) {
+		values[name] = sampleType(value)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.count++
+	if len(s.records) < s.Keep {
+		s.records = append(s.records, rec)
+	}
+	for name, valueType := range values {
+		profile := s.field(name)
+		if valueType != "" {
+			profile.types[valueType]++
+		}
+	}
+}
+
+// Columns records that the records being sampled have the named columns, such as the header of
+// a CSV file. Records which omit a column, such as maps which leave out empty columns, count it as
+// null even if no record has a value for it
+func (s *Sampler) Columns(names ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range names {
+		s.field(name)
+	}
+}
+
+// ParseError records that a record failed to parse because of the named column, which is ""
+// if the column is not known
+func (s *Sampler) ParseError(column string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.parseErrors == nil {
+		s.parseErrors = map[string]int64{}
+	}
+	s.parseErrors[column]++
+	if column != "" {
+		s.field(column)
+	}
+}
+
+// Records returns the first Keep records which reached the sink, in the order they arrived
+func (s *Sampler) Records() []interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]interface{}{}, s.records...)
+}
+
+// Report returns a SampleReport describing the records seen so far
+func (s *Sampler) Report() *SampleReport {
+	report := &SampleReport{}
+	if s == nil {
+		return report
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report.Records = s.count
+	for _, count := range s.parseErrors {
+		report.ParseErrors += count
+	}
+
+	for name, profile := range s.fields {
+		field := FieldReport{
+			Name:        name,
+			Types:       map[string]int64{},
+			ParseErrors: s.parseErrors[name],
+		}
+		present := int64(0)
+		for valueType, count := range profile.types {
+			field.Types[valueType] = count
+			present += count
+		}
+		field.Type = inferType(field.Types)
+		field.Nulls = report.Records - present
+		if report.Records > 0 {
+			field.NullRate = float64(field.Nulls) / float64(report.Records)
+		}
+		report.Fields = append(report.Fields, field)
+	}
+	sort.Slice(report.Fields, func(i, j int) bool {
+		return report.Fields[i].Name < report.Fields[j].Name
+	})
+
+	return report
+}
+
+// field returns the profile of the named field, creating it if it has not been seen
+func (s *Sampler) field(name string) *fieldProfile {
+	if s.fields == nil {
+		s.fields = map[string]*fieldProfile{}
+	}
+	profile, seen := s.fields[name]
+	if !seen {
+		profile = &fieldProfile{types: map[string]int64{}}
+		s.fields[name] = profile
+	}
+	return profile
+}
+
+// Print writes the report to w as a table with a row for each field
+func (r *SampleReport) Print(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Sampled %d records, %d failed to parse\n\n", r.Records, r.ParseErrors)
+	fmt.Fprintln(table, "FIELD\tTYPE\tNULLS\tPARSE ERRORS")
+	for _, field := range r.Fields {
+		fieldType := field.Type
+		if fieldType == SampleTypeMixed {
+			fieldType = fmt.Sprintf("%s (%s)", fieldType, formatTypes(field.Types))
+		} else if fieldType == "" {
+			fieldType = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%.1f%%\t%d\n", field.Name, fieldType, field.NullRate*100, field.ParseErrors)
+	}
+	return table.Flush()
+}
+
+// WithSampler is a chainable configuration method that sets the Sampler the stages run under the
+// Controller (and its children) limit and report their records to, making the run a dry run.
+// It must be called before the stages are started.
+//
+// Pipeline.DryRun is generally preferred, as it also replaces the sink of the Pipeline
+func (c *Controller) WithSampler(sampler *Sampler) *Controller {
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	root.sampler = sampler
+	return c
+}
+
+// Sampler returns the Sampler of the dry run being run under the Controller, or nil if it is not a dry run
+func (c *Controller) Sampler() *Sampler {
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	return root.sampler
+}
+
+// sampleFields returns the fields of rec, with the fields of nested objects flattened into
+// their path
+func sampleFields(rec interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+
+	object, isObject := rec.(map[string]interface{})
+	if !isObject {
+		// Records which aren't maps are profiled as they would be written
+		encoded, err := json.Marshal(rec)
+		if err != nil || json.Unmarshal(encoded, &object) != nil {
+			return fields
+		}
+	}
+
+	flattenFields(fields, "", object)
+	return fields
+}
+
+// flattenFields adds the values of object to fields, prefixing their names with prefix
+func flattenFields(fields map[string]interface{}, prefix string, object map[string]interface{}) {
+	for name, value := range object {
+		if nested, isNested := value.(map[string]interface{}); isNested && len(nested) > 0 {
+			flattenFields(fields, prefix+name+".", nested)
+			continue
+		}
+		fields[prefix+name] = value
+	}
+}
+
+// sampleType returns the type inferred for a value, or "" if it is null or empty
+func sampleType(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+
+	switch value := value.(type) {
+	case string:
+		return inferStringType(value)
+	case bool:
+		return SampleTypeBoolean
+	case time.Time:
+		return SampleTypeDate
+	case float64:
+		if value == float64(int64(value)) {
+			return SampleTypeInteger
+		}
+		return SampleTypeFloat
+	case float32:
+		if value == float32(int64(value)) {
+			return SampleTypeInteger
+		}
+		return SampleTypeFloat
+	case json.Number:
+		return inferStringType(value.String())
+	}
+
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return SampleTypeInteger
+	case reflect.Slice, reflect.Array:
+		return SampleTypeArray
+	case reflect.Map, reflect.Struct:
+		return SampleTypeObject
+	}
+	return SampleTypeString
+}
+
+// inferStringType returns the type of the values a string is most likely to hold, or "" if it is empty
+func inferStringType(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return SampleTypeInteger
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return SampleTypeFloat
+	}
+	if _, err := strconv.ParseBool(value); err == nil && len(value) > 1 {
+		return SampleTypeBoolean
+	}
+	for _, layout := range SampleDateFormats {
+		if _, err := time.Parse(layout, value); err == nil {
+			return SampleTypeDate
+		}
+	}
+	return SampleTypeString
+}
+
+// inferType returns the type of a field from the types of its values. Integers and floats
+// are inferred as floats
+func inferType(types map[string]int64) string {
+	switch len(types) {
+	case 0:
+		return ""
+	case 1:
+		for valueType := range types {
+			return valueType
+		}
+	case 2:
+		if types[SampleTypeInteger] > 0 && types[SampleTypeFloat] > 0 {
+			return SampleTypeFloat
+		}
+	}
+	return SampleTypeMixed
+}
+
+// formatTypes lists the number of values of each type, ordered by type
+func formatTypes(types map[string]int64) string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf("%s: %d", name, types[name])
+	}
+	return strings.Join(counts, ", ")
+}
@@ -0,0 +1,157 @@
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSampler(t *testing.T) {
+	Convey("Sampler", t, func() {
+		sampler := NewSampler(10)
+
+		Convey("infers the type and null rate of each field", func() {
+			sampler.Record(map[string]interface{}{"id": "1", "price": "1.5", "open": "true", "when": "2020-01-02", "name": "Bob"})
+			sampler.Record(map[string]interface{}{"id": "2", "price": "3", "name": ""})
+			sampler.Record(map[string]interface{}{"id": "x", "address": map[string]interface{}{"city": "NYC"}})
+			sampler.ParseError("price", errors.New("bad price"))
+			sampler.ParseError("", errors.New("bad row"))
+
+			report := sampler.Report()
+			So(report.Records, ShouldEqual, 3)
+			So(report.ParseErrors, ShouldEqual, 2)
+
+			fields := map[string]FieldReport{}
+			names := []string{}
+			for _, field := range report.Fields {
+				fields[field.Name] = field
+				names = append(names, field.Name)
+			}
+			So(names, ShouldResemble, []string{"address.city", "id", "name", "open", "price", "when"})
+
+			So(fields["id"].Type, ShouldEqual, SampleTypeMixed)
+			So(fields["id"].Types, ShouldResemble, map[string]int64{SampleTypeInteger: 2, SampleTypeString: 1})
+			So(fields["id"].Nulls, ShouldEqual, 0)
+			So(fields["price"].Type, ShouldEqual, SampleTypeFloat)
+			So(fields["price"].ParseErrors, ShouldEqual, 1)
+			So(fields["open"].Type, ShouldEqual, SampleTypeBoolean)
+			So(fields["when"].Type, ShouldEqual, SampleTypeDate)
+			So(fields["address.city"].Type, ShouldEqual, SampleTypeString)
+			So(fields["name"].Nulls, ShouldEqual, 2)
+			So(fields["name"].NullRate, ShouldAlmostEqual, 2.0/3.0)
+		})
+
+		Convey("profiles records which aren't maps as they are encoded", func() {
+			type person struct {
+				Name    string    `json:"name"`
+				Age     int       `json:"age"`
+				Born    time.Time `json:"born"`
+				Tags    []string  `json:"tags"`
+				Skipped string    `json:"-"`
+			}
+			sampler.Record(&person{Name: "Bob", Age: 42, Tags: []string{"a"}})
+
+			report := sampler.Report()
+			types := map[string]string{}
+			for _, field := range report.Fields {
+				types[field.Name] = field.Type
+			}
+			So(types, ShouldResemble, map[string]string{
+				"name": SampleTypeString,
+				"age":  SampleTypeInteger,
+				"born": SampleTypeDate,
+				"tags": SampleTypeArray,
+			})
+		})
+
+		Convey("prints the report as a table", func() {
+			sampler.Record(map[string]interface{}{"id": "1"})
+			sampler.Record(map[string]interface{}{"id": "a", "name": "Bob"})
+
+			out := &bytes.Buffer{}
+			So(sampler.Report().Print(out), ShouldBeNil)
+			So(out.String(), ShouldEqual, "Sampled 2 records, 0 failed to parse\n\n"+
+				"FIELD  TYPE                           NULLS  PARSE ERRORS\n"+
+				"id     mixed (integer: 1, string: 1)  0.0%   0\n"+
+				"name   string                         50.0%  0\n")
+		})
+
+		Convey("keeps only the first Keep records while profiling every record", func() {
+			sampler.Keep = 1
+			sampler.Record(map[string]interface{}{"id": "1"})
+			sampler.Record(map[string]interface{}{"id": "2"})
+
+			So(sampler.Records(), ShouldResemble, []interface{}{map[string]interface{}{"id": "1"}})
+			So(sampler.Report().Records, ShouldEqual, 2)
+			So(sampler.Report().Fields[0].Types, ShouldResemble, map[string]int64{SampleTypeInteger: 2})
+		})
+
+		Convey("counts known columns which records omit as null", func() {
+			sampler.Columns("id", "notes")
+			sampler.Record(map[string]interface{}{"id": "1"})
+
+			report := sampler.Report()
+			So(report.Fields, ShouldHaveLength, 2)
+			So(report.Fields[1].Name, ShouldEqual, "notes")
+			So(report.Fields[1].Type, ShouldEqual, "")
+			So(report.Fields[1].NullRate, ShouldEqual, 1)
+		})
+
+		Convey("can be built as a literal", func() {
+			literal := &Sampler{Limit: 10, Keep: 1}
+			literal.Columns("id")
+			literal.ParseError("age", errors.New("bad age"))
+			literal.Record(map[string]interface{}{"id": "1"})
+
+			report := literal.Report()
+			So(report.Records, ShouldEqual, 1)
+			So(report.ParseErrors, ShouldEqual, 1)
+			So(report.Fields, ShouldHaveLength, 2)
+		})
+
+		Convey("Reached is only true once the limit has been read", func() {
+			So(sampler.Reached(9), ShouldBeFalse)
+			So(sampler.Reached(10), ShouldBeTrue)
+			So(NewSampler(0).Reached(1000), ShouldBeFalse)
+			So((*Sampler)(nil).Reached(1000), ShouldBeFalse)
+		})
+	})
+}
+
+func TestPipelineDryRun(t *testing.T) {
+	Convey("Pipeline.DryRun", t, func() {
+		written := []interface{}{}
+		sink := SinkFunc(func(ctrl *Controller, in <-chan interface{}) {
+			for rec := range in {
+				written = append(written, rec)
+			}
+		})
+		ctrl := NewController()
+
+		result := NewPipeline().
+			From(StreamArray([]map[string]interface{}{{"id": 1}, {"id": 2.5}})).
+			To(sink).
+			DryRun(ctrl, 10)
+
+		Convey("records the records instead of writing them", func() {
+			So(result.Err, ShouldBeNil)
+			So(result.Records, ShouldEqual, 2)
+			So(result.Sample, ShouldHaveLength, 2)
+			So(written, ShouldBeEmpty)
+		})
+
+		Convey("reports the fields of the records", func() {
+			So(result.Report.Records, ShouldEqual, 2)
+			So(result.Report.Fields, ShouldHaveLength, 1)
+			So(result.Report.Fields[0].Type, ShouldEqual, SampleTypeFloat)
+		})
+
+		Convey("makes the Sampler available to the stages", func() {
+			So(ctrl.Sampler(), ShouldNotBeNil)
+			So(ctrl.Sampler().Limit, ShouldEqual, 10)
+		})
+	})
+}
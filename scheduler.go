@@ -0,0 +1,343 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrSchedulerStopped is returned when an Importer is registered with or run by a Scheduler which has been stopped
+var ErrSchedulerStopped = errors.New("Scheduler has been stopped")
+
+// A RunOutcome describes how a run of an Importer ended
+type RunOutcome int
+
+const (
+	// RunSucceeded is the outcome of a run whose ImportFn returned no error
+	RunSucceeded RunOutcome = iota
+	// RunFailed is the outcome of a run whose ImportFn returned an error
+	RunFailed
+	// RunAborted is the outcome of a run which was aborted
+	RunAborted
+)
+
+func (o RunOutcome) String() string {
+	switch o {
+	case RunSucceeded:
+		return "succeeded"
+	case RunFailed:
+		return "failed"
+	case RunAborted:
+		return "aborted"
+	default:
+		return "unknown"
+	}
+}
+
+// A Run is the record of a single run of a scheduled Importer
+type Run struct {
+	// Name is the name the Importer was registered with
+	Name string
+	// Start is when the run started
+	Start time.Time
+	// End is when the run ended
+	End time.Time
+	// Outcome is how the run ended
+	Outcome RunOutcome
+	// Progress is the Progress of each stage of the run when it ended, which includes its record counts
+	Progress []Progress
+	// Err is the error returned by the run, if any
+	Err error
+}
+
+// Duration returns how long the run took
+func (r Run) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// A RunHistory stores the Runs of the Importers of a Scheduler
+type RunHistory interface {
+	// Record stores a Run
+	Record(run Run) error
+	// Runs returns the Runs of the named Importer, oldest first
+	Runs(name string) ([]Run, error)
+}
+
+// MemoryRunHistory is a RunHistory which keeps a bounded number of Runs of each Importer in memory
+type MemoryRunHistory struct {
+	mu    sync.Mutex
+	limit int
+	runs  map[string][]Run
+}
+
+// NewMemoryRunHistory builds a MemoryRunHistory which keeps the limit most recent Runs of each Importer.
+// A limit of zero or less keeps every Run
+func NewMemoryRunHistory(limit int) *MemoryRunHistory {
+	return &MemoryRunHistory{limit: limit, runs: map[string][]Run{}}
+}
+
+// Record stores a Run, discarding the oldest Run of the Importer if it has reached the limit
+func (h *MemoryRunHistory) Record(run Run) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	runs := append(h.runs[run.Name], run)
+	if h.limit > 0 && len(runs) > h.limit {
+		runs = runs[len(runs)-h.limit:]
+	}
+	h.runs[run.Name] = runs
+	return nil
+}
+
+// Runs returns the Runs of the named Importer, oldest first
+func (h *MemoryRunHistory) Runs(name string) ([]Run, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Run{}, h.runs[name]...), nil
+}
+
+// A Scheduler runs named Importers on a Schedule. An Importer is never run again while it is still
+// running, and every Run is recorded in the Scheduler's RunHistory
+type Scheduler struct {
+	Log Logger
+
+	mu        sync.Mutex
+	importers map[string]*scheduledImporter
+	history   RunHistory
+	stop      chan struct{}
+	stopped   bool
+	loops     sync.WaitGroup
+	runs      sync.WaitGroup
+}
+
+// scheduledImporter is an Importer registered with a Scheduler
+type scheduledImporter struct {
+	name     string
+	importer *Importer
+	schedule Schedule
+	running  bool
+}
+
+// NewScheduler builds a Scheduler. By default, the 100 most recent Runs of each Importer are kept in memory
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		Log:       DefaultLogger.WithField("task", "scheduler"),
+		importers: map[string]*scheduledImporter{},
+		history:   NewMemoryRunHistory(100),
+	}
+}
+
+// WithHistory is a chainable configuration method that sets where the Runs of the Importers are recorded
+func (s *Scheduler) WithHistory(history RunHistory) *Scheduler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history = history
+	return s
+}
+
+// Register adds the Importer to the Scheduler under the specified name, to be run on the Schedule.
+// If the Scheduler has been started, the Importer is scheduled immediately. ErrSchedulerStopped is
+// returned if the Scheduler has been stopped
+func (s *Scheduler) Register(name string, importer *Importer, schedule Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return ErrSchedulerStopped
+	}
+	if _, exists := s.importers[name]; exists {
+		return fmt.Errorf("An importer named %q is already registered", name)
+	}
+
+	scheduled := &scheduledImporter{name: name, importer: importer, schedule: schedule}
+	s.importers[name] = scheduled
+	if s.stop != nil {
+		s.startLoop(scheduled, s.stop)
+	}
+	return nil
+}
+
+// Start starts running the Importers on their Schedules. A Scheduler which has been stopped
+// can't be started again
+func (s *Scheduler) Start() *Scheduler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil || s.stopped {
+		return s
+	}
+	s.stop = make(chan struct{})
+	for _, scheduled := range s.importers {
+		s.startLoop(scheduled, s.stop)
+	}
+	return s
+}
+
+// Stop stops scheduling new runs, and waits for the runs in progress to finish. Use Abort to
+// stop the runs in progress. Once stopped, the Scheduler refuses to register or run Importers
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.stopped = true
+	s.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+	s.loops.Wait()
+	s.runs.Wait()
+}
+
+// RunNow runs the named Importer immediately, waiting for it to finish. ErrAlreadyRunning is
+// returned if the Importer is already running, and ErrSchedulerStopped if the Scheduler has been stopped
+func (s *Scheduler) RunNow(name string) (Run, error) {
+	scheduled, err := s.lookup(name)
+	if err != nil {
+		return Run{}, err
+	}
+	if err := s.claim(scheduled); err != nil {
+		return Run{}, err
+	}
+	run := s.run(scheduled)
+	return run, run.Err
+}
+
+// Abort aborts the named Importer if it is running
+func (s *Scheduler) Abort(name string) error {
+	scheduled, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	scheduled.importer.Abort()
+	return nil
+}
+
+// Running returns whether the named Importer is running
+func (s *Scheduler) Running(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scheduled, exists := s.importers[name]
+	return exists && scheduled.running
+}
+
+// History returns the recorded Runs of the named Importer, oldest first
+func (s *Scheduler) History(name string) ([]Run, error) {
+	s.mu.Lock()
+	history := s.history
+	s.mu.Unlock()
+	return history.Runs(name)
+}
+
+// lookup returns the Importer registered under the name
+func (s *Scheduler) lookup(name string) (*scheduledImporter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scheduled, exists := s.importers[name]
+	if !exists {
+		return nil, fmt.Errorf("No importer named %q is registered", name)
+	}
+	return scheduled, nil
+}
+
+// claim marks the Importer as running and adds the run to those Stop waits for. ErrAlreadyRunning
+// is returned if it was already running, and ErrSchedulerStopped if the Scheduler has been stopped
+func (s *Scheduler) claim(scheduled *scheduledImporter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return ErrSchedulerStopped
+	}
+	if scheduled.running {
+		return ErrAlreadyRunning
+	}
+	scheduled.running = true
+	s.runs.Add(1)
+	return nil
+}
+
+// startLoop starts running the Importer on its Schedule until stop is closed
+func (s *Scheduler) startLoop(scheduled *scheduledImporter, stop chan struct{}) {
+	log := s.Log.WithField("importer", scheduled.name)
+
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		for {
+			next := scheduled.schedule.Next(time.Now())
+			if next.IsZero() {
+				log.Info("Schedule has no more runs")
+				return
+			}
+
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if err := s.claim(scheduled); err == ErrSchedulerStopped {
+				return
+			} else if err != nil {
+				log.Warn("Skipping run, the previous run is still running")
+				continue
+			}
+			go s.run(scheduled)
+		}
+	}()
+}
+
+// run runs the claimed Importer and records the Run. The Importer stops being marked as running
+// even if it panics, so it is still run on its Schedule
+func (s *Scheduler) run(scheduled *scheduledImporter) Run {
+	defer s.runs.Done()
+	defer func() {
+		s.mu.Lock()
+		scheduled.running = false
+		s.mu.Unlock()
+	}()
+	log := s.Log.WithField("importer", scheduled.name)
+
+	run := Run{Name: scheduled.name, Start: time.Now()}
+	log.Info("Starting run")
+	run.Err = scheduled.importer.Run()
+	run.End = time.Now()
+
+	if run.Err == ErrAlreadyRunning {
+		// The importer was run outside of the scheduler
+		log.Warn("Skipping run, the importer is already running")
+		return run
+	}
+
+	if ctrl := scheduled.importer.Controller(); ctrl != nil {
+		run.Progress = ctrl.Progress()
+		if state := ctrl.State(); run.Err != nil && (state == StateAborting || state == StateAborted) {
+			run.Outcome = RunAborted
+		}
+	}
+	if run.Err != nil && run.Outcome != RunAborted {
+		run.Outcome = RunFailed
+	}
+
+	s.mu.Lock()
+	history := s.history
+	s.mu.Unlock()
+
+	runLog := log.WithField("outcome", run.Outcome.String()).WithField("duration", run.Duration())
+	if run.Err != nil {
+		runLog = runLog.WithError(run.Err)
+	}
+	runLog.Info("Finished run")
+
+	if err := history.Record(run); err != nil {
+		log.WithError(err).Error("Error recording run")
+	}
+	return run
+}
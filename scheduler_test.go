@@ -0,0 +1,133 @@
+package ingest
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScheduler(t *testing.T) {
+	Convey("Scheduler", t, func() {
+		scheduler := NewScheduler()
+
+		Convey("runs importers at their interval and records their runs", func() {
+			var runs int32
+			importer := NewImporter(func(ctrl *Controller) error {
+				if atomic.AddInt32(&runs, 1) == 2 {
+					return errors.New("boom")
+				}
+				return nil
+			})
+			So(scheduler.Register("feed", importer, Every(10*time.Millisecond)), ShouldBeNil)
+
+			scheduler.Start()
+			So(waitFor(func() bool { return atomic.LoadInt32(&runs) >= 3 }, time.Second), ShouldBeTrue)
+			scheduler.Stop()
+
+			history, err := scheduler.History("feed")
+			So(err, ShouldBeNil)
+			So(len(history), ShouldBeGreaterThanOrEqualTo, 3)
+			So(history[0].Outcome, ShouldEqual, RunSucceeded)
+			So(history[1].Outcome, ShouldEqual, RunFailed)
+			So(history[1].Err.Error(), ShouldEqual, "boom")
+			So(history[1].End, ShouldHappenOnOrAfter, history[1].Start)
+		})
+
+		Convey("rejects duplicate names", func() {
+			importer := NewImporter(func(ctrl *Controller) error { return nil })
+			So(scheduler.Register("feed", importer, Every(time.Hour)), ShouldBeNil)
+			So(scheduler.Register("feed", importer, Every(time.Hour)), ShouldNotBeNil)
+		})
+
+		Convey("does not overlap runs of the same importer", func() {
+			var running, overlapped int32
+			release := make(chan struct{})
+			importer := NewImporter(func(ctrl *Controller) error {
+				if atomic.AddInt32(&running, 1) > 1 {
+					atomic.StoreInt32(&overlapped, 1)
+				}
+				defer atomic.AddInt32(&running, -1)
+				<-release
+				return nil
+			})
+			So(scheduler.Register("feed", importer, Every(5*time.Millisecond)), ShouldBeNil)
+
+			scheduler.Start()
+			So(waitFor(func() bool { return scheduler.Running("feed") }, time.Second), ShouldBeTrue)
+			_, err := scheduler.RunNow("feed")
+			So(err, ShouldEqual, ErrAlreadyRunning)
+			time.Sleep(30 * time.Millisecond)
+			close(release)
+			scheduler.Stop()
+
+			So(atomic.LoadInt32(&overlapped), ShouldEqual, 0)
+		})
+
+		Convey("stops marking an importer as running when it panics", func() {
+			panics := true
+			importer := NewImporter(func(ctrl *Controller) error {
+				if panics {
+					panic("boom")
+				}
+				return nil
+			})
+			So(scheduler.Register("feed", importer, Every(time.Hour)), ShouldBeNil)
+
+			So(func() { scheduler.RunNow("feed") }, ShouldPanic)
+			So(scheduler.Running("feed"), ShouldBeFalse)
+
+			panics = false
+			_, err := scheduler.RunNow("feed")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("refuses to register or run importers once stopped", func() {
+			importer := NewImporter(func(ctrl *Controller) error { return nil })
+			So(scheduler.Register("feed", importer, Every(time.Hour)), ShouldBeNil)
+			scheduler.Start().Stop()
+
+			So(scheduler.Register("other", importer, Every(time.Hour)), ShouldEqual, ErrSchedulerStopped)
+			_, err := scheduler.RunNow("feed")
+			So(err, ShouldEqual, ErrSchedulerStopped)
+		})
+
+		Convey("aborts running importers", func() {
+			started := make(chan struct{})
+			importer := NewImporter(func(ctrl *Controller) error {
+				ctrl.WorkerStart()
+				defer ctrl.WorkerEnd()
+				close(started)
+				<-ctrl.Quit
+				return ErrAborted
+			})
+			So(scheduler.Register("feed", importer, Every(time.Hour)), ShouldBeNil)
+
+			done := make(chan Run)
+			go func() {
+				run, _ := scheduler.RunNow("feed")
+				done <- run
+			}()
+			<-started
+			So(scheduler.Abort("feed"), ShouldBeNil)
+
+			run := <-done
+			So(run.Outcome, ShouldEqual, RunAborted)
+			So(scheduler.Abort("unknown"), ShouldNotBeNil)
+		})
+	})
+}
+
+// waitFor polls the condition until it is true, returning false if it is not true within the timeout
+func waitFor(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
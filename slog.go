@@ -0,0 +1,80 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// SlogLogger is a Logger which logs to a log/slog Logger. Fields are logged as slog attributes,
+// and the levels are gated by the slog Handler
+type SlogLogger struct {
+	logger *slog.Logger
+	attrs  []any
+}
+
+// NewSlogLogger builds a SlogLogger which logs to logger. If logger is nil, the slog default
+// logger at the time of each entry is used
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	return &SlogLogger{logger: logger}
+}
+
+// WithError returns a Logger which logs the error in the "error" field
+func (s *SlogLogger) WithError(err error) Logger {
+	return s.with("error", err)
+}
+
+// WithField returns a Logger which logs the field
+func (s *SlogLogger) WithField(field string, value interface{}) Logger {
+	return s.with(field, value)
+}
+
+// WithFields returns a Logger which logs all of the fields, in order of their names
+func (s *SlogLogger) WithFields(fields map[string]interface{}) Logger {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := make([]any, 0, 2*len(names))
+	for _, name := range names {
+		attrs = append(attrs, name, fields[name])
+	}
+	return s.with(attrs...)
+}
+
+// Debug logs at slog.LevelDebug
+func (s *SlogLogger) Debug(args ...interface{}) { s.log(slog.LevelDebug, args) }
+
+// Info logs at slog.LevelInfo
+func (s *SlogLogger) Info(args ...interface{}) { s.log(slog.LevelInfo, args) }
+
+// Warn logs at slog.LevelWarn
+func (s *SlogLogger) Warn(args ...interface{}) { s.log(slog.LevelWarn, args) }
+
+// Error logs at slog.LevelError
+func (s *SlogLogger) Error(args ...interface{}) { s.log(slog.LevelError, args) }
+
+// with returns a copy of the SlogLogger which also logs the attributes
+func (s *SlogLogger) with(attrs ...any) *SlogLogger {
+	return &SlogLogger{
+		logger: s.logger,
+		attrs:  append(append([]any{}, s.attrs...), attrs...),
+	}
+}
+
+// log logs the message built from args, if the handler is enabled for the level
+func (s *SlogLogger) log(level slog.Level, args []interface{}) {
+	logger := s.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	ctx := context.Background()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	logger.Log(ctx, level, fmt.Sprint(args...), s.attrs...)
+}
@@ -0,0 +1,466 @@
+package ingest
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/mcuadros/go-defaults"
+)
+
+// SortLessFn is a function that reports whether record a should be sorted before record b
+type SortLessFn func(a, b interface{}) bool
+
+// GroupKeyFn is a function that returns the key used to group a record
+type GroupKeyFn func(rec interface{}) string
+
+// A Group is a set of records which share a key, emitted by a Sorter built with GroupBy
+type Group struct {
+	Key     string
+	Records []interface{}
+}
+
+// ErrNoSortCodec is reported by a Sorter which has more records than fit in a single run, but no
+// SortCodec to spill them to disk with
+var ErrNoSortCodec = errors.New("Sorter has no codec to spill runs with")
+
+// A Sorter sorts the records read from its input. Records are sorted in memory in runs, which
+// are spilled to disk and merged once the input is closed, so the whole input never needs to be
+// held in memory. The sort is stable.
+//
+// Records which fit in a single run are emitted as they were read. Once there are more, every
+// record is written to disk with the Codec of the Sorter and the records emitted are the copies
+// decoded from it. With the default GobSortCodec this means any types other than the basic types
+// must be registered with gob.Register, unexported fields are lost, and records are no longer the
+// same pointers they were read as
+type Sorter struct {
+	Opts SortOpts
+	Log  Logger
+	In   <-chan interface{}
+	Less SortLessFn
+
+	groupKey GroupKeyFn
+}
+
+// SortOpts are the options used to configure a Sorter
+type SortOpts struct {
+	// RunSize is the maximum number of records that will be sorted in memory before they are
+	// spilled to disk
+	RunSize int `default:"100000"`
+
+	// SpillTo is the path to the directory where sorted runs will be stored. If it is empty, runs
+	// are stored in os.TempDir()
+	SpillTo string
+
+	// Codec writes the records of the runs to disk, and reads them back. It is required once
+	// records are spilled
+	Codec SortCodec
+}
+
+// A SortCodec writes the records of the runs a Sorter spills to disk, and reads them back when the
+// runs are merged
+type SortCodec interface {
+	// NewEncoder returns a SortEncoder which writes records to w
+	NewEncoder(w io.Writer) SortEncoder
+	// NewDecoder returns a SortDecoder which reads the records written to r
+	NewDecoder(r io.Reader) SortDecoder
+}
+
+// A SortEncoder writes records to a run
+type SortEncoder interface {
+	Encode(rec interface{}) error
+}
+
+// A SortDecoder reads records from a run. Decode returns io.EOF once there are none left
+type SortDecoder interface {
+	Decode() (interface{}, error)
+}
+
+// GobSortCodec is a SortCodec which writes records with encoding/gob. It is the default codec of a Sorter
+type GobSortCodec struct{}
+
+// NewEncoder returns a SortEncoder which writes records to w with gob
+func (GobSortCodec) NewEncoder(w io.Writer) SortEncoder {
+	return gobSortEncoder{gob.NewEncoder(w)}
+}
+
+// NewDecoder returns a SortDecoder which reads records written to r with gob
+func (GobSortCodec) NewDecoder(r io.Reader) SortDecoder {
+	return gobSortDecoder{gob.NewDecoder(r)}
+}
+
+// gobSortEncoder writes records with gob as interface values, so their types are kept
+type gobSortEncoder struct {
+	encoder *gob.Encoder
+}
+
+func (e gobSortEncoder) Encode(rec interface{}) error {
+	return e.encoder.Encode(&rec)
+}
+
+// gobSortDecoder reads records written by a gobSortEncoder
+type gobSortDecoder struct {
+	decoder *gob.Decoder
+}
+
+func (d gobSortDecoder) Decode() (interface{}, error) {
+	var rec interface{}
+	err := d.decoder.Decode(&rec)
+	return rec, err
+}
+
+// Sort builds a Sorter which will sort records using the less function
+func Sort(less SortLessFn) *Sorter {
+	sorter := &Sorter{
+		Log:  DefaultLogger.WithField("task", "sort"),
+		Less: less,
+	}
+	defaults.SetDefaults(&sorter.Opts)
+	sorter.Opts.Codec = GobSortCodec{}
+	return sorter
+}
+
+// GroupBy builds a Sorter which will sort records by the key returned by keyFn, and emit
+// a Group for each key containing all of its records.
+//
+// Only the records of a single group are held in memory at a time
+func GroupBy(keyFn GroupKeyFn) *Sorter {
+	sorter := Sort(func(a, b interface{}) bool {
+		return keyFn(a) < keyFn(b)
+	})
+	sorter.Log = DefaultLogger.WithField("task", "group-by")
+	sorter.groupKey = keyFn
+	return sorter
+}
+
+// RunSize is a chainable configuration method that sets the maximum number of records that will
+// be sorted in memory before they are spilled to disk
+func (s *Sorter) RunSize(size int) *Sorter {
+	s.Opts.RunSize = size
+	return s
+}
+
+// SpillTo is a chainable configuration method that sets the directory sorted runs are stored in.
+//
+// It will generally be the same as the DownloadTo directory of the Downloader
+func (s *Sorter) SpillTo(path string) *Sorter {
+	s.Opts.SpillTo = path
+	return s
+}
+
+// Codec is a chainable configuration method that sets the SortCodec runs are written to disk with
+func (s *Sorter) Codec(codec SortCodec) *Sorter {
+	s.Opts.Codec = codec
+	return s
+}
+
+// WithOpts is a chainable configuration method used to directly set the SortOpts
+func (s *Sorter) WithOpts(opts SortOpts) *Sorter {
+	s.Opts = opts
+	return s
+}
+
+// Start starts running the Sort task under the control of the specified controller, reading
+// records from In and writing them to the returned channel once In has been closed
+func (s *Sorter) Start(ctrl *Controller) <-chan interface{} {
+	in := s.In
+	out := make(chan interface{})
+
+	ctrl = ctrl.ChildNamed(s.task())
+	defer ctrl.ChildBuilt()
+
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+		defer close(out)
+
+		emit := func(rec interface{}) bool {
+			select {
+			case <-ctrl.Quit:
+				return false
+			case out <- rec:
+				return true
+			}
+		}
+		if s.groupKey != nil {
+			var flush func() bool
+			emit, flush = s.groupEmitter(ctrl.Checkpointer(), emit)
+			defer flush()
+		}
+
+		if err := s.sort(ctrl, in, emit); err != nil {
+			ctrl.ReportError(s.task(), 0, err)
+		}
+	}()
+
+	return out
+}
+
+// Transform reads from the specified input and starts the Sorter under the control of the
+// specified controller, allowing it to be used as a Transform in a Pipeline
+func (s *Sorter) Transform(ctrl *Controller, in <-chan interface{}) <-chan interface{} {
+	s.In = in
+	return s.Start(ctrl)
+}
+
+// sort reads all of the records from in, spilling sorted runs to disk when there are more
+// than RunSize, and emits them in order.
+//
+// Spilled records are emitted as copies, which can not be followed to the sink, so they are
+// released from the Checkpointer
+func (s *Sorter) sort(ctrl *Controller, in <-chan interface{}, emit func(rec interface{}) bool) error {
+	checkpoints := ctrl.Checkpointer()
+	runs := []string{}
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+	}()
+
+	buffer := make([]interface{}, 0, s.runSize())
+	for rec := range in {
+		if !ctrl.AwaitResume() {
+			return nil
+		}
+		buffer = append(buffer, rec)
+		if len(buffer) < s.runSize() {
+			continue
+		}
+
+		run, err := s.spill(buffer)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		for _, spilled := range buffer {
+			checkpoints.Release(spilled)
+		}
+		buffer = buffer[:0]
+	}
+
+	select {
+	case <-ctrl.Quit:
+		return nil
+	default:
+	}
+
+	sort.Stable(sortRun{buffer, s.Less})
+	if len(runs) == 0 {
+		for _, rec := range buffer {
+			if !emit(rec) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	if len(buffer) > 0 {
+		run, err := s.spill(buffer)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		for _, spilled := range buffer {
+			checkpoints.Release(spilled)
+		}
+	}
+
+	s.Log.WithField("runs", len(runs)).Debug("Merging sorted runs")
+	return s.merge(runs, emit)
+}
+
+// spill sorts the records and writes them to a new run, returning its path
+func (s *Sorter) spill(recs []interface{}) (string, error) {
+	if s.Opts.Codec == nil {
+		return "", ErrNoSortCodec
+	}
+	sort.Stable(sortRun{recs, s.Less})
+
+	dir := s.Opts.SpillTo
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(dir, "sort-run-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := s.Opts.Codec.NewEncoder(writer)
+	for _, rec := range recs {
+		if err := encoder.Encode(rec); err != nil {
+			os.Remove(file.Name())
+			return "", err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// merge emits the records of all of the runs in order
+func (s *Sorter) merge(runs []string, emit func(rec interface{}) bool) error {
+	merger := &runMerger{less: s.Less}
+	defer merger.close()
+
+	for i, path := range runs {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		reader := &runReader{index: i, file: file, decoder: s.Opts.Codec.NewDecoder(bufio.NewReader(file))}
+		merger.readers = append(merger.readers, reader)
+
+		if more, err := reader.next(); err != nil {
+			return err
+		} else if more {
+			heap.Push(merger, reader)
+		}
+	}
+
+	for merger.Len() > 0 {
+		reader := merger.heaped[0]
+		if !emit(reader.rec) {
+			return nil
+		}
+
+		more, err := reader.next()
+		if err != nil {
+			return err
+		}
+		if more {
+			heap.Fix(merger, 0)
+		} else {
+			heap.Pop(merger)
+		}
+	}
+
+	return nil
+}
+
+// groupEmitter wraps emit so that consecutive records with the same key are emitted as a single Group.
+//
+// The returned flush function emits the final group. Grouped records can not be followed to the
+// sink, so they are released from the Checkpointer
+func (s *Sorter) groupEmitter(checkpoints *Checkpointer, emit func(rec interface{}) bool) (func(rec interface{}) bool, func() bool) {
+	var group *Group
+
+	flush := func() bool {
+		if group == nil {
+			return true
+		}
+		ready := *group
+		group = nil
+		return emit(ready)
+	}
+
+	return func(rec interface{}) bool {
+		key := s.groupKey(rec)
+		if group != nil && group.Key != key && !flush() {
+			return false
+		}
+		if group == nil {
+			group = &Group{Key: key}
+		}
+		checkpoints.Release(rec)
+		group.Records = append(group.Records, rec)
+		return true
+	}, flush
+}
+
+// runSize returns the number of records in each run, which is always at least one
+func (s *Sorter) runSize() int {
+	if s.Opts.RunSize < 1 {
+		return 1
+	}
+	return s.Opts.RunSize
+}
+
+// task returns the name of the task the Sorter reports errors with
+func (s *Sorter) task() string {
+	if s.groupKey != nil {
+		return "group-by"
+	}
+	return "sort"
+}
+
+// sortRun sorts a run of records in memory
+type sortRun struct {
+	recs []interface{}
+	less SortLessFn
+}
+
+func (r sortRun) Len() int           { return len(r.recs) }
+func (r sortRun) Less(i, j int) bool { return r.less(r.recs[i], r.recs[j]) }
+func (r sortRun) Swap(i, j int)      { r.recs[i], r.recs[j] = r.recs[j], r.recs[i] }
+
+// runReader reads the records of a run spilled to disk
+type runReader struct {
+	index   int
+	file    *os.File
+	decoder SortDecoder
+	rec     interface{}
+}
+
+// next reads the next record of the run, returning false once there are none left
+func (r *runReader) next() (bool, error) {
+	rec, err := r.decoder.Decode()
+	if err == io.EOF {
+		r.rec = nil
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	r.rec = rec
+	return true, nil
+}
+
+// runMerger is a heap of runs ordered by their next record. Ties are broken by the order
+// of the runs, which keeps the merge stable
+type runMerger struct {
+	less    SortLessFn
+	readers []*runReader
+	heaped  []*runReader
+}
+
+func (m *runMerger) Len() int { return len(m.heaped) }
+
+func (m *runMerger) Less(i, j int) bool {
+	a, b := m.heaped[i], m.heaped[j]
+	if m.less(a.rec, b.rec) {
+		return true
+	}
+	if m.less(b.rec, a.rec) {
+		return false
+	}
+	return a.index < b.index
+}
+
+func (m *runMerger) Swap(i, j int) { m.heaped[i], m.heaped[j] = m.heaped[j], m.heaped[i] }
+
+func (m *runMerger) Push(x interface{}) { m.heaped = append(m.heaped, x.(*runReader)) }
+
+func (m *runMerger) Pop() interface{} {
+	last := m.heaped[len(m.heaped)-1]
+	m.heaped = m.heaped[:len(m.heaped)-1]
+	return last
+}
+
+// close closes all of the runs
+func (m *runMerger) close() {
+	for _, reader := range m.readers {
+		reader.file.Close()
+	}
+}
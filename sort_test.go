@@ -0,0 +1,138 @@
+package ingest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSort(t *testing.T) {
+	Convey("Sort", t, func() {
+		ctrl := NewController()
+
+		dir, err := ioutil.TempDir("", "sort")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		byValue := func(a, b interface{}) bool {
+			return a.(int) < b.(int)
+		}
+
+		Convey("sorts records in memory when they fit in a single run", func() {
+			sorter := Sort(byValue).SpillTo(dir)
+			sorter.In = StreamArray([]int{3, 1, 2}).Start(ctrl)
+			results, err := Stream(sorter.Start(ctrl)).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []interface{}{1, 2, 3})
+		})
+
+		Convey("merges runs spilled to disk and removes them", func() {
+			sorter := Sort(byValue).RunSize(3).SpillTo(dir)
+			sorter.In = StreamArray([]int{9, 4, 7, 1, 8, 2, 6, 3, 5, 0}).Start(ctrl)
+			results, err := Stream(sorter.Start(ctrl)).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+
+			ctrl.Wait()
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(files, ShouldBeEmpty)
+		})
+
+		Convey("is stable across runs", func() {
+			words := []string{"bb", "a", "cc", "b", "aa", "c"}
+			byLength := func(a, b interface{}) bool {
+				return len(a.(string)) < len(b.(string))
+			}
+
+			sorter := Sort(byLength).RunSize(2).SpillTo(dir)
+			sorter.In = StreamArray(words).Start(ctrl)
+			results, err := Stream(sorter.Start(ctrl)).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []interface{}{"a", "b", "c", "bb", "cc", "aa"})
+		})
+
+		Convey("writes spilled runs with the configured codec", func() {
+			codec := &lineSortCodec{}
+			sorter := Sort(byValue).RunSize(2).SpillTo(dir).Codec(codec)
+			sorter.In = StreamArray([]int{3, 1, 2}).Start(ctrl)
+			results, err := Stream(sorter.Start(ctrl)).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []interface{}{1, 2, 3})
+			So(codec.encoded, ShouldEqual, 3)
+		})
+
+		Convey("reports an error when runs must be spilled without a codec", func() {
+			sorter := Sort(byValue).WithOpts(SortOpts{RunSize: 2, SpillTo: dir})
+			sorter.In = StreamArray([]int{3, 1, 2}).Start(ctrl)
+			_, err := Stream(sorter.Start(ctrl)).Collect(ctrl)
+
+			So(errors.Is(err, ErrNoSortCodec), ShouldBeTrue)
+		})
+
+		Convey("GroupBy emits a Group for each key", func() {
+			words := []string{"apple", "bean", "avocado", "carrot", "banana"}
+			firstLetter := func(rec interface{}) string {
+				return strings.ToUpper(rec.(string)[:1])
+			}
+
+			sorter := GroupBy(firstLetter).RunSize(2).SpillTo(dir)
+			sorter.In = StreamArray(words).Start(ctrl)
+			results, err := Stream(sorter.Start(ctrl)).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []interface{}{
+				Group{Key: "A", Records: []interface{}{"apple", "avocado"}},
+				Group{Key: "B", Records: []interface{}{"bean", "banana"}},
+				Group{Key: "C", Records: []interface{}{"carrot"}},
+			})
+		})
+	})
+}
+
+// lineSortCodec is a SortCodec which writes ints as lines of text, counting the records it encodes
+type lineSortCodec struct {
+	encoded int
+}
+
+func (c *lineSortCodec) NewEncoder(w io.Writer) SortEncoder {
+	return lineSortEncoder{c, w}
+}
+
+func (c *lineSortCodec) NewDecoder(r io.Reader) SortDecoder {
+	return lineSortDecoder{bufio.NewScanner(r)}
+}
+
+type lineSortEncoder struct {
+	codec *lineSortCodec
+	w     io.Writer
+}
+
+func (e lineSortEncoder) Encode(rec interface{}) error {
+	e.codec.encoded++
+	_, err := fmt.Fprintln(e.w, rec)
+	return err
+}
+
+type lineSortDecoder struct {
+	scanner *bufio.Scanner
+}
+
+func (d lineSortDecoder) Decode() (interface{}, error) {
+	if !d.scanner.Scan() {
+		return nil, io.EOF
+	}
+	return strconv.Atoi(d.scanner.Text())
+}
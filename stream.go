@@ -1,11 +1,35 @@
 package ingest
 
-import "fmt"
-import "reflect"
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/go-defaults"
+)
 
 // StreamForEachFn is a function that operates over each record in a stream
 type StreamForEachFn func(rec interface{}) error
 
+// StreamForEachContextFn is a function that operates over each record in a stream
+// and receives the context of the controller running the stream
+type StreamForEachContextFn func(ctx context.Context, rec interface{}) error
+
+// StreamMapFn is a function that replaces each record in a stream
+type StreamMapFn func(rec interface{}) (interface{}, error)
+
+// StreamFilterFn is a function that decides whether a record is kept in a stream
+type StreamFilterFn func(rec interface{}) bool
+
+// StreamFlatMapFn is a function that replaces each record in a stream with any number of records
+type StreamFlatMapFn func(rec interface{}) ([]interface{}, error)
+
+// streamOp is a single operation configured on a Streamer. It returns the records that
+// replace rec in the stream
+type streamOp func(ctx context.Context, rec interface{}) ([]interface{}, error)
+
 // A Streamer is used to manipulate input in and out of channels and slices
 type Streamer struct {
 	Opts StreamOpts
@@ -14,30 +38,74 @@ type Streamer struct {
 	Out  chan interface{}
 
 	depGroup *DependencyGroup
-	forEachs []StreamForEachFn
+	task     string
+	progress *StageProgress
+	ops      []streamOp
+	input    Input
+	sources  []*Streamer
+	outputs  []Output
+	owned    []Output
+	first    chan interface{}
+	group    func() grouper
+	err      error
 }
 
 // StreamOpts are the options used to configure a Streamer
 type StreamOpts struct {
 	Progress chan struct{}
+
+	// StopOnDrain defines whether the Streamer stops reading its input when the controller
+	// begins draining, which is the case when the Streamer is the source of a pipeline
+	StopOnDrain bool
+
+	// NumWorkers is the number of workers that will process records from each input
+	NumWorkers int `default:"1"`
+
+	// Ordered defines whether records are emitted in the order they were read when there
+	// are multiple workers
+	Ordered bool
+
+	// RateLimiter is an optional RateLimiter which limits how fast records are written to
+	// the outputs. Each record, or each batch or window when grouping, takes a single token
+	RateLimiter *RateLimiter
 }
 
+// StreamOrderWindow is how many records each worker of an ordered Streamer may process ahead
+// of the oldest record which has not yet been emitted
+var StreamOrderWindow = 4
+
 // NewStream builds a new Streamer. Generally you will want to use
 // StreamArray or Stream instead
 func NewStream() *Streamer {
-	return &Streamer{
+	stream := &Streamer{
+		Log:      DefaultLogger.WithField("task", "stream"),
 		depGroup: NewDependencyGroup(),
+		task:     "stream",
 	}
+	defaults.SetDefaults(&stream.Opts)
+	return stream
 }
 
 // Stream builds a new Streamer that will read from the input channel
 func Stream(input <-chan interface{}) *Streamer {
 	stream := NewStream()
-	stream.Log = DefaultLogger.WithField("task", "stream")
 	stream.In = input
 	return stream
 }
 
+// Merge builds a Streamer which will read from the outputs of all of the specified Streamers,
+// such as the branches of a Tee. The Streamers are started along with it, so they should not
+// be started on their own. Channels can be merged by wrapping them with Stream.
+//
+// The output of the Streamer will only be closed once all of the inputs have been closed
+func Merge(streams ...*Streamer) *Streamer {
+	stream := NewStream()
+	stream.Log = DefaultLogger.WithField("task", "stream-merge")
+	stream.task = "stream-merge"
+	stream.sources = streams
+	return stream
+}
+
 // StreamArray builds a Streamer which will ready from the provided array
 func StreamArray(array interface{}) *Streamer {
 	arrValue := reflect.ValueOf(array)
@@ -55,7 +123,9 @@ func StreamArray(array interface{}) *Streamer {
 
 	stream := NewStream()
 	stream.Log = DefaultLogger.WithField("task", "stream-array")
+	stream.task = "stream-array"
 	stream.In = input
+	stream.Opts.StopOnDrain = true
 
 	return stream
 }
@@ -67,13 +137,113 @@ func (s *Streamer) WriteTo(output chan interface{}) *Streamer {
 	return s
 }
 
+// Broadcast is a chainable configuration method that sets multiple channels
+// the Streamer will output records to. Every record is written to each of the outputs.
+//
+// Like WriteTo, the outputs will not be closed by the Streamer
+func (s *Streamer) Broadcast(outputs ...chan interface{}) *Streamer {
+	for _, out := range outputs {
+		if s.first == nil {
+			s.first = out
+		}
+		s.outputs = append(s.outputs, OutputOf(out))
+	}
+	return s
+}
+
+// ReadFrom is a chainable configuration method that sets the Input the Streamer reads records
+// from, such as a channel of another type adapted with InputOf. It replaces In
+func (s *Streamer) ReadFrom(in Input) *Streamer {
+	s.input = in
+	return s
+}
+
+// SendTo is a chainable configuration method that adds an Output the Streamer writes every
+// record to, such as a channel of another type adapted with OutputOf. Records which can not
+// be written to the Output are reported to the controller.
+//
+// Unlike the outputs of Broadcast, the Output is closed once the Streamer finishes
+func (s *Streamer) SendTo(out Output) *Streamer {
+	s.outputs = append(s.outputs, out)
+	s.owned = append(s.owned, out)
+	return s
+}
+
+// Tee configures the Streamer to write every record to n new branches, returning
+// a Streamer that reads from each branch.
+//
+// The branches are closed once the Streamer finishes, and must each be started for the
+// Streamer to make progress
+func (s *Streamer) Tee(n int) []*Streamer {
+	branches := make([]*Streamer, n)
+	for i := range branches {
+		branch := make(chan interface{})
+		s.SendTo(OutputOf(branch))
+		branches[i] = Stream(branch)
+	}
+	return branches
+}
+
+// Named is a chainable configuration method that sets the name of the task the Streamer
+// logs and reports its progress as.
+//
+// Streamers with the same name running under the same Controller share their progress
+func (s *Streamer) Named(name string) *Streamer {
+	s.task = name
+	s.Log = s.Log.WithField("task", name)
+	return s
+}
+
 // ReportProgressTo is a chainable configuration method that sets
-// where the Streamer will report progress events
+// where the Streamer will report progress events.
+//
+// A goroutine is started for each event, so Controller.ReportProgressEvery is
+// preferred for large streams
 func (s *Streamer) ReportProgressTo(progress chan struct{}) *Streamer {
 	s.Opts.Progress = progress
 	return s
 }
 
+// StopOnDrain is a chainable configuration method that sets whether the Streamer
+// will stop reading its input when the controller begins draining.
+//
+// Streamers built with StreamArray stop on drain by default
+func (s *Streamer) StopOnDrain(stop bool) *Streamer {
+	s.Opts.StopOnDrain = stop
+	return s
+}
+
+// Workers is a chainable configuration method that sets how many workers
+// will process the records of each input
+func (s *Streamer) Workers(count int) *Streamer {
+	s.Opts.NumWorkers = count
+	return s
+}
+
+// Ordered is a chainable configuration method that sets whether the Streamer
+// will emit records in the order that they were read when there are multiple workers.
+//
+// Records are held in a reorder buffer until all of the records before them have been emitted
+func (s *Streamer) Ordered(ordered bool) *Streamer {
+	s.Opts.Ordered = ordered
+	return s
+}
+
+// RateLimit is a chainable configuration method that limits the Streamer to writing
+// perSecond records per second, with bursts of up to burst records.
+//
+// The limit can be changed while the Streamer is running by calling SetRate on Opts.RateLimiter
+func (s *Streamer) RateLimit(perSecond float64, burst int) *Streamer {
+	return s.RateLimitWith(NewRateLimiter(perSecond, burst))
+}
+
+// RateLimitWith is a chainable configuration method that sets the RateLimiter used to limit
+// how fast the Streamer writes records. A RateLimiter may be shared between Streamers
+func (s *Streamer) RateLimitWith(limiter *RateLimiter) *Streamer {
+	s.Opts.RateLimiter = limiter
+	return s
+}
+
 // DependOn is a chainable configuration method that will not proceed until all
 // specified controllers have resolved
 func (s *Streamer) DependOn(ctrls ...*Controller) *Streamer {
@@ -88,62 +258,396 @@ func (s *Streamer) DependOn(ctrls ...*Controller) *Streamer {
 // and the record will not be transmitted
 //
 // For each can be called multiple times, in which case the functions will
-// be executed in the order that they were added to the stream
+// be executed in the order that they were added to the stream, along with any
+// Map, Filter or FlatMap functions
 func (s *Streamer) ForEach(fn StreamForEachFn) *Streamer {
-	s.forEachs = append(s.forEachs, fn)
+	return s.ForEachContext(func(ctx context.Context, rec interface{}) error {
+		return fn(rec)
+	})
+}
+
+// ForEachContext is a chainable configuration method that behaves like ForEach, but
+// the function will also receive the context of the Controller running the stream.
+//
+// The context is cancelled when the Controller is aborted, which allows the function
+// to hand it off to code that only understands context.Context
+func (s *Streamer) ForEachContext(fn StreamForEachContextFn) *Streamer {
+	s.ops = append(s.ops, func(ctx context.Context, rec interface{}) ([]interface{}, error) {
+		if err := fn(ctx, rec); err != nil {
+			return nil, err
+		}
+		return []interface{}{rec}, nil
+	})
+	return s
+}
+
+// Map is a chainable configuration method that replaces each record in the
+// stream with the result of the specified function.
+//
+// If an error is returned, it will be reported to the controller
+// and the record will not be transmitted
+func (s *Streamer) Map(fn StreamMapFn) *Streamer {
+	s.ops = append(s.ops, func(ctx context.Context, rec interface{}) ([]interface{}, error) {
+		mapped, err := fn(rec)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{mapped}, nil
+	})
+	return s
+}
+
+// Filter is a chainable configuration method that drops every record for which
+// the specified function returns false
+func (s *Streamer) Filter(fn StreamFilterFn) *Streamer {
+	s.ops = append(s.ops, func(ctx context.Context, rec interface{}) ([]interface{}, error) {
+		if !fn(rec) {
+			return nil, nil
+		}
+		return []interface{}{rec}, nil
+	})
+	return s
+}
+
+// FlatMap is a chainable configuration method that replaces each record in the
+// stream with all of the records returned by the specified function. Returning
+// an empty slice drops the record.
+//
+// If an error is returned, it will be reported to the controller
+// and none of the records will be transmitted
+func (s *Streamer) FlatMap(fn StreamFlatMapFn) *Streamer {
+	s.ops = append(s.ops, func(ctx context.Context, rec interface{}) ([]interface{}, error) {
+		return fn(rec)
+	})
 	return s
 }
 
 // Start starts running the Stream task under the control of the specified controller
+//
+// It returns the channel records are written to. If the Streamer is broadcasting to
+// multiple outputs, the first of them is returned. If records are only written to the
+// branches of a Tee or to the Outputs set with SendTo, a closed channel is returned
 func (s *Streamer) Start(ctrl *Controller) <-chan interface{} {
-	ctrl = ctrl.Child()
+	ctrl = ctrl.ChildNamed(s.task)
 	defer ctrl.ChildBuilt()
 
 	s.depGroup.Wait()
+	s.progress = ctrl.Stage(s.task)
+
+	outputs := s.outputs
+	owned := s.owned
+	var result <-chan interface{}
+	switch {
+	case s.Out != nil:
+		outputs = append([]Output{OutputOf(s.Out)}, outputs...)
+		result = s.Out
+	case len(outputs) == 0:
+		out := make(chan interface{})
+		outputs = []Output{OutputOf(out)}
+		owned = append(owned, outputs[0])
+		result = out
+	case s.first != nil:
+		result = s.first
+	default:
+		result = closedChannel()
+	}
 
-	out := s.Out
-	if out == nil {
-		out = make(chan interface{})
+	if len(owned) > 0 {
 		go func() {
 			ctrl.Wait()
-			close(out)
+			for _, out := range owned {
+				out.Close()
+			}
+		}()
+	}
+
+	// A Streamer which was configured with invalid options reports why and emits nothing
+	if s.err != nil {
+		ctrl.ReportError(s.task, 0, s.err)
+		return result
+	}
+
+	inputs := []Input{}
+	for _, source := range s.sources {
+		inputs = append(inputs, InputOf(source.Start(ctrl)))
+	}
+	if len(inputs) == 0 && s.input != nil {
+		inputs = []Input{s.input}
+	} else if len(inputs) == 0 {
+		inputs = []Input{InputOf(s.In)}
+	}
+
+	if s.group != nil {
+		// The workers write to the grouping stage, which is closed once they have all exited
+		grouped := make(chan interface{})
+		s.startGrouping(ctrl, grouped, outputs)
+
+		workers := ctrl.ChildNamed(s.task + "-workers")
+		defer workers.ChildBuilt()
+		go func() {
+			workers.Wait()
+			close(grouped)
 		}()
+
+		s.startWorkers(workers, inputs, []Output{OutputOf(grouped)})
+		return result
+	}
+
+	s.startWorkers(ctrl, inputs, outputs)
+	return result
+}
+
+// startWorkers starts the workers which read records from the inputs and write them to all of the outputs
+func (s *Streamer) startWorkers(ctrl *Controller, inputs []Input, outputs []Output) {
+	if s.Opts.Ordered && s.numWorkers() > 1 {
+		s.startOrdered(ctrl, inputs, outputs)
+		return
 	}
 
+	id := 0
+	for _, in := range inputs {
+		for i := 0; i < s.numWorkers(); i++ {
+			s.startWorker(ctrl, id, in, outputs)
+			id++
+		}
+	}
+}
+
+// startWorker starts a worker which reads records from the input and writes them to all of the outputs
+func (s *Streamer) startWorker(ctrl *Controller, id int, in Input, outputs []Output) {
+	log := s.Log.WithField("worker", id)
+	checkpoints := ctrl.Checkpointer()
 	ctrl.WorkerStart()
-	s.Log.Debug("Starting worker")
+	log.Debug("Starting worker")
 	go func() {
 		defer ctrl.WorkerEnd()
-		defer s.Log.Debug("Exiting worker")
-		for {
-			select {
-			case <-ctrl.Quit:
-				return
-			case rec, ok := <-s.In:
-				if !ok {
-					return
+		defer log.Debug("Exiting worker")
+		s.read(ctrl, in, func(rec interface{}) bool {
+			started := time.Now()
+			recs, err := s.runOps(ctrl.Context(), rec)
+			s.progress.Observe(time.Since(started))
+			if err != nil {
+				s.progress.Failed(1)
+				ctrl.ReportError(s.task, id, err)
+				return true
+			}
+			checkpoints.Transfer(rec, recs)
+			if !s.emit(ctrl, id, outputs, recs) {
+				return false
+			}
+			s.progress.Out(len(recs))
+			return true
+		})
+	}()
+}
+
+// orderedRecord is a record read by an ordered Streamer, along with its position in the input
+// and the worker which processed it
+type orderedRecord struct {
+	seq    uint64
+	worker int
+	rec    interface{}
+	recs   []interface{}
+	err    error
+}
+
+// startOrdered starts the workers of a Streamer which preserves the order of its input.
+//
+// A reader for each input numbers the records it reads and hands them to the workers, which
+// process them in parallel. The results are then held by a single emitter until all of the
+// records before them have been written to the outputs.
+func (s *Streamer) startOrdered(ctrl *Controller, inputs []Input, outputs []Output) {
+	jobs := make(chan orderedRecord)
+	results := make(chan orderedRecord)
+	window := make(chan struct{}, s.numWorkers()*StreamOrderWindow)
+
+	var seqMu sync.Mutex
+	var nextSeq uint64
+
+	readers := sync.WaitGroup{}
+	readers.Add(len(inputs))
+	for _, in := range inputs {
+		ctrl.WorkerStart()
+		go func(in Input) {
+			defer ctrl.WorkerEnd()
+			defer readers.Done()
+			s.read(ctrl, in, func(rec interface{}) bool {
+				select {
+				case <-ctrl.Quit:
+					return false
+				case window <- struct{}{}:
 				}
-				if err := s.runForEachs(rec); err != nil {
-					ctrl.Err <- err
-					continue
+
+				seqMu.Lock()
+				job := orderedRecord{seq: nextSeq, rec: rec}
+				nextSeq++
+				seqMu.Unlock()
+
+				select {
+				case <-ctrl.Quit:
+					return false
+				case jobs <- job:
+					return true
 				}
+			})
+		}(in)
+	}
+	go func() {
+		readers.Wait()
+		close(jobs)
+	}()
+
+	workers := sync.WaitGroup{}
+	workers.Add(s.numWorkers())
+	for i := 0; i < s.numWorkers(); i++ {
+		log := s.Log.WithField("worker", i)
+		ctrl.WorkerStart()
+		log.Debug("Starting worker")
+		go func(id int) {
+			defer ctrl.WorkerEnd()
+			defer workers.Done()
+			defer log.Debug("Exiting worker")
+			for job := range jobs {
+				job.worker = id
+				started := time.Now()
+				job.recs, job.err = s.runOps(ctrl.Context(), job.rec)
+				s.progress.Observe(time.Since(started))
 				select {
 				case <-ctrl.Quit:
 					return
-				case out <- rec:
-					s.reportProgress()
+				case results <- job:
+				}
+			}
+		}(i)
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	checkpoints := ctrl.Checkpointer()
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+
+		pending := map[uint64]orderedRecord{}
+		var next uint64
+		for result := range results {
+			pending[result.seq] = result
+			for {
+				ready, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				<-window
+
+				if ready.err != nil {
+					s.progress.Failed(1)
+					ctrl.ReportError(s.task, ready.worker, ready.err)
 					continue
 				}
+				checkpoints.Transfer(ready.rec, ready.recs)
+				if !s.emit(ctrl, ready.worker, outputs, ready.recs) {
+					return
+				}
+				s.progress.Out(len(ready.recs))
 			}
 		}
 	}()
+}
 
-	return out
+// numWorkers returns the number of workers that will process each input, which is always at least one
+func (s *Streamer) numWorkers() int {
+	if s.Opts.NumWorkers < 1 {
+		return 1
+	}
+	return s.Opts.NumWorkers
+}
+
+// read reads records from the input until it is closed, the controller quits (or drains,
+// when StopOnDrain is set) or fn returns false.
+//
+// It waits for the controller to resume before each record when it is paused
+func (s *Streamer) read(ctrl *Controller, in Input, fn func(rec interface{}) bool) {
+	var stop <-chan struct{} = ctrl.Quit
+	if s.Opts.StopOnDrain {
+		stop = ctrl.Draining()
+	}
+
+	for {
+		if s.Opts.StopOnDrain && ctrl.IsDraining() {
+			return
+		}
+		if !ctrl.AwaitResume() {
+			return
+		}
+		rec, ok := in.Receive(stop)
+		if !ok {
+			return
+		}
+		s.progress.In(1)
+		if !fn(rec) {
+			return
+		}
+	}
+}
+
+// emit sends each of the records to the outputs, returning false if the controller quit first.
+// Records sent to several outputs must be acknowledged by each of them before they are checkpointed
+func (s *Streamer) emit(ctrl *Controller, worker int, outputs []Output, recs []interface{}) bool {
+	var checkpoints *Checkpointer
+	if len(outputs) > 1 && len(recs) > 0 {
+		checkpoints = ctrl.Checkpointer()
+	}
+
+	for _, rec := range recs {
+		if !s.Opts.RateLimiter.Wait(1, ctrl.Quit) {
+			return false
+		}
+		checkpoints.Share(rec, len(outputs))
+		if !s.send(ctrl, worker, outputs, rec) {
+			return false
+		}
+		s.reportProgress()
+	}
+	return true
+}
+
+// send writes the record to each of the outputs, returning false if the controller quit first.
+// Outputs which can not accept the record are reported to the controller
+func (s *Streamer) send(ctrl *Controller, worker int, outputs []Output, rec interface{}) bool {
+	for _, out := range outputs {
+		sent, err := out.Send(ctrl.Quit, rec)
+		if err != nil {
+			ctrl.ReportError(s.task, worker, err)
+			ctrl.Checkpointer().Release(rec)
+		} else if !sent {
+			return false
+		}
+	}
+	return true
+}
+
+// Produce starts the Streamer under the control of the specified controller, allowing it
+// to be used as the Source of a Pipeline
+func (s *Streamer) Produce(ctrl *Controller) <-chan interface{} {
+	return s.Start(ctrl)
+}
+
+// Transform reads from the specified input and starts the Streamer under the control of the
+// specified controller, allowing it to be used as a Transform in a Pipeline
+func (s *Streamer) Transform(ctrl *Controller, in <-chan interface{}) <-chan interface{} {
+	s.In = in
+	s.input = nil
+	return s.Start(ctrl)
 }
 
 // Collect reads the results of the Input into an array, under the control of the specified controller.
 //
-// If the Controller is aborted, ErrAborted will be returned
+// If the Controller is aborted, ErrAborted will be returned. Collect reads the errors reported
+// to the Controller, so Error should not be called on the same Controller at the same time
 func (s *Streamer) Collect(ctrl *Controller) ([]interface{}, error) {
 	resultChan := s.Start(ctrl)
 
@@ -153,9 +657,16 @@ func (s *Streamer) Collect(ctrl *Controller) ([]interface{}, error) {
 		select {
 		case rec, ok := <-resultChan:
 			if !ok {
+				if err := ctrl.takeError(); err != nil {
+					return nil, err
+				}
 				return results, nil
 			}
 			results = append(results, rec)
+		case <-ctrl.errorsReady():
+			if err := ctrl.takeError(); err != nil {
+				return nil, err
+			}
 		case err := <-ctrl.Err:
 			return nil, err
 		case <-ctrl.Quit:
@@ -173,20 +684,27 @@ func (s *Streamer) reportProgress() {
 	}
 }
 
-// runForEachs will run all of the forEach functions on the specified record, or
-// return the first error encountered.
+// runOps will run all of the configured operations on the specified record, returning
+// the records that should be transmitted, or the first error encountered.
 //
-// If there are no forEachs, it is essentially a no-op
-func (s *Streamer) runForEachs(rec interface{}) error {
-	if s.forEachs == nil || len(s.forEachs) == 0 {
-		return nil
-	}
+// If there are no operations, it is essentially a no-op
+func (s *Streamer) runOps(ctx context.Context, rec interface{}) ([]interface{}, error) {
+	recs := []interface{}{rec}
 
-	for _, fn := range s.forEachs {
-		if err := fn(rec); err != nil {
-			return err
+	for _, op := range s.ops {
+		var next []interface{}
+		for _, rec := range recs {
+			results, err := op(ctx, rec)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, results...)
+		}
+		if len(next) == 0 {
+			return nil, nil
 		}
+		recs = next
 	}
 
-	return nil
+	return recs, nil
 }
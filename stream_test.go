@@ -0,0 +1,269 @@
+package ingest
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// sortedInts converts a slice of records into a sorted slice of ints
+func sortedInts(recs []interface{}) []int {
+	result := make([]int, len(recs))
+	for i, rec := range recs {
+		result[i] = rec.(int)
+	}
+	sort.Ints(result)
+	return result
+}
+
+func TestStreamer(t *testing.T) {
+	Convey("Streamer", t, func() {
+		ctrl := NewController()
+
+		Convey("Merge reads from all inputs and closes once they have all finished", func() {
+			first := StreamArray([]int{1, 2, 3})
+			second := Stream(StreamArray([]int{4, 5}).Start(ctrl))
+
+			results, err := Merge(first, second).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(sortedInts(results), ShouldResemble, []int{1, 2, 3, 4, 5})
+		})
+
+		Convey("Merge rejoins the branches of a Tee", func() {
+			source := StreamArray([]int{1, 2, 3})
+			branches := source.Tee(2)
+			_, isOpen := <-source.Start(ctrl)
+			So(isOpen, ShouldBeFalse)
+
+			doubled := branches[1].Map(func(rec interface{}) (interface{}, error) {
+				return rec.(int) * 2, nil
+			})
+			results, err := Merge(branches[0], doubled).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(sortedInts(results), ShouldResemble, []int{1, 2, 2, 3, 4, 6})
+		})
+
+		Convey("Tee writes every record to each branch", func() {
+			source := StreamArray([]int{1, 2, 3})
+			branches := source.Tee(2)
+			So(branches, ShouldHaveLength, 2)
+			source.Start(ctrl)
+
+			collected := make(chan []int, len(branches))
+			for _, branch := range branches {
+				out := branch.Start(ctrl)
+				go func() {
+					recs := []interface{}{}
+					for rec := range out {
+						recs = append(recs, rec)
+					}
+					collected <- sortedInts(recs)
+				}()
+			}
+
+			So(<-collected, ShouldResemble, []int{1, 2, 3})
+			So(<-collected, ShouldResemble, []int{1, 2, 3})
+		})
+
+		Convey("Broadcast writes every record to each output", func() {
+			first := make(chan interface{}, 3)
+			second := make(chan interface{}, 3)
+
+			StreamArray([]int{1, 2, 3}).Broadcast(first, second).Start(ctrl)
+			ctrl.Wait()
+			close(first)
+			close(second)
+
+			So(len(first), ShouldEqual, 3)
+			So(len(second), ShouldEqual, 3)
+		})
+
+		Convey("Map, Filter and FlatMap reshape records in the order they were added", func() {
+			results, err := StreamArray([]int{1, 2, 3, 4}).
+				Filter(func(rec interface{}) bool {
+					return rec.(int)%2 == 0
+				}).
+				Map(func(rec interface{}) (interface{}, error) {
+					return rec.(int) * 10, nil
+				}).
+				FlatMap(func(rec interface{}) ([]interface{}, error) {
+					return []interface{}{rec, rec.(int) + 1}, nil
+				}).
+				Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []interface{}{20, 21, 40, 41})
+		})
+
+		Convey("Map reports errors and drops the record", func() {
+			ctrl.CollectErrors(NeverFail)
+			out := StreamArray([]int{1, 2}).Map(func(rec interface{}) (interface{}, error) {
+				if rec.(int) == 1 {
+					return nil, errors.New("one")
+				}
+				return rec, nil
+			}).Start(ctrl)
+
+			results := []interface{}{}
+			for rec := range out {
+				results = append(results, rec)
+			}
+
+			So(results, ShouldResemble, []interface{}{2})
+			So(ctrl.Error(), ShouldNotBeNil)
+		})
+
+		Convey("Workers processes records in parallel", func() {
+			results, err := StreamArray([]int{1, 2, 3, 4, 5, 6}).Workers(3).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(sortedInts(results), ShouldResemble, []int{1, 2, 3, 4, 5, 6})
+		})
+
+		Convey("Ordered preserves the input order across workers", func() {
+			input := make([]int, 200)
+			for i := range input {
+				input[i] = i
+			}
+
+			results, err := StreamArray(input).Workers(8).Ordered(true).Map(func(rec interface{}) (interface{}, error) {
+				time.Sleep(time.Duration(rec.(int)%5) * time.Millisecond)
+				return rec, nil
+			}).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldHaveLength, len(input))
+			for i, rec := range results {
+				So(rec, ShouldEqual, i)
+			}
+		})
+
+		Convey("Ordered reports errors with the name of the stream and the worker which failed", func() {
+			ctrl.CollectErrors(NeverFail)
+			// Hold each record until both workers have taken one, so each worker reports an error
+			var started sync.WaitGroup
+			started.Add(2)
+			out := StreamArray([]int{1, 2}).Named("geocode").Workers(2).Ordered(true).Map(func(rec interface{}) (interface{}, error) {
+				started.Done()
+				started.Wait()
+				return nil, errors.New("failed")
+			}).Start(ctrl)
+			for range out {
+			}
+
+			err := ctrl.Error()
+			So(err, ShouldHaveSameTypeAs, MultiError{})
+			workers := []int{}
+			for _, err := range err.(MultiError) {
+				taskErr := err.(*TaskError)
+				So(taskErr.Task, ShouldEqual, "geocode")
+				workers = append(workers, taskErr.Worker)
+			}
+			sort.Ints(workers)
+			So(workers, ShouldResemble, []int{0, 1})
+		})
+
+		Convey("Batch", func() {
+			Convey("groups records into slices, flushing the partial batch", func() {
+				results, err := StreamArray([]int{1, 2, 3, 4, 5}).Batch(2, 0).Collect(ctrl)
+				So(err, ShouldBeNil)
+				So(results, ShouldResemble, []interface{}{
+					[]interface{}{1, 2},
+					[]interface{}{3, 4},
+					[]interface{}{5},
+				})
+			})
+
+			Convey("emits a partial batch after maxWait", func() {
+				input := make(chan interface{})
+				out := Stream(input).Batch(10, 10*time.Millisecond).Start(ctrl)
+
+				input <- 1
+				input <- 2
+				So(<-out, ShouldResemble, []interface{}{1, 2})
+
+				input <- 3
+				close(input)
+				So(<-out, ShouldResemble, []interface{}{3})
+			})
+		})
+
+		Convey("TumblingWindow groups records by key", func() {
+			results, err := StreamArray([]int{1, 2, 3, 4}).TumblingWindow(time.Hour, func(rec interface{}) interface{} {
+				return rec.(int) % 2
+			}).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldHaveLength, 2)
+			for _, rec := range results {
+				window := rec.(Window)
+				So(window.End.Sub(window.Start), ShouldEqual, time.Hour)
+				So(len(window.Records), ShouldEqual, 2)
+				for _, rec := range window.Records {
+					So(rec.(int)%2, ShouldEqual, window.Key)
+				}
+			}
+		})
+
+		Convey("Windows group records by keys which can't be compared", func() {
+			results, err := StreamArray([]int{1, 2, 3}).TumblingWindow(time.Hour, func(rec interface{}) interface{} {
+				return []int{rec.(int) % 2}
+			}).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldHaveLength, 2)
+			So(results[0].(Window).Key, ShouldResemble, []int{1})
+			So(results[0].(Window).Records, ShouldResemble, []interface{}{1, 3})
+		})
+
+		Convey("SlidingWindow places records in every open window", func() {
+			results, err := StreamArray([]int{1, 2, 3}).SlidingWindow(time.Hour, 30*time.Minute, nil).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldHaveLength, 2)
+			for _, rec := range results {
+				So(rec.(Window).Records, ShouldResemble, []interface{}{1, 2, 3})
+			}
+		})
+
+		Convey("Windows and batches report an error instead of starting when", func() {
+			invalid := func(configure func(*Streamer) *Streamer) error {
+				var err error
+				So(finishes(func() {
+					_, err = configure(StreamArray([]int{1, 2, 3})).Collect(ctrl)
+				}, time.Second), ShouldBeTrue)
+				return err
+			}
+
+			Convey("the size is not positive", func() {
+				err := invalid(func(s *Streamer) *Streamer { return s.TumblingWindow(0, nil) })
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "size must be greater than zero")
+			})
+
+			Convey("the slide is not positive", func() {
+				err := invalid(func(s *Streamer) *Streamer { return s.SlidingWindow(time.Hour, 0, nil) })
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "slide must be greater than zero")
+			})
+
+			Convey("the slide is longer than the size", func() {
+				err := invalid(func(s *Streamer) *Streamer { return s.SlidingWindow(time.Minute, time.Hour, nil) })
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "no greater than the size")
+			})
+
+			Convey("a batch has no size or maxWait", func() {
+				err := invalid(func(s *Streamer) *Streamer { return s.Batch(0, 0) })
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "Invalid batch")
+
+				err = invalid(func(s *Streamer) *Streamer { return s.Batch(-1, time.Second) })
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
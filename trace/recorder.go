@@ -0,0 +1,116 @@
+package trace
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Recorder is a Tracer which keeps its spans in memory, for use in tests
+type Recorder struct {
+	mu     sync.Mutex
+	nextID uint64
+	spans  []*RecordedSpan
+}
+
+// A RecordedSpan is a span started by a Recorder
+type RecordedSpan struct {
+	ID         uint64
+	ParentID   uint64
+	Name       string
+	Attributes map[string]interface{}
+	Errors     []error
+	StartTime  time.Time
+	EndTime    time.Time
+
+	recorder *Recorder
+}
+
+// recorderKey is the context key under which a Recorder stores the current span
+type recorderKey struct{}
+
+// NewRecorder builds a new, empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Start starts a span which is a child of the span in ctx, if there is one
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	span := &RecordedSpan{
+		ID:         r.nextID,
+		Name:       name,
+		Attributes: map[string]interface{}{},
+		StartTime:  time.Now(),
+		recorder:   r,
+	}
+	if parent, ok := ctx.Value(recorderKey{}).(*RecordedSpan); ok && parent.recorder == r {
+		span.ParentID = parent.ID
+	}
+	for _, attr := range attrs {
+		span.Attributes[attr.Key] = attr.Value
+	}
+	r.spans = append(r.spans, span)
+
+	return context.WithValue(ctx, recorderKey{}, span), span
+}
+
+// Spans returns a copy of every span which has ended, in the order they were started
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := []RecordedSpan{}
+	for _, span := range r.spans {
+		if span.EndTime.IsZero() {
+			continue
+		}
+		copied := *span
+		copied.Attributes = map[string]interface{}{}
+		for key, value := range span.Attributes {
+			copied.Attributes[key] = value
+		}
+		copied.Errors = append([]error{}, span.Errors...)
+		spans = append(spans, copied)
+	}
+	return spans
+}
+
+// Named returns the ended spans with the specified name
+func (r *Recorder) Named(name string) []RecordedSpan {
+	spans := []RecordedSpan{}
+	for _, span := range r.Spans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// SetAttributes adds attributes to the span
+func (s *RecordedSpan) SetAttributes(attrs ...Attribute) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	for _, attr := range attrs {
+		s.Attributes[attr.Key] = attr.Value
+	}
+}
+
+// RecordError records that the operation failed with err
+func (s *RecordedSpan) RecordError(err error) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.Errors = append(s.Errors, err)
+}
+
+// End completes the span. Only the first call has an effect
+func (s *RecordedSpan) End() {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	if s.EndTime.IsZero() {
+		s.EndTime = time.Now()
+	}
+}
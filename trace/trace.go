@@ -0,0 +1,52 @@
+// Package trace defines the tracing hooks ingest stages report spans into. Its shape mirrors
+// OpenTelemetry's Tracer and Span, so an OpenTelemetry tracer can be adapted with a thin wrapper
+package trace
+
+import (
+	"context"
+)
+
+// An Attribute is a key and value describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String builds an Attribute with a string value
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int builds an Attribute with an integer value
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// A Span is a single operation within a trace
+type Span interface {
+	// SetAttributes adds attributes to the span
+	SetAttributes(attrs ...Attribute)
+	// RecordError records that the operation failed with err
+	RecordError(err error)
+	// End completes the span
+	End()
+}
+
+// A Tracer starts spans
+type Tracer interface {
+	// Start starts a span which is a child of the span in ctx, if there is one, returning a
+	// context containing the new span
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Noop is a Tracer whose spans are thrown away
+var Noop Tracer = noop{}
+
+type noop struct{}
+
+func (noop) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noop{}
+}
+func (noop) SetAttributes(attrs ...Attribute) {}
+func (noop) RecordError(err error)            {}
+func (noop) End()                             {}
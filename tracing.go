@@ -0,0 +1,35 @@
+package ingest
+
+import (
+	"github.com/urbint/ingest/trace"
+)
+
+// DefaultTracer is the Tracer ingest will report spans to when a Controller has not been
+// configured with WithTracer. By default, spans are discarded
+var DefaultTracer trace.Tracer = trace.Noop
+
+// WithTracer is a chainable configuration method that sets the Tracer the Controller's children,
+// and the stages run under them, report spans to. It must be called before the stages are started.
+//
+// Spans are parented using the Controller's context, so a span in the context passed to
+// NewControllerWithContext becomes the parent of the pipeline's spans
+func (c *Controller) WithTracer(tracer trace.Tracer) *Controller {
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	root.tracer = tracer
+	return c
+}
+
+// Tracer returns the Tracer the Controller's children, and the stages run under them, report spans to
+func (c *Controller) Tracer() trace.Tracer {
+	root := c.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if root.tracer == nil {
+		return DefaultTracer
+	}
+	return root.tracer
+}
@@ -0,0 +1,65 @@
+package ingest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/urbint/ingest/trace"
+)
+
+func TestTracing(t *testing.T) {
+	Convey("Tracing", t, func() {
+		recorder := trace.NewRecorder()
+		ctrl := NewController().WithTracer(recorder).CollectErrors(NeverFail)
+
+		Convey("each named child is a span parented by its ancestors", func() {
+			parent := ctrl.ChildNamed("parent")
+			child := parent.ChildNamed("child")
+			child.ChildBuilt()
+			parent.ChildBuilt()
+			ctrl.Wait()
+
+			spans := recorder.Spans()
+			So(spans, ShouldHaveLength, 2)
+			So(spans[0].Name, ShouldEqual, "parent")
+			So(spans[1].Name, ShouldEqual, "child")
+			So(spans[1].ParentID, ShouldEqual, spans[0].ID)
+		})
+
+		Convey("errors reported by a stage are recorded on its span", func() {
+			out := StreamArray([]int{1}).ForEach(func(rec interface{}) error {
+				return errors.New("failed")
+			}).Start(ctrl)
+			for range out {
+			}
+			ctrl.Wait()
+
+			spans := recorder.Named("stream-array")
+			So(spans, ShouldHaveLength, 1)
+			So(spans[0].Errors, ShouldHaveLength, 1)
+		})
+
+		Convey("each downloaded file is a span", func() {
+			dir, err := ioutil.TempDir("", "trace")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			file, err := ioutil.TempFile(dir, "source")
+			So(err, ShouldBeNil)
+			file.Close()
+
+			for res := range Download(file.Name()).DownloadTo(dir).Start(ctrl) {
+				res.Close()
+			}
+			ctrl.Wait()
+
+			spans := recorder.Named("download-file")
+			So(spans, ShouldHaveLength, 1)
+			So(spans[0].Attributes["file"], ShouldEqual, file.Name())
+			So(spans[0].ParentID, ShouldEqual, recorder.Named("download")[0].ID)
+		})
+	})
+}
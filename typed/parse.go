@@ -0,0 +1,104 @@
+package typed
+
+import (
+	"io"
+
+	"github.com/urbint/ingest"
+	"github.com/urbint/ingest/parse"
+)
+
+// A CSVParser is a parse.CSVParser which allocates and produces records of type *T.
+//
+// The embedded parse.CSVParser can be used to configure the parser
+type CSVParser[T any] struct {
+	*parse.CSVParser
+}
+
+// CSV builds a CSVParser which will read from the specified input channel and decode each row into a *T
+func CSV[T any](input <-chan io.ReadCloser) *CSVParser[T] {
+	parser := parse.CSV(input)
+	parser.AllocateWith(func() interface{} { return new(T) })
+	return &CSVParser[T]{parser}
+}
+
+// Start starts running the parser under the control of the specified controller
+func (c *CSVParser[T]) Start(ctrl *ingest.Controller) <-chan *T {
+	out := make(chan *T)
+	c.CSVParser.SendTo(ingest.OutputOf(out)).Start(ctrl)
+	return out
+}
+
+// Stream starts running the parser under the control of the specified controller, returning a
+// Stream which reads the parsed records
+func (c *CSVParser[T]) Stream(ctrl *ingest.Controller) *Stream[*T] {
+	return StreamOf(c.Start(ctrl))
+}
+
+// Collect reads all of the parsed records into a slice, under the control of the specified controller
+func (c *CSVParser[T]) Collect(ctrl *ingest.Controller) ([]*T, error) {
+	return c.Stream(ctrl).Collect(ctrl)
+}
+
+// A JSONParser is a parse.JSONParser which allocates and produces records of type *T.
+//
+// The embedded parse.JSONParser can be used to configure the parser
+type JSONParser[T any] struct {
+	*parse.JSONParser
+}
+
+// JSON builds a JSONParser which will read from the specified input channel and decode each record into a *T
+func JSON[T any](input <-chan io.ReadCloser) *JSONParser[T] {
+	parser := parse.JSON(input)
+	parser.Struct(new(T))
+	return &JSONParser[T]{parser}
+}
+
+// Start starts running the parser under the control of the specified controller
+func (j *JSONParser[T]) Start(ctrl *ingest.Controller) <-chan *T {
+	out := make(chan *T)
+	j.JSONParser.SendTo(ingest.OutputOf(out)).Start(ctrl)
+	return out
+}
+
+// Stream starts running the parser under the control of the specified controller, returning a
+// Stream which reads the parsed records
+func (j *JSONParser[T]) Stream(ctrl *ingest.Controller) *Stream[*T] {
+	return StreamOf(j.Start(ctrl))
+}
+
+// Collect reads all of the parsed records into a slice, under the control of the specified controller
+func (j *JSONParser[T]) Collect(ctrl *ingest.Controller) ([]*T, error) {
+	return j.Stream(ctrl).Collect(ctrl)
+}
+
+// An XMLParser is a parse.XMLParser which allocates and produces records of type *T.
+//
+// The embedded parse.XMLParser can be used to configure the parser
+type XMLParser[T any] struct {
+	*parse.XMLParser
+}
+
+// XML builds an XMLParser which will read from the specified input channel and decode each record into a *T
+func XML[T any](input <-chan io.ReadCloser) *XMLParser[T] {
+	parser := parse.XML(input)
+	parser.Struct(new(T))
+	return &XMLParser[T]{parser}
+}
+
+// Start starts running the parser under the control of the specified controller
+func (x *XMLParser[T]) Start(ctrl *ingest.Controller) <-chan *T {
+	out := make(chan *T)
+	x.XMLParser.SendTo(ingest.OutputOf(out)).Start(ctrl)
+	return out
+}
+
+// Stream starts running the parser under the control of the specified controller, returning a
+// Stream which reads the parsed records
+func (x *XMLParser[T]) Stream(ctrl *ingest.Controller) *Stream[*T] {
+	return StreamOf(x.Start(ctrl))
+}
+
+// Collect reads all of the parsed records into a slice, under the control of the specified controller
+func (x *XMLParser[T]) Collect(ctrl *ingest.Controller) ([]*T, error) {
+	return x.Stream(ctrl).Collect(ctrl)
+}
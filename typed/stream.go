@@ -0,0 +1,190 @@
+package typed
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/urbint/ingest"
+)
+
+// A Stream is an ingest.Streamer whose records are all of type T
+type Stream[T any] struct {
+	stream *ingest.Streamer
+	out    chan T
+}
+
+// StreamOf builds a Stream which will read from the input channel
+func StreamOf[T any](input <-chan T) *Stream[T] {
+	return &Stream[T]{stream: ingest.NewStream().ReadFrom(ingest.InputOf(input))}
+}
+
+// StreamArray builds a Stream which will read from the provided slice
+func StreamArray[T any](array []T) *Stream[T] {
+	return Wrap[T](ingest.StreamArray(array))
+}
+
+// Wrap builds a Stream from an existing ingest.Streamer whose records are of type T.
+//
+// Records which turn out not to be a T are reported to the controller running the Stream
+func Wrap[T any](stream *ingest.Streamer) *Stream[T] {
+	return &Stream[T]{stream: stream}
+}
+
+// Untyped returns the ingest.Streamer wrapped by the Stream, which can be used for configuration
+// that has no typed equivalent
+func (s *Stream[T]) Untyped() *ingest.Streamer {
+	return s.stream
+}
+
+// ForEach is a chainable configuration method that will execute a function on each record
+// of the Stream. See ingest.Streamer.ForEach
+func (s *Stream[T]) ForEach(fn func(rec T) error) *Stream[T] {
+	return s.ForEachContext(func(ctx context.Context, rec T) error {
+		return fn(rec)
+	})
+}
+
+// ForEachContext is a chainable configuration method that behaves like ForEach, but the function
+// will also receive the context of the Controller running the Stream
+func (s *Stream[T]) ForEachContext(fn func(ctx context.Context, rec T) error) *Stream[T] {
+	s.stream.ForEachContext(func(ctx context.Context, rec interface{}) error {
+		typed, err := cast[T](rec)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, typed)
+	})
+	return s
+}
+
+// Filter is a chainable configuration method that drops every record for which the specified
+// function returns false
+func (s *Stream[T]) Filter(fn func(rec T) bool) *Stream[T] {
+	s.stream.FlatMap(func(rec interface{}) ([]interface{}, error) {
+		typed, err := cast[T](rec)
+		if err != nil {
+			return nil, err
+		}
+		if !fn(typed) {
+			return nil, nil
+		}
+		return []interface{}{rec}, nil
+	})
+	return s
+}
+
+// Workers is a chainable configuration method that sets how many workers will process the
+// records of the Stream
+func (s *Stream[T]) Workers(count int) *Stream[T] {
+	s.stream.Workers(count)
+	return s
+}
+
+// Ordered is a chainable configuration method that sets whether the Stream will emit records
+// in the order that they were read when there are multiple workers
+func (s *Stream[T]) Ordered(ordered bool) *Stream[T] {
+	s.stream.Ordered(ordered)
+	return s
+}
+
+// StopOnDrain is a chainable configuration method that sets whether the Stream will stop reading
+// its input when the controller begins draining
+func (s *Stream[T]) StopOnDrain(stop bool) *Stream[T] {
+	s.stream.StopOnDrain(stop)
+	return s
+}
+
+// RateLimit is a chainable configuration method that limits the Stream to writing perSecond
+// records per second, with bursts of up to burst records
+func (s *Stream[T]) RateLimit(perSecond float64, burst int) *Stream[T] {
+	s.stream.RateLimit(perSecond, burst)
+	return s
+}
+
+// DependOn is a chainable configuration method that will not proceed until all
+// specified controllers have resolved
+func (s *Stream[T]) DependOn(ctrls ...*ingest.Controller) *Stream[T] {
+	s.stream.DependOn(ctrls...)
+	return s
+}
+
+// Map returns a Stream which replaces each record of s with the result of the specified function.
+//
+// The returned Stream shares its configuration with s, which should not be used afterwards
+func Map[T, U any](s *Stream[T], fn func(rec T) (U, error)) *Stream[U] {
+	s.stream.Map(func(rec interface{}) (interface{}, error) {
+		typed, err := cast[T](rec)
+		if err != nil {
+			return nil, err
+		}
+		return fn(typed)
+	})
+	return &Stream[U]{stream: s.stream}
+}
+
+// FlatMap returns a Stream which replaces each record of s with all of the records returned by
+// the specified function.
+//
+// The returned Stream shares its configuration with s, which should not be used afterwards
+func FlatMap[T, U any](s *Stream[T], fn func(rec T) ([]U, error)) *Stream[U] {
+	s.stream.FlatMap(func(rec interface{}) ([]interface{}, error) {
+		typed, err := cast[T](rec)
+		if err != nil {
+			return nil, err
+		}
+		results, err := fn(typed)
+		if err != nil {
+			return nil, err
+		}
+		recs := make([]interface{}, len(results))
+		for i, result := range results {
+			recs[i] = result
+		}
+		return recs, nil
+	})
+	return &Stream[U]{stream: s.stream}
+}
+
+// Start starts running the Stream under the control of the specified controller, returning the
+// channel records are written to. Starting a Stream which has already been started returns the
+// same channel
+func (s *Stream[T]) Start(ctrl *ingest.Controller) <-chan T {
+	if s.out == nil {
+		s.out = make(chan T)
+		s.stream.SendTo(ingest.OutputOf(s.out)).Start(ctrl)
+	}
+	return s.out
+}
+
+// Collect reads the records of the Stream into a slice, under the control of the specified controller
+func (s *Stream[T]) Collect(ctrl *ingest.Controller) ([]T, error) {
+	recs, err := s.stream.Collect(ctrl)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]T, len(recs))
+	for i, rec := range recs {
+		if results[i], err = cast[T](rec); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// Produce starts the Stream under the control of the specified controller, allowing it to be
+// used as the Source of an ingest.Pipeline
+func (s *Stream[T]) Produce(ctrl *ingest.Controller) <-chan interface{} {
+	return s.stream.Start(ctrl)
+}
+
+// Transform reads from the specified input and starts the Stream under the control of the
+// specified controller, allowing it to be used as a Transform in an ingest.Pipeline
+func (s *Stream[T]) Transform(ctrl *ingest.Controller, in <-chan interface{}) <-chan interface{} {
+	return s.stream.Transform(ctrl, in)
+}
+
+// Produces returns the type of record produced by the Stream
+func (s *Stream[T]) Produces() reflect.Type {
+	return typeOf[T]()
+}
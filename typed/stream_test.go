@@ -0,0 +1,221 @@
+package typed
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/urbint/ingest"
+)
+
+type person struct {
+	Name string `csv:"name" json:"name"`
+	Age  int    `csv:"age" json:"age"`
+}
+
+func TestStream(t *testing.T) {
+	Convey("Stream", t, func() {
+		ctrl := ingest.NewController()
+
+		Convey("Filter and Map operate on typed records", func() {
+			evens := StreamArray([]int{1, 2, 3, 4}).Filter(func(rec int) bool {
+				return rec%2 == 0
+			})
+			results, err := Map(evens, func(rec int) (string, error) {
+				return strconv.Itoa(rec * 10), nil
+			}).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []string{"20", "40"})
+		})
+
+		Convey("StreamOf reads from a typed channel", func() {
+			input := make(chan string, 2)
+			input <- "a"
+			input <- "b"
+			close(input)
+
+			results, err := FlatMap(StreamOf(input), func(rec string) ([]string, error) {
+				return []string{rec, strings.ToUpper(rec)}, nil
+			}).Collect(ctrl)
+
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []string{"a", "A", "b", "B"})
+		})
+
+		Convey("Wrap reports records of the wrong type instead of panicking", func() {
+			out := Wrap[int](ingest.StreamArray([]interface{}{1, "two", 3})).Start(ctrl)
+
+			results := []int{}
+			for rec := range out {
+				results = append(results, rec)
+			}
+
+			So(results, ShouldResemble, []int{1, 3})
+			So(ctrl.Error(), ShouldNotBeNil)
+		})
+
+		Convey("Wrap rejects nil records unless the record type is an interface", func() {
+			out := Wrap[int](ingest.StreamArray([]interface{}{1, nil, 3})).Start(ctrl)
+
+			results := []int{}
+			for rec := range out {
+				results = append(results, rec)
+			}
+
+			So(results, ShouldResemble, []int{1, 3})
+			So(ctrl.Error(), ShouldNotBeNil)
+
+			stringers := []fmt.Stringer{}
+			for rec := range Wrap[fmt.Stringer](ingest.StreamArray([]interface{}{nil})).Start(ingest.NewController()) {
+				stringers = append(stringers, rec)
+			}
+			So(stringers, ShouldResemble, []fmt.Stringer{nil})
+		})
+
+		Convey("Wrap names interface record types in its errors", func() {
+			for range Wrap[fmt.Stringer](ingest.StreamArray([]interface{}{1})).Start(ctrl) {
+			}
+
+			err := ctrl.Error()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Expected a fmt.Stringer, received int")
+		})
+
+		Convey("Start returns the same channel when called again", func() {
+			stream := StreamArray([]int{1, 2})
+			out := stream.Start(ctrl)
+			So(stream.Start(ctrl), ShouldEqual, out)
+
+			results := []int{}
+			for rec := range out {
+				results = append(results, rec)
+			}
+			So(results, ShouldResemble, []int{1, 2})
+		})
+
+		Convey("ForEach errors are reported to the controller", func() {
+			_, err := StreamArray([]int{1}).ForEach(func(rec int) error {
+				return errors.New("failed")
+			}).Collect(ctrl)
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestParsers(t *testing.T) {
+	Convey("Typed parsers produce pointers to the record type", t, func() {
+		ctrl := ingest.NewController()
+		input := func(contents string) <-chan io.ReadCloser {
+			in := make(chan io.ReadCloser, 1)
+			in <- ioutil.NopCloser(strings.NewReader(contents))
+			close(in)
+			return in
+		}
+
+		Convey("CSV", func() {
+			results, err := CSV[person](input("name,age\nada,36\n")).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []*person{{Name: "ada", Age: 36}})
+		})
+
+		Convey("JSON", func() {
+			results, err := JSON[person](input(`{"name": "ada", "age": 36}`)).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []*person{{Name: "ada", Age: 36}})
+		})
+
+		Convey("JSON records which fail to decode are not sent on", func() {
+			results, err := JSON[person](input(`{"name": "ada", "age": "old"} {"name": "bob", "age": 42}`)).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []*person{{Name: "bob", Age: 42}})
+		})
+	})
+}
+
+func TestParserErrors(t *testing.T) {
+	Convey("Parsers which abort on an error never send after their output is closed", t, func() {
+		rows := "name,age\nada,young\n" + strings.Repeat("bob,42\n", 1000)
+		run := func(ctrl *ingest.Controller) (int, error) {
+			in := make(chan io.ReadCloser, 1)
+			in <- ioutil.NopCloser(strings.NewReader(rows))
+			close(in)
+			parser := CSV[person](in)
+			parser.AbortOnError(true)
+			parser.Opts.NumWorkers = 1
+
+			count := 0
+			for range parser.Start(ctrl) {
+				count++
+			}
+			return count, ctrl.Error()
+		}
+
+		Convey("when the error aborts the controller", func() {
+			_, err := run(ingest.NewController())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("when errors are collected", func() {
+			count, err := run(ingest.NewController().CollectErrors(ingest.NeverFail))
+			So(err, ShouldNotBeNil)
+			So(count, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestParserCheckpoints(t *testing.T) {
+	Convey("Parsers resume after the rows checkpointed by a previous run", t, func() {
+		dir, err := ioutil.TempDir("", "typed-checkpoints")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		store := ingest.NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+		open := func(name, contents string) <-chan io.ReadCloser {
+			path := filepath.Join(dir, name)
+			So(ioutil.WriteFile(path, []byte(contents), 0644), ShouldBeNil)
+			file, err := os.Open(path)
+			So(err, ShouldBeNil)
+			in := make(chan io.ReadCloser, 1)
+			in <- file
+			close(in)
+			return in
+		}
+		resumeFrom := func(checkpoint ingest.Checkpoint) *ingest.Controller {
+			checkpoint.Source = filepath.Join(dir, checkpoint.Source)
+			So(store.Save([]ingest.Checkpoint{checkpoint}), ShouldBeNil)
+			checkpointer, err := ingest.NewCheckpointer(store)
+			So(err, ShouldBeNil)
+			return ingest.NewController().WithCheckpointer(checkpointer)
+		}
+
+		Convey("CSV", func() {
+			ctrl := resumeFrom(ingest.Checkpoint{Stage: "parse-csv", Source: "people.csv", Offset: 2})
+			results, err := CSV[person](open("people.csv", "name,age\nada,36\nbob,42\ncy,7\n")).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []*person{{Name: "cy", Age: 7}})
+		})
+
+		Convey("JSON", func() {
+			ctrl := resumeFrom(ingest.Checkpoint{Stage: "parse-json", Source: "people.json", Offset: 1})
+			results, err := JSON[person](open("people.json", `{"name": "ada", "age": 36} {"name": "bob", "age": 42}`)).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, []*person{{Name: "bob", Age: 42}})
+		})
+
+		Convey("skip sources which were finished", func() {
+			ctrl := resumeFrom(ingest.Checkpoint{Stage: "parse-csv", Source: "people.csv", Offset: 1, Done: true})
+			results, err := CSV[person](open("people.csv", "name,age\nada,36\n")).Collect(ctrl)
+			So(err, ShouldBeNil)
+			So(results, ShouldBeEmpty)
+		})
+	})
+}
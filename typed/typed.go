@@ -0,0 +1,28 @@
+// Package typed provides a generic API over the ingest Streamer and parsers, so that the type of
+// the records flowing through a pipeline is checked at compile time.
+//
+// Each of the types is a thin wrapper over the interface{} based API of the ingest, parse and write
+// packages, which remains available for configuration that has no typed equivalent. Records are
+// read from and written to typed channels directly with ingest.InputOf and ingest.OutputOf, rather
+// than being relayed between typed and untyped channels
+package typed
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// cast converts an untyped record to T, returning an error if it is of a different type. A nil
+// record is only a T if T is an interface
+func cast[T any](rec interface{}) (T, error) {
+	typed, ok := rec.(T)
+	if !ok && (rec != nil || typeOf[T]().Kind() != reflect.Interface) {
+		return typed, fmt.Errorf("Expected a %v, received %T", typeOf[T](), rec)
+	}
+	return typed, nil
+}
+
+// typeOf returns the type T. Unlike the type of its zero value, it is not nil when T is an interface
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
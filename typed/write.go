@@ -0,0 +1,15 @@
+package typed
+
+import (
+	"github.com/olivere/elastic"
+	"github.com/urbint/ingest"
+	"github.com/urbint/ingest/write"
+)
+
+// Elasticsearch builds a write.ElasticWriter which reads records of type T from in directly.
+//
+// Unlike write.Elasticsearch, which reads from a chan of write.ElasticWritable, the type of the
+// records is checked at compile time
+func Elasticsearch[T write.ElasticWritable](client *elastic.Client, in <-chan T) *write.ElasticWriter {
+	return write.Elasticsearch(client, nil).ReadFrom(ingest.InputOf(in))
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"time"
 )
 
 // An Unzipper will download and extract the specified URLs
@@ -59,7 +61,7 @@ func Unzip(urls ...string) *Unzipper {
 
 // Start starts running the Unzip task under the control of the specified controller
 func (u *Unzipper) Start(ctrl *Controller) <-chan io.ReadCloser {
-	ctrl = ctrl.Child()
+	ctrl = ctrl.ChildNamed("unzip")
 	defer ctrl.ChildBuilt()
 
 	u.depGroup.Wait()
@@ -73,12 +75,40 @@ func (u *Unzipper) Start(ctrl *Controller) <-chan io.ReadCloser {
 	files := Download(u.URLs...).WithOpts(u.Opts.DownloadOpts).Start(ctrl)
 
 	for i := 0; i < u.Opts.MaxParallelUnzips; i++ {
-		u.startUnzipWorker(ctrl, files, unzipped)
+		u.startUnzipWorker(ctrl, i, files, unzipped)
 	}
 
 	return unzipped
 }
 
+// Produce starts the Unzipper under the control of the specified controller, allowing it to
+// be used as the Source of a Pipeline
+func (u *Unzipper) Produce(ctrl *Controller) <-chan interface{} {
+	readers := u.Start(ctrl)
+	out := make(chan interface{})
+
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+		defer close(out)
+		for reader := range readers {
+			select {
+			case <-ctrl.Quit:
+				reader.Close()
+				return
+			case out <- reader:
+			}
+		}
+	}()
+
+	return out
+}
+
+// Produces returns the type of record produced by the Unzipper
+func (u *Unzipper) Produces() reflect.Type {
+	return reflect.TypeOf((*io.ReadCloser)(nil)).Elem()
+}
+
 // Filter sets a filepath.Match pattern that will be used to filter the results
 // from the unzipper.
 //
@@ -116,29 +146,42 @@ func (u *Unzipper) DependOn(ctrls ...*Controller) *Unzipper {
 	return u
 }
 
-func (u *Unzipper) startUnzipWorker(ctrl *Controller, input <-chan *os.File, output chan<- io.ReadCloser) {
+func (u *Unzipper) startUnzipWorker(ctrl *Controller, id int, input <-chan *os.File, output chan<- io.ReadCloser) {
+	log := u.Log.WithField("worker", id)
 	ctrl.WorkerStart()
-	u.Log.Debug("Starting worker")
+	log.Debug("Starting worker")
+	progress := ctrl.Stage("unzip")
 	go func() {
 		defer ctrl.WorkerEnd()
-		defer u.Log.Debug("Exiting worker")
+		defer log.Debug("Exiting worker")
 		for {
+			// Stop taking new archives once the controller begins draining
+			if ctrl.IsDraining() {
+				return
+			}
 			select {
-			case <-ctrl.Quit:
+			case <-ctrl.Draining():
 				return
 			case file, ok := <-input:
 				if !ok {
 					return
 				}
+				progress.In(1)
+				started := time.Now()
 				results, err := u.UnzipFile(file)
+				progress.Observe(time.Since(started))
 				if err != nil {
-					ctrl.Err <- err
+					progress.Failed(1)
+					ctrl.ReportError("unzip", id, err)
 				} else {
-					for _, result := range results {
+					for i, result := range results {
+						// Files which have already been unzipped are passed on while draining
 						select {
 						case <-ctrl.Quit:
+							closeAll(results[i:])
 							return
 						case output <- result:
+							progress.Out(1)
 							continue
 						}
 					}
@@ -150,7 +193,8 @@ func (u *Unzipper) startUnzipWorker(ctrl *Controller, input <-chan *os.File, out
 
 // UnzipFile will unzip the specified os.File and return an array of ReadClosers
 //
-// The file will be closed as a result of being passed to Unzip
+// The file will be closed as a result of being passed to Unzip. Each ReadCloser has a Name method
+// which returns the path of the archive joined with the path of the file within it
 func (u *Unzipper) UnzipFile(file *os.File) ([]io.ReadCloser, error) {
 	result := []io.ReadCloser{}
 
@@ -168,12 +212,10 @@ func (u *Unzipper) UnzipFile(file *os.File) ([]io.ReadCloser, error) {
 			opened, err := inside.Open()
 			if err != nil {
 				// We errored, close all of the open files before returning the error
-				for _, file := range result {
-					file.Close()
-				}
+				closeAll(result)
 				return nil, err
 			}
-			result = append(result, opened)
+			result = append(result, zipEntry{opened, file.Name() + "/" + name, int64(inside.UncompressedSize64)})
 		} else {
 			fileLog.Debug("Skipping file")
 		}
@@ -184,6 +226,31 @@ func (u *Unzipper) UnzipFile(file *os.File) ([]io.ReadCloser, error) {
 	return result, nil
 }
 
+// zipEntry is a file read from a zip archive. It is named by the path of the archive and the
+// path of the file within it, so that parsers can checkpoint it
+type zipEntry struct {
+	io.ReadCloser
+	name string
+	size int64
+}
+
+// Name returns the path of the archive joined with the path of the file within it
+func (e zipEntry) Name() string {
+	return e.name
+}
+
+// Size returns the uncompressed size of the file
+func (e zipEntry) Size() int64 {
+	return e.size
+}
+
+// closeAll closes all of the specified readers
+func closeAll(readers []io.ReadCloser) {
+	for _, reader := range readers {
+		reader.Close()
+	}
+}
+
 // filterMatch will return whether the specified file name matches the configured filter
 func (u *Unzipper) filterMatch(fileName string) bool {
 	if u.Opts.Filter == "" {
@@ -0,0 +1,264 @@
+package ingest
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// StreamKeyFn is a function that returns the key used to group a record into windows. Keys which
+// can't be compared with ==, such as slices and maps, are grouped by their formatted value
+type StreamKeyFn func(rec interface{}) interface{}
+
+// A Window is a group of records emitted by a Streamer configured with
+// TumblingWindow or SlidingWindow
+type Window struct {
+	// Key is the key returned by the StreamKeyFn for each of the records in the window
+	Key interface{}
+	// Start is the time the window opened, inclusive
+	Start time.Time
+	// End is the time the window closes, exclusive
+	End time.Time
+	// Records are the records that arrived while the window was open, in the order they arrived
+	Records []interface{}
+}
+
+// A grouper collects the records of a Streamer into batches or windows
+type grouper interface {
+	// add adds a record which arrived at the specified time, returning any groups which are complete
+	add(rec interface{}, now time.Time) []interface{}
+	// expire returns the groups which are complete as of the specified time
+	expire(now time.Time) []interface{}
+	// deadline returns the next time a group will be complete, if there is one
+	deadline() (time.Time, bool)
+	// flush returns all of the remaining groups
+	flush() []interface{}
+}
+
+// Batch is a chainable configuration method that groups the records of the Streamer
+// into []interface{} slices of the specified size.
+//
+// A partial batch is emitted once maxWait has elapsed since its first record arrived, and when
+// the input of the Streamer is closed. A size or maxWait of 0 disables that limit.
+//
+// Neither may be negative, and at least one must be set, otherwise the Streamer reports an error
+// when started
+func (s *Streamer) Batch(size int, maxWait time.Duration) *Streamer {
+	if size < 0 || maxWait < 0 || (size == 0 && maxWait == 0) {
+		s.err = fmt.Errorf("Invalid batch: size and maxWait must not be negative, and one must be greater than zero, received %d and %s", size, maxWait)
+		return s
+	}
+	s.group = func() grouper {
+		return &batcher{size: size, maxWait: maxWait}
+	}
+	return s
+}
+
+// TumblingWindow is a chainable configuration method that groups the records of the Streamer
+// into non-overlapping windows of the specified duration, with a separate window for each key
+// returned by keyFn. Each window is emitted as a Window once it closes.
+//
+// Windows are aligned to multiples of size and are based on the time each record reaches the
+// grouping stage. If keyFn is nil, all records share a single key. Open windows are emitted
+// when the input of the Streamer is closed.
+//
+// The size must be greater than zero, otherwise the Streamer reports an error when started
+func (s *Streamer) TumblingWindow(size time.Duration, keyFn StreamKeyFn) *Streamer {
+	return s.SlidingWindow(size, size, keyFn)
+}
+
+// SlidingWindow is a chainable configuration method that groups the records of the Streamer
+// into windows of the specified duration, a new one of which opens every slide, with a separate
+// window for each key returned by keyFn. Each record is part of every window open when it arrives.
+//
+// The slide must be greater than zero and no greater than size, otherwise the Streamer reports
+// an error when started. Windows behave like those of TumblingWindow in all other respects
+func (s *Streamer) SlidingWindow(size, slide time.Duration, keyFn StreamKeyFn) *Streamer {
+	if size <= 0 {
+		s.err = fmt.Errorf("Invalid window: size must be greater than zero, received %s", size)
+		return s
+	}
+	if slide <= 0 || slide > size {
+		s.err = fmt.Errorf("Invalid window: slide must be greater than zero and no greater than the size of %s, received %s", size, slide)
+		return s
+	}
+	if keyFn == nil {
+		keyFn = func(rec interface{}) interface{} { return nil }
+	}
+	s.group = func() grouper {
+		return &windower{size: size, slide: slide, keyFn: keyFn, index: map[windowID]*Window{}}
+	}
+	return s
+}
+
+// startGrouping starts a worker which groups the records read from in and writes the groups
+// to all of the outputs. The final groups are written once in is closed.
+//
+// Grouped records can not be followed to the sink, so they are released from the Checkpointer
+func (s *Streamer) startGrouping(ctrl *Controller, in <-chan interface{}, outputs []Output) {
+	groups := s.group()
+	checkpoints := ctrl.Checkpointer()
+
+	ctrl.WorkerStart()
+	go func() {
+		defer ctrl.WorkerEnd()
+
+		for {
+			var timer *time.Timer
+			var timeout <-chan time.Time
+			if deadline, ok := groups.deadline(); ok {
+				timer = time.NewTimer(deadline.Sub(time.Now()))
+				timeout = timer.C
+			}
+
+			var ready []interface{}
+			select {
+			case <-ctrl.Quit:
+				return
+			case rec, ok := <-in:
+				if !ok {
+					s.emit(ctrl, 0, outputs, groups.flush())
+					return
+				}
+				checkpoints.Release(rec)
+				ready = groups.add(rec, time.Now())
+			case now := <-timeout:
+				ready = groups.expire(now)
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+			if !s.emit(ctrl, 0, outputs, ready) {
+				return
+			}
+		}
+	}()
+}
+
+// batcher groups records into slices of a maximum size
+type batcher struct {
+	size    int
+	maxWait time.Duration
+
+	batch   []interface{}
+	started time.Time
+}
+
+func (b *batcher) add(rec interface{}, now time.Time) []interface{} {
+	if len(b.batch) == 0 {
+		b.started = now
+	}
+	b.batch = append(b.batch, rec)
+	if b.size > 0 && len(b.batch) >= b.size {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *batcher) expire(now time.Time) []interface{} {
+	if deadline, ok := b.deadline(); ok && !now.Before(deadline) {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *batcher) deadline() (time.Time, bool) {
+	if b.maxWait <= 0 || len(b.batch) == 0 {
+		return time.Time{}, false
+	}
+	return b.started.Add(b.maxWait), true
+}
+
+func (b *batcher) flush() []interface{} {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	batch := b.batch
+	b.batch = nil
+	return []interface{}{batch}
+}
+
+// windowID identifies an open window
+type windowID struct {
+	key   interface{}
+	start time.Time
+}
+
+// uncomparableKey is a key which can't be compared with ==, formatted along with its type
+type uncomparableKey string
+
+// indexKey returns the key a window is indexed by, which is the key itself unless it can't be
+// compared, as using it in a map would panic
+func indexKey(key interface{}) interface{} {
+	if key == nil || reflect.ValueOf(key).Comparable() {
+		return key
+	}
+	return uncomparableKey(fmt.Sprintf("%T %#v", key, key))
+}
+
+// windower groups records into keyed windows which open every slide and last for size
+type windower struct {
+	size  time.Duration
+	slide time.Duration
+	keyFn StreamKeyFn
+
+	open  []*Window
+	index map[windowID]*Window
+}
+
+func (w *windower) add(rec interface{}, now time.Time) []interface{} {
+	ready := w.expire(now)
+
+	key := w.keyFn(rec)
+	for start := now.Truncate(w.slide); start.Add(w.size).After(now); start = start.Add(-w.slide) {
+		id := windowID{indexKey(key), start}
+		window, exists := w.index[id]
+		if !exists {
+			window = &Window{Key: key, Start: start, End: start.Add(w.size)}
+			w.index[id] = window
+			w.open = append(w.open, window)
+		}
+		window.Records = append(window.Records, rec)
+	}
+
+	return ready
+}
+
+func (w *windower) expire(now time.Time) []interface{} {
+	var ready []interface{}
+	open := w.open[:0]
+	for _, window := range w.open {
+		if now.Before(window.End) {
+			open = append(open, window)
+			continue
+		}
+		delete(w.index, windowID{indexKey(window.Key), window.Start})
+		ready = append(ready, *window)
+	}
+	w.open = open
+	return ready
+}
+
+func (w *windower) deadline() (time.Time, bool) {
+	if len(w.open) == 0 {
+		return time.Time{}, false
+	}
+	next := w.open[0].End
+	for _, window := range w.open[1:] {
+		if window.End.Before(next) {
+			next = window.End
+		}
+	}
+	return next, true
+}
+
+func (w *windower) flush() []interface{} {
+	ready := make([]interface{}, len(w.open))
+	for i, window := range w.open {
+		ready[i] = *window
+	}
+	w.open = nil
+	w.index = map[windowID]*Window{}
+	return ready
+}
@@ -1,13 +1,19 @@
 package write
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mcuadros/go-defaults"
 	"github.com/olivere/elastic"
 	"github.com/urbint/ingest"
+	"github.com/urbint/ingest/metrics"
+	"github.com/urbint/ingest/trace"
 	"github.com/urbint/ingest/utils"
 )
 
@@ -19,20 +25,41 @@ type ElasticWriterOpts struct {
 	FlushSize         int           `default:"15000000"`
 	AbortOnError      bool          `default:"false"`
 	Progress          chan struct{}
+	DeadLetters       ingest.DeadLetterSink
+	Backoff           elastic.Backoff // defaults to an exponential backoff from 200ms to 10s
 }
 
 // An ElasticWriter writes records to Elasticsearch
 type ElasticWriter struct {
 	Opts ElasticWriterOpts
 
-	In  <-chan ElasticWritable
-	Log ingest.Logger
+	In    <-chan ElasticWritable
+	Log   ingest.Logger
+	input ingest.Input
 
 	errs chan error
 	es   *elastic.Client
 
 	processor    *elastic.BulkProcessor
 	pendingCount uint32
+	progress     *ingest.StageProgress
+
+	flushLatency metrics.Histogram
+	flushMu      sync.Mutex
+	flushes      map[int64]flush
+	ctx          context.Context
+	tracer       trace.Tracer
+
+	checkpoints *ingest.Checkpointer
+	sampler     *ingest.Sampler
+	pendingMu   sync.Mutex
+	pending     map[elastic.BulkableRequest]ElasticWritable
+}
+
+// flush is a bulk request which has been sent to Elasticsearch
+type flush struct {
+	started time.Time
+	span    trace.Span
 }
 
 // ElasticWritable is an interface that a record must implement to be stored in Elasticsearch
@@ -44,6 +71,15 @@ type ElasticWritable interface {
 	ForElastic() (index string, elasticType string, id string, data interface{})
 }
 
+// ElasticContextWritable is an ElasticWritable which is handed the context of the writer's Controller,
+// which is cancelled when the Controller quits. ForElasticContext is used instead of ForElastic
+type ElasticContextWritable interface {
+	ElasticWritable
+
+	// ForElasticContext returns a record for elasticsearch as ForElastic does
+	ForElasticContext(ctx context.Context) (index string, elasticType string, id string, data interface{})
+}
+
 // ForElastic converts a chan of interface to a chan of ElasticWritable
 func ForElastic(in <-chan interface{}) chan ElasticWritable {
 	result := make(chan ElasticWritable)
@@ -73,7 +109,9 @@ func Elasticsearch(client *elastic.Client, input <-chan ElasticWritable) *Elasti
 }
 
 // ReportProgressTo is a chainable configuration method that sets where
-// progress will be reported to
+// progress will be reported to.
+//
+// A goroutine is started for each event, so ingest.Controller.ReportProgressEvery is preferred
 func (e *ElasticWriter) ReportProgressTo(dest chan struct{}) *ElasticWriter {
 	e.Opts.Progress = dest
 	return e
@@ -114,6 +152,28 @@ func (e *ElasticWriter) FlushSize(numBytes int) *ElasticWriter {
 	return e
 }
 
+// RetryWith is a chainable configuration method used to set the Backoff which decides when, and how
+// many times, failed bulk requests are retried. Retries are counted by the writer's metrics
+func (e *ElasticWriter) RetryWith(backoff elastic.Backoff) *ElasticWriter {
+	e.Opts.Backoff = backoff
+	return e
+}
+
+// ReadFrom is a chainable configuration method that sets the Input the writer reads records from
+// instead of In, such as a channel of another type adapted with ingest.InputOf. Records which are
+// not ElasticWritable are reported to the controller
+func (e *ElasticWriter) ReadFrom(in ingest.Input) *ElasticWriter {
+	e.input = in
+	return e
+}
+
+// DeadLetterTo is a chainable configuration method that sets where documents which
+// Elasticsearch fails to store are sent
+func (e *ElasticWriter) DeadLetterTo(sink ingest.DeadLetterSink) *ElasticWriter {
+	e.Opts.DeadLetters = sink
+	return e
+}
+
 // ApplySettings reads the configured SettingsPath and applies the settings file to
 // elasticsearch cluster.
 func (e *ElasticWriter) ApplySettings(indexName string, settingsPath string) error {
@@ -157,30 +217,64 @@ func (e *ElasticWriter) CreateIndexWithSettings(indexName string, settingsPath s
 
 // Start starts the ElasticWriter under the control of the *ingest.Controller
 func (e *ElasticWriter) Start(ctrl *ingest.Controller) {
+	e.progress = ctrl.Stage("write-elasticsearch")
+	e.flushLatency = ctrl.Metrics().Histogram("ingest_bulk_flush_duration_seconds",
+		"Time taken to flush each bulk request.", metrics.Labels{"stage": "write-elasticsearch"}, nil)
+	e.flushes = map[int64]flush{}
+	e.ctx, e.tracer = ctrl.Context(), ctrl.Tracer()
+	e.checkpoints = ctrl.Checkpointer()
+	e.sampler = ctrl.Sampler()
+	e.pending = map[elastic.BulkableRequest]ElasticWritable{}
+
 	if err := e.startBulkProcessor(); err != nil {
-		ctrl.Err <- err
+		ctrl.ReportError("write-elasticsearch", 0, err)
 		return
 	}
 	defer e.stopBulkProcessor()
 
+	input := e.input
+	if input == nil {
+		input = ingest.InputOf(e.In)
+	}
 	for {
 		select {
-		case <-ctrl.Quit:
-			return
 		case err := <-e.errs:
-			ctrl.Err <- err
+			ctrl.ReportError("write-elasticsearch", 0, err)
 			if e.Opts.AbortOnError {
 				return
 			}
-		case rec, ok := <-e.In:
-			if !ok {
-				return
-			}
-			e.storeRec(rec)
+			continue
+		default:
+		}
+		rec, ok := input.Receive(ctrl.Quit)
+		if !ok {
+			return
+		}
+		writable, isWritable := rec.(ElasticWritable)
+		if !isWritable {
+			ctrl.ReportError("write-elasticsearch", 0, fmt.Errorf("Expected an ElasticWritable, received %T", rec))
+			continue
 		}
+		e.storeRec(writable)
 	}
 }
 
+// Consume reads from the specified input and writes the records to Elasticsearch under the control
+// of the specified controller, allowing the ElasticWriter to be used as the Sink of a Pipeline
+func (e *ElasticWriter) Consume(ctrl *ingest.Controller, in <-chan interface{}) {
+	e.ReadFrom(ingest.InputOf(in)).Start(ctrl)
+}
+
+// Acknowledges returns true, as the ElasticWriter acknowledges records once they have been flushed
+func (e *ElasticWriter) Acknowledges() bool {
+	return true
+}
+
+// Accepts returns the type of record accepted by the ElasticWriter
+func (e *ElasticWriter) Accepts() reflect.Type {
+	return reflect.TypeOf((*ElasticWritable)(nil)).Elem()
+}
+
 // startBulkProcessor starts the elastic.BulkProcessor
 func (e *ElasticWriter) startBulkProcessor() error {
 	e.Log.Debug("Starting BulkInserter")
@@ -189,6 +283,8 @@ func (e *ElasticWriter) startBulkProcessor() error {
 		BulkActions(e.Opts.MaxPendingActions).
 		BulkSize(e.Opts.FlushSize).
 		FlushInterval(e.Opts.FlushInterval).
+		Backoff(e.backoff()).
+		Before(e.beforeFlush).
 		After(e.afterFlush).
 		Do()
 
@@ -200,6 +296,30 @@ func (e *ElasticWriter) startBulkProcessor() error {
 	return nil
 }
 
+// backoff returns the configured Backoff, wrapped so each retry it allows is counted
+func (e *ElasticWriter) backoff() elastic.Backoff {
+	backoff := e.Opts.Backoff
+	if backoff == nil {
+		backoff = elastic.NewExponentialBackoff(200*time.Millisecond, 10*time.Second)
+	}
+	return countingBackoff{backoff, e.progress}
+}
+
+// countingBackoff is an elastic.Backoff which counts the retries it allows
+type countingBackoff struct {
+	elastic.Backoff
+	progress *ingest.StageProgress
+}
+
+// Next returns how long to wait before the next retry, and whether to retry at all
+func (b countingBackoff) Next(retry int) (time.Duration, bool) {
+	wait, ok := b.Backoff.Next(retry)
+	if ok {
+		b.progress.Retried(1)
+	}
+	return wait, ok
+}
+
 // stopBulkProcessor flushes any pending records and returns
 func (e *ElasticWriter) stopBulkProcessor() error {
 	if err := e.processor.Flush(); err != nil {
@@ -209,24 +329,87 @@ func (e *ElasticWriter) stopBulkProcessor() error {
 }
 
 func (e *ElasticWriter) storeRec(rec ElasticWritable) {
-	index, elasticType, id, data := rec.ForElastic()
+	var index, elasticType, id string
+	var data interface{}
+	if withContext, hasContext := rec.(ElasticContextWritable); hasContext {
+		index, elasticType, id, data = withContext.ForElasticContext(e.ctx)
+	} else {
+		index, elasticType, id, data = rec.ForElastic()
+	}
 	if data == nil {
+		e.ack(rec)
 		return
 	}
 
-	e.processor.Add(elastic.NewBulkIndexRequest().Index(index).Type(elasticType).Id(id).Doc(data))
+	request := elastic.NewBulkIndexRequest().Index(index).Type(elasticType).Id(id).Doc(data)
+	if e.checkpoints != nil {
+		e.pendingMu.Lock()
+		e.pending[request] = rec
+		e.pendingMu.Unlock()
+	}
+	e.processor.Add(request)
+	e.progress.In(1)
 	atomic.AddUint32(&e.pendingCount, 1)
 }
 
+func (e *ElasticWriter) beforeFlush(id int64, requests []elastic.BulkableRequest) {
+	_, span := e.tracer.Start(e.ctx, "bulk-flush", trace.Int("requests", int64(len(requests))))
+
+	e.flushMu.Lock()
+	e.flushes[id] = flush{started: time.Now(), span: span}
+	e.flushMu.Unlock()
+}
+
 func (e *ElasticWriter) afterFlush(id int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if response.Errors {
-		for _, item := range response.Failed() {
-			esErr := item.Error
-			e.Log.WithField("reason", esErr.Reason).WithField("type", esErr.Type).Error("Error in bulk insert")
-		}
-	}
+	e.flushMu.Lock()
+	flushed, known := e.flushes[id]
+	delete(e.flushes, id)
+	e.flushMu.Unlock()
+
+	failed := 0
+	acked := make([]bool, len(requests))
 	if err != nil {
 		e.Log.WithError(err).Error("error writing to elasticsearch")
+		failed = len(requests)
+		for _, request := range requests {
+			e.deadLetter(request, "", "", err)
+		}
+	} else {
+		for i := range acked {
+			acked[i] = true
+		}
+	}
+	if err == nil && response != nil && response.Errors {
+		// The items of the response are in the same order as the requests
+		for i, items := range response.Items {
+			for _, item := range items {
+				if item.Status >= 200 && item.Status <= 299 {
+					continue
+				}
+				itemErr := fmt.Errorf("bulk insert failed with status %d", item.Status)
+				if esErr := item.Error; esErr != nil {
+					e.Log.WithField("reason", esErr.Reason).WithField("type", esErr.Type).Error("Error in bulk insert")
+					itemErr = fmt.Errorf("%s: %s", esErr.Type, esErr.Reason)
+				}
+				failed++
+				if i < len(requests) {
+					e.deadLetter(requests[i], item.Index, item.Id, itemErr)
+					acked[i] = e.Opts.DeadLetters != nil
+				}
+			}
+		}
+	}
+	e.checkpoint(requests, acked)
+	e.progress.Failed(failed)
+	e.progress.Out(len(requests) - failed)
+
+	if known {
+		e.flushLatency.Observe(time.Since(flushed.started).Seconds())
+		flushed.span.SetAttributes(trace.Int("failed", int64(failed)))
+		if err != nil {
+			flushed.span.RecordError(err)
+		}
+		flushed.span.End()
 	}
 
 	recsStored := atomic.LoadUint32(&e.pendingCount)
@@ -240,5 +423,54 @@ func (e *ElasticWriter) afterFlush(id int64, requests []elastic.BulkableRequest,
 			}
 		}()
 	}
+}
 
+// checkpoint acknowledges the records of the acknowledged requests, so that the checkpoints of the
+// sources they were read from can advance. Records which failed are only acknowledged once they
+// have been sent to the DeadLetterSink, otherwise they are read again when the import is resumed
+func (e *ElasticWriter) checkpoint(requests []elastic.BulkableRequest, acked []bool) {
+	if e.checkpoints == nil {
+		return
+	}
+
+	recs := make([]interface{}, 0, len(requests))
+	e.pendingMu.Lock()
+	for i, request := range requests {
+		if rec, known := e.pending[request]; known {
+			delete(e.pending, request)
+			if acked[i] {
+				recs = append(recs, rec)
+			}
+		}
+	}
+	e.pendingMu.Unlock()
+
+	e.ack(recs...)
+}
+
+// ack acknowledges that the records have been written, logging any error encountered while
+// saving the checkpoints
+func (e *ElasticWriter) ack(recs ...interface{}) {
+	if err := e.checkpoints.Ack(recs...); err != nil {
+		e.Log.WithError(err).Error("Error saving checkpoint")
+	}
+}
+
+// deadLetter sends a document which failed to be stored to the configured DeadLetterSink, unless
+// it is a dry run, which must not write anything
+func (e *ElasticWriter) deadLetter(request elastic.BulkableRequest, index string, id string, err error) {
+	if e.Opts.DeadLetters == nil || e.sampler != nil {
+		return
+	}
+
+	// The source of a request is its action, followed by the document
+	var raw []byte
+	if lines, sourceErr := request.Source(); sourceErr == nil && len(lines) > 0 {
+		raw = []byte(lines[len(lines)-1])
+	}
+
+	letter := ingest.DeadLetter{Stage: "write-elasticsearch", Source: index, ID: id, Raw: raw, Err: err}
+	if sendErr := e.Opts.DeadLetters.Send(letter); sendErr != nil {
+		e.Log.WithError(sendErr).Error("Error sending dead letter")
+	}
 }